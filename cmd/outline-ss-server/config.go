@@ -0,0 +1,459 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+)
+
+type Config struct {
+	Keys []KeyConfig
+	// Ports holds optional per-port settings.  Ports are opened only if they
+	// have at least one key.
+	Ports []PortConfig `yaml:",omitempty" json:",omitempty"`
+	// SaltMarking controls how server salts are marked, on all ports.
+	SaltMarking *SaltMarkingConfig `yaml:"salt_marking,omitempty" json:"salt_marking,omitempty"`
+}
+
+// SaltMarkingConfig describes the marks that let the server recognize its own
+// salts, to reject reflected connections.
+type SaltMarkingConfig struct {
+	// Secret may be changed to rotate the marks without changing the keys.
+	Secret  string `yaml:",omitempty" json:",omitempty"`
+	MarkLen int    `yaml:"mark_len,omitempty" json:"mark_len,omitempty"`
+	// Previous secrets are still recognized until they expire.
+	Previous []PreviousSaltSecretConfig `yaml:",omitempty" json:",omitempty"`
+}
+
+type PreviousSaltSecretConfig struct {
+	Secret string
+	// Expiry is an RFC 3339 time, e.g. "2026-10-01T00:00:00Z".
+	Expiry string
+}
+
+func (c *SaltMarkingConfig) marking() (*service.SaltMarking, error) {
+	if c == nil {
+		return nil, nil
+	}
+	marking := &service.SaltMarking{Secret: c.Secret, MarkLen: c.MarkLen}
+	for _, previous := range c.Previous {
+		expiry, err := time.Parse(time.RFC3339, previous.Expiry)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid expiry: %v", err)
+		}
+		marking.Previous = append(marking.Previous, service.PreviousSaltSecret{Secret: previous.Secret, Expiry: expiry})
+	}
+	if err := marking.Validate(); err != nil {
+		return nil, err
+	}
+	return marking, nil
+}
+
+type KeyConfig struct {
+	ID     string
+	Port   int
+	Cipher string
+	Secret string
+	// Egress overrides the port's egress settings for this key.
+	Egress *EgressConfig `yaml:",omitempty" json:",omitempty"`
+	// NATTimeouts overrides the port's UDP NAT timeout rules for this key.
+	NATTimeouts []NATTimeoutConfig `yaml:"nat_timeouts,omitempty" json:"nat_timeouts,omitempty"`
+}
+
+type PortConfig struct {
+	Port int
+	// Listeners is the number of TCP and UDP sockets to open with SO_REUSEPORT,
+	// each served by its own goroutines.  It only takes effect when the port is opened.
+	// The UDP NAT limits are divided among the sockets, rounding down, so they
+	// can't be lower than Listeners.
+	Listeners int           `yaml:",omitempty" json:",omitempty"`
+	Egress    *EgressConfig `yaml:",omitempty" json:",omitempty"`
+	TCP       *TCPConfig    `yaml:"tcp,omitempty" json:"tcp,omitempty"`
+	UDP       *UDPConfig    `yaml:"udp,omitempty" json:"udp,omitempty"`
+	// ProxyProtocol accepts client addresses from load balancers.
+	ProxyProtocol *ProxyProtocolConfig `yaml:"proxy_protocol,omitempty" json:"proxy_protocol,omitempty"`
+	// Socket is the name, in LISTEN_FDNAMES, of the inherited sockets to serve
+	// the port with.  By default, inherited sockets bound to the port are used.
+	Socket string `yaml:",omitempty" json:",omitempty"`
+}
+
+// ProxyProtocolConfig lists the load balancers that put PROXY protocol headers
+// in front of TCP connections, and optionally UDP packets.
+type ProxyProtocolConfig struct {
+	// Trusted lists the networks of the load balancers, e.g. "10.0.0.0/8".
+	// Connections from them must start with a header.
+	Trusted []string
+	// UDP requires a v2 header in each UDP packet from trusted networks.
+	UDP bool `yaml:",omitempty" json:",omitempty"`
+}
+
+func (c *ProxyProtocolConfig) policy() (*service.ProxyProtocolPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	policy := &service.ProxyProtocolPolicy{}
+	for _, cidr := range c.Trusted {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		policy.TrustedNetworks = append(policy.TrustedNetworks, network)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// EgressConfig controls the address family of outbound connections.
+type EgressConfig struct {
+	// Family is one of "any", "prefer_ipv4", "prefer_ipv6", "ipv4_only" or "ipv6_only".
+	Family string `yaml:",omitempty" json:",omitempty"`
+	// FallbackDelay is the Happy Eyeballs delay.  Negative values disable it.
+	FallbackDelay time.Duration `yaml:"fallback_delay,omitempty" json:"fallback_delay,omitempty"`
+	// NAT64Prefix, e.g. "64:ff9b::/96", is used to reach IPv4 targets in ipv6_only mode.
+	NAT64Prefix string `yaml:"nat64_prefix,omitempty" json:"nat64_prefix,omitempty"`
+}
+
+func (c *EgressConfig) policy() (*service.EgressPolicy, error) {
+	if c == nil {
+		return nil, nil
+	}
+	family, err := service.ParseIPFamily(c.Family)
+	if err != nil {
+		return nil, err
+	}
+	policy := &service.EgressPolicy{Family: family, FallbackDelay: c.FallbackDelay}
+	if c.NAT64Prefix != "" {
+		if policy.NAT64Prefix, err = onet.ParseNAT64Prefix(c.NAT64Prefix); err != nil {
+			return nil, err
+		}
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// TCPConfig limits outbound connection attempts and the lifetime of TCP
+// connections.  Zero values disable each limit.
+type TCPConfig struct {
+	ConnectTimeout    time.Duration `yaml:"connect_timeout,omitempty" json:"connect_timeout,omitempty"`
+	ConnectAttempts   int           `yaml:"connect_attempts,omitempty" json:"connect_attempts,omitempty"`
+	ClientIdleTimeout time.Duration `yaml:"client_idle_timeout,omitempty" json:"client_idle_timeout,omitempty"`
+	TargetIdleTimeout time.Duration `yaml:"target_idle_timeout,omitempty" json:"target_idle_timeout,omitempty"`
+	MaxDuration       time.Duration `yaml:"max_duration,omitempty" json:"max_duration,omitempty"`
+	// Fallback forwards connections that fail authentication to another service.
+	Fallback *FallbackConfig `yaml:"fallback,omitempty" json:"fallback,omitempty"`
+	// Probes controls how connections that fail authentication are absorbed.
+	Probes *ProbeConfig `yaml:"probes,omitempty" json:"probes,omitempty"`
+	// Padding randomizes the length of the first response to each client.
+	Padding *PaddingConfig `yaml:"padding,omitempty" json:"padding,omitempty"`
+	// Socket tunes the client, target and listening sockets.
+	Socket *TCPSocketConfig `yaml:"socket,omitempty" json:"socket,omitempty"`
+}
+
+// TCPSocketConfig holds TCP socket options.  Omitted values keep the system defaults.
+type TCPSocketConfig struct {
+	KeepAliveIdle     time.Duration `yaml:"keepalive_idle,omitempty" json:"keepalive_idle,omitempty"`
+	KeepAliveInterval time.Duration `yaml:"keepalive_interval,omitempty" json:"keepalive_interval,omitempty"`
+	KeepAliveCount    int           `yaml:"keepalive_count,omitempty" json:"keepalive_count,omitempty"`
+	// NoDelay is true by default.
+	NoDelay     *bool         `yaml:"no_delay,omitempty" json:"no_delay,omitempty"`
+	UserTimeout time.Duration `yaml:"user_timeout,omitempty" json:"user_timeout,omitempty"`
+	// FastOpenQueue enables TCP Fast Open from clients.
+	FastOpenQueue   int  `yaml:"fast_open_queue,omitempty" json:"fast_open_queue,omitempty"`
+	FastOpenConnect bool `yaml:"fast_open_connect,omitempty" json:"fast_open_connect,omitempty"`
+	MultipathTCP    bool `yaml:"mptcp,omitempty" json:"mptcp,omitempty"`
+	DSCP            int  `yaml:"dscp,omitempty" json:"dscp,omitempty"`
+}
+
+func (c *TCPConfig) socketOptions() (*service.TCPSocketOptions, error) {
+	if c == nil || c.Socket == nil {
+		return nil, nil
+	}
+	opts := &service.TCPSocketOptions{
+		KeepAliveIdle:     c.Socket.KeepAliveIdle,
+		KeepAliveInterval: c.Socket.KeepAliveInterval,
+		KeepAliveCount:    c.Socket.KeepAliveCount,
+		Nagle:             c.Socket.NoDelay != nil && !*c.Socket.NoDelay,
+		UserTimeout:       c.Socket.UserTimeout,
+		FastOpenQueue:     c.Socket.FastOpenQueue,
+		FastOpenConnect:   c.Socket.FastOpenConnect,
+		MultipathTCP:      c.Socket.MultipathTCP,
+		DSCP:              c.Socket.DSCP,
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid socket config: %v", err)
+	}
+	return opts, nil
+}
+
+// PaddingConfig describes how the first response to each client is split into chunks.
+// Each count is chosen uniformly between its minimum and maximum.
+type PaddingConfig struct {
+	MinChunks int `yaml:"min_chunks,omitempty" json:"min_chunks,omitempty"`
+	MaxChunks int `yaml:"max_chunks,omitempty" json:"max_chunks,omitempty"`
+	// Empty chunks are only accepted by some clients.
+	MinEmptyChunks int `yaml:"min_empty_chunks,omitempty" json:"min_empty_chunks,omitempty"`
+	MaxEmptyChunks int `yaml:"max_empty_chunks,omitempty" json:"max_empty_chunks,omitempty"`
+}
+
+func (c *TCPConfig) padding() (*ss.PaddingPolicy, error) {
+	if c == nil || c.Padding == nil {
+		return nil, nil
+	}
+	policy := &ss.PaddingPolicy{
+		MinChunks:      c.Padding.MinChunks,
+		MaxChunks:      c.Padding.MaxChunks,
+		MinEmptyChunks: c.Padding.MinEmptyChunks,
+		MaxEmptyChunks: c.Padding.MaxEmptyChunks,
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid padding config: %v", err)
+	}
+	return policy, nil
+}
+
+// ProbeConfig describes how connections that fail authentication are absorbed.
+type ProbeConfig struct {
+	// AuthTimeout replaces the default deadline to authenticate.
+	AuthTimeout time.Duration `yaml:"auth_timeout,omitempty" json:"auth_timeout,omitempty"`
+	// AuthJitter adds a random delay, up to this long, to the deadline of each connection.
+	AuthJitter time.Duration `yaml:"auth_jitter,omitempty" json:"auth_jitter,omitempty"`
+	// MaxBytes closes the connection after the client sends this many bytes.
+	MaxBytes int64 `yaml:"max_bytes,omitempty" json:"max_bytes,omitempty"`
+	// Close is "fin" (the default) or "rst".
+	Close string `yaml:",omitempty" json:",omitempty"`
+}
+
+func (c *TCPConfig) probePolicy() (service.ProbePolicy, error) {
+	if c == nil || c.Probes == nil {
+		return service.ProbePolicy{}, nil
+	}
+	p := c.Probes
+	if p.AuthTimeout < 0 || p.AuthJitter < 0 || p.MaxBytes < 0 {
+		return service.ProbePolicy{}, fmt.Errorf("Probe settings must not be negative")
+	}
+	policy := service.ProbePolicy{AuthTimeout: p.AuthTimeout, AuthJitter: p.AuthJitter, MaxBytes: p.MaxBytes}
+	switch p.Close {
+	case "", "fin":
+	case "rst":
+		policy.Reset = true
+	default:
+		return service.ProbePolicy{}, fmt.Errorf("Unknown probe close style %q", p.Close)
+	}
+	return policy, nil
+}
+
+// FallbackConfig describes the service that receives unauthenticated connections.
+type FallbackConfig struct {
+	// Address is the host:port of the fallback service.
+	Address        string
+	ConnectTimeout time.Duration `yaml:"connect_timeout,omitempty" json:"connect_timeout,omitempty"`
+}
+
+func (c *TCPConfig) fallback() (*service.TCPFallback, error) {
+	if c == nil || c.Fallback == nil {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(c.Fallback.Address); err != nil {
+		return nil, fmt.Errorf("Invalid fallback address: %v", err)
+	}
+	if c.Fallback.ConnectTimeout < 0 {
+		return nil, fmt.Errorf("Fallback connect timeout must not be negative")
+	}
+	return &service.TCPFallback{Address: c.Fallback.Address, ConnectTimeout: c.Fallback.ConnectTimeout}, nil
+}
+
+func (c *TCPConfig) timeouts() (service.TCPTimeouts, error) {
+	if c == nil {
+		return service.TCPTimeouts{}, nil
+	}
+	if c.ConnectTimeout < 0 || c.ConnectAttempts < 0 || c.ClientIdleTimeout < 0 || c.TargetIdleTimeout < 0 || c.MaxDuration < 0 {
+		return service.TCPTimeouts{}, fmt.Errorf("TCP timeouts must not be negative")
+	}
+	return service.TCPTimeouts{
+		Connect:         c.ConnectTimeout,
+		ConnectAttempts: c.ConnectAttempts,
+		ClientIdle:      c.ClientIdleTimeout,
+		TargetIdle:      c.TargetIdleTimeout,
+		MaxDuration:     c.MaxDuration,
+	}, nil
+}
+
+// UDPConfig controls the UDP NAT table of a port.  Zero values disable each limit.
+type UDPConfig struct {
+	// NATFiltering is one of "endpoint_independent" (the default),
+	// "address_dependent" or "address_and_port_dependent".
+	NATFiltering             string `yaml:"nat_filtering,omitempty" json:"nat_filtering,omitempty"`
+	MaxNATEntries            int    `yaml:"max_nat_entries,omitempty" json:"max_nat_entries,omitempty"`
+	MaxNATEntriesPerClientIP int    `yaml:"max_nat_entries_per_client_ip,omitempty" json:"max_nat_entries_per_client_ip,omitempty"`
+	MaxNATEntriesPerKey      int    `yaml:"max_nat_entries_per_key,omitempty" json:"max_nat_entries_per_key,omitempty"`
+	// NATTimeouts sets the NAT timeout by destination.  The first matching rule applies.
+	NATTimeouts []NATTimeoutConfig `yaml:"nat_timeouts,omitempty" json:"nat_timeouts,omitempty"`
+	// Workers and QueueLen size the packet pipeline of each socket.  Zero
+	// means the defaults.
+	Workers  int `yaml:"workers,omitempty" json:"workers,omitempty"`
+	QueueLen int `yaml:"queue_len,omitempty" json:"queue_len,omitempty"`
+	// BatchSize enables batched socket I/O on Linux.
+	BatchSize int `yaml:"batch_size,omitempty" json:"batch_size,omitempty"`
+}
+
+// NATTimeoutConfig is a UDP NAT timeout rule.  Empty ports or networks match
+// any destination.
+type NATTimeoutConfig struct {
+	Ports     []int         `yaml:",omitempty" json:",omitempty"`
+	Networks  []string      `yaml:",omitempty" json:",omitempty"`
+	Timeout   time.Duration `yaml:",omitempty" json:",omitempty"`
+	FastClose bool          `yaml:"fast_close,omitempty" json:"fast_close,omitempty"`
+}
+
+// natTimeoutPolicy returns nil if there are no rules.
+func natTimeoutPolicy(configs []NATTimeoutConfig) (*service.NATTimeoutPolicy, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	policy := &service.NATTimeoutPolicy{}
+	for _, c := range configs {
+		rule := service.NATTimeoutRule{Ports: c.Ports, Timeout: c.Timeout, FastClose: c.FastClose}
+		for _, cidr := range c.Networks {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			rule.Networks = append(rule.Networks, network)
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (c *UDPConfig) natLimits() (service.NATLimits, error) {
+	if c == nil {
+		return service.NATLimits{}, nil
+	}
+	if c.MaxNATEntries < 0 || c.MaxNATEntriesPerClientIP < 0 || c.MaxNATEntriesPerKey < 0 {
+		return service.NATLimits{}, fmt.Errorf("UDP NAT limits must not be negative")
+	}
+	return service.NATLimits{
+		MaxEntries:            c.MaxNATEntries,
+		MaxEntriesPerClientIP: c.MaxNATEntriesPerClientIP,
+		MaxEntriesPerKey:      c.MaxNATEntriesPerKey,
+	}, nil
+}
+
+func (c *UDPConfig) pipeline() (service.UDPPipeline, error) {
+	if c == nil {
+		return service.UDPPipeline{}, nil
+	}
+	pipeline := service.UDPPipeline{Workers: c.Workers, QueueLen: c.QueueLen, BatchSize: c.BatchSize}
+	return pipeline, pipeline.Validate()
+}
+
+func (c *UDPConfig) natFiltering() (service.NATFiltering, error) {
+	if c == nil {
+		return service.EndpointIndependentFiltering, nil
+	}
+	return service.ParseNATFiltering(c.NATFiltering)
+}
+
+// maxListeners bounds PortConfig.Listeners, to avoid exhausting file descriptors.
+const maxListeners = 256
+
+// portOptions holds the parsed settings of a PortConfig.
+type portOptions struct {
+	listeners    int
+	egress       *service.EgressPolicy
+	tcpTimeouts  service.TCPTimeouts
+	tcpFallback  *service.TCPFallback
+	probePolicy  service.ProbePolicy
+	padding      *ss.PaddingPolicy
+	tcpSocket    *service.TCPSocketOptions
+	natLimits    service.NATLimits
+	natFiltering service.NATFiltering
+	natTimeouts  *service.NATTimeoutPolicy
+	udpPipeline  service.UDPPipeline
+	// The PROXY protocol policy of each protocol, or nil.
+	tcpProxyProtocol *service.ProxyProtocolPolicy
+	udpProxyProtocol *service.ProxyProtocolPolicy
+	// The name of the inherited sockets for the port, or empty.
+	socketName string
+}
+
+func (c *PortConfig) options() (portOptions, error) {
+	var opts portOptions
+	var err error
+	if c.Listeners < 0 || c.Listeners > maxListeners {
+		return opts, fmt.Errorf("Listeners must be between 0 and %v", maxListeners)
+	}
+	opts.listeners = c.Listeners
+	opts.socketName = c.Socket
+	if opts.egress, err = c.Egress.policy(); err != nil {
+		return opts, fmt.Errorf("Invalid egress config: %v", err)
+	}
+	if opts.tcpTimeouts, err = c.TCP.timeouts(); err != nil {
+		return opts, err
+	}
+	if opts.tcpFallback, err = c.TCP.fallback(); err != nil {
+		return opts, err
+	}
+	if opts.probePolicy, err = c.TCP.probePolicy(); err != nil {
+		return opts, err
+	}
+	if opts.padding, err = c.TCP.padding(); err != nil {
+		return opts, err
+	}
+	if opts.tcpSocket, err = c.TCP.socketOptions(); err != nil {
+		return opts, err
+	}
+	if opts.tcpSocket != nil && opts.tcpSocket.FastOpenConnect && opts.tcpTimeouts.ConnectAttempts > 1 {
+		// Connections only fail when data is sent, so there is nothing to retry.
+		return opts, fmt.Errorf("Fast Open to targets can't be used with more than one connect attempt")
+	}
+	if opts.natLimits, err = c.UDP.natLimits(); err != nil {
+		return opts, err
+	}
+	if _, exact := splitNATLimits(opts.natLimits, c.Listeners); !exact {
+		return opts, fmt.Errorf("UDP NAT limits must be at least the number of listeners (%v)", c.Listeners)
+	}
+	if opts.natFiltering, err = c.UDP.natFiltering(); err != nil {
+		return opts, err
+	}
+	if opts.udpPipeline, err = c.UDP.pipeline(); err != nil {
+		return opts, err
+	}
+	if opts.tcpProxyProtocol, err = c.ProxyProtocol.policy(); err != nil {
+		return opts, fmt.Errorf("Invalid PROXY protocol config: %v", err)
+	}
+	if c.ProxyProtocol != nil && c.ProxyProtocol.UDP {
+		opts.udpProxyProtocol = opts.tcpProxyProtocol
+	}
+	if c.UDP != nil {
+		if opts.natTimeouts, err = natTimeoutPolicy(c.UDP.NATTimeouts); err != nil {
+			return opts, fmt.Errorf("Invalid NAT timeouts: %v", err)
+		}
+	}
+	return opts, nil
+}
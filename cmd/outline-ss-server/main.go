@@ -15,8 +15,10 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
@@ -24,7 +26,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -63,35 +68,286 @@ func init() {
 }
 
 type ssPort struct {
-	tcpService service.TCPService
-	udpService service.UDPService
-	cipherList service.CipherList
+	// There is a service for each listener, and several listeners if the port
+	// uses SO_REUSEPORT.
+	tcpServices []service.TCPService
+	udpServices []service.UDPService
+	cipherList  service.CipherList
+	// The name of the port's sockets in the server's socketSet.
+	socketName string
+}
+
+// apply updates the settings of a running port.
+func (port *ssPort) apply(opts portOptions) {
+	for _, tcpService := range port.tcpServices {
+		tcpService.SetEgressPolicy(opts.egress)
+		tcpService.SetTimeouts(opts.tcpTimeouts)
+		tcpService.SetFallback(opts.tcpFallback)
+		tcpService.SetProbePolicy(opts.probePolicy)
+		tcpService.SetPadding(opts.padding)
+		tcpService.SetSocketOptions(opts.tcpSocket)
+		tcpService.SetProxyProtocol(opts.tcpProxyProtocol)
+	}
+	natLimits, exact := splitNATLimits(opts.natLimits, len(port.udpServices))
+	if !exact {
+		logger.Warningf("UDP NAT limits below the number of sockets (%v) allow one entry per socket", len(port.udpServices))
+	}
+	for _, udpService := range port.udpServices {
+		udpService.SetEgressPolicy(opts.egress)
+		udpService.SetNATLimits(natLimits)
+		udpService.SetNATFiltering(opts.natFiltering)
+		udpService.SetNATTimeouts(opts.natTimeouts)
+		udpService.SetProxyProtocol(opts.udpProxyProtocol)
+	}
+}
+
+// splitNATLimits returns the limits for each of `n` UDP sockets of a port.
+// Each socket has its own NAT table, and the kernel may send the flows of one
+// client IP or key to all of them, so the limits are divided among them,
+// rounding down.  A limit below `n` can't be enforced, since each socket
+// allows at least one entry.  Then the result is not `exact`.
+func splitNATLimits(limits service.NATLimits, n int) (split service.NATLimits, exact bool) {
+	if n <= 1 {
+		return limits, true
+	}
+	exact = true
+	divide := func(limit int) int {
+		if limit == 0 {
+			return 0
+		}
+		if limit < n {
+			exact = false
+			return 1
+		}
+		return limit / n
+	}
+	split = service.NATLimits{
+		MaxEntries:            divide(limits.MaxEntries),
+		MaxEntriesPerClientIP: divide(limits.MaxEntriesPerClientIP),
+		MaxEntriesPerKey:      divide(limits.MaxEntriesPerKey),
+	}
+	return split, exact
 }
 
 type SSServer struct {
-	natTimeout  time.Duration
-	m           metrics.ShadowsocksMetrics
-	replayCache service.ReplayCache
-	ports       map[int]*ssPort
+	natTimeout     time.Duration
+	m              metrics.ShadowsocksMetrics
+	replayCache    service.ReplayCache
+	udpReplayCache service.ReplayCache
+	replay         replayOptions
+	stopSaving     chan struct{}
+	probeLog       *service.ProbeLog
+	ports          map[int]*ssPort
+	// Sockets opened by another process, or nil.
+	sockets *socketSet
+	// Ports below this can only be served with inherited sockets, because the
+	// server dropped the privileges to open them.  Zero if there is no limit.
+	minNewPort atomic.Int32
+	// The files that the server reads and writes while it runs.  They change
+	// when it chroots.
+	files atomic.Pointer[serverFiles]
 }
 
-func (s *SSServer) startPort(portNum int) error {
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: portNum})
-	if err != nil {
-		return fmt.Errorf("Failed to start TCP on port %v: %v", portNum, err)
+// serverFiles are the paths of the config and replay files.
+type serverFiles struct {
+	config    string
+	replay    string
+	udpReplay string
+}
+
+// replayOptions configures the replay caches, and how they are saved across restarts.
+type replayOptions struct {
+	history    int
+	udpHistory int
+	// Salts are forgotten after this long, to free memory.  Zero means never.
+	expiry time.Duration
+	// Files for saving the caches.  Empty if the cache is not saved.
+	file    string
+	udpFile string
+	// How often to save the caches, in addition to when the server stops.
+	saveInterval time.Duration
+	// Saved caches older than this are ignored.  Zero means no limit.
+	maxAge time.Duration
+	// Whether a missing or corrupt file prevents the server from starting.
+	required bool
+	// Caches passed by the previous server in an upgrade, which are loaded
+	// instead of the files.  Nil if there was no upgrade.
+	inherited *replayState
+}
+
+// probeLogOptions configures the log of failed connections.
+type probeLogOptions struct {
+	// Number of recent probes to keep in memory.
+	history int
+	// Number of initial bytes of each probe to hash.
+	hashBytes int
+	// File for appending probes as JSON lines.  Empty if they are not written.
+	file string
+}
+
+// open returns the probe log, or nil if it is disabled.
+func (o *probeLogOptions) open() (*service.ProbeLog, error) {
+	if o.history == 0 && o.file == "" {
+		return nil, nil
 	}
-	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{Port: portNum})
+	if o.history < 0 || o.hashBytes < 0 {
+		return nil, errors.New("Probe log sizes must not be negative")
+	}
+	probeLog := service.NewProbeLog(o.history, o.hashBytes)
+	if o.file != "" {
+		file, err := os.OpenFile(o.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open probe log file: %v", err)
+		}
+		probeLog.SetWriter(file)
+	}
+	return probeLog, nil
+}
+
+// replayFiles returns the caches that are saved to files, by file name.
+func (s *SSServer) replayFiles() map[string]*service.ReplayCache {
+	paths := s.files.Load()
+	files := make(map[string]*service.ReplayCache)
+	if paths.replay != "" {
+		files[paths.replay] = &s.replayCache
+	}
+	if paths.udpReplay != "" {
+		files[paths.udpReplay] = &s.udpReplayCache
+	}
+	return files
+}
+
+func (s *SSServer) loadReplayCaches() error {
+	if s.replay.inherited != nil {
+		if err := s.replayCache.Load(bytes.NewReader(s.replay.inherited.tcp), 0); err != nil {
+			return fmt.Errorf("Failed to load replay history from the previous server: %v", err)
+		}
+		if err := s.udpReplayCache.Load(bytes.NewReader(s.replay.inherited.udp), 0); err != nil {
+			return fmt.Errorf("Failed to load UDP replay history from the previous server: %v", err)
+		}
+		logger.Info("Loaded replay history from the previous server")
+		return nil
+	}
+	for path, cache := range s.replayFiles() {
+		err := cache.LoadFile(path, s.replay.maxAge)
+		if err == nil {
+			logger.Infof("Loaded replay history from %v", path)
+			continue
+		}
+		if s.replay.required {
+			return fmt.Errorf("Failed to load replay history from %v: %v", path, err)
+		}
+		if errors.Is(err, os.ErrNotExist) {
+			logger.Infof("No replay history in %v", path)
+		} else {
+			logger.Warningf("Ignoring replay history in %v: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func (s *SSServer) saveReplayCaches() {
+	for path, cache := range s.replayFiles() {
+		if err := cache.SaveFile(path); err != nil {
+			logger.Errorf("Failed to save replay history to %v: %v", path, err)
+		}
+	}
+}
+
+func (s *SSServer) saveReplayCachesPeriodically(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.replay.saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveReplayCaches()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// startPort opens a port with the access keys in `ciphers`.  Inherited sockets
+// for the port are used if there are any.  Otherwise, the listeners are created
+// with the socket options and the number of listeners in `opts`.
+func (s *SSServer) startPort(portNum int, ciphers *list.List, opts portOptions) error {
+	listeners, packetConns, err := s.sockets.take(portNum, opts.socketName)
 	if err != nil {
-		return fmt.Errorf("Failed to start UDP on port %v: %v", portNum, err)
+		return fmt.Errorf("Failed to use inherited sockets for port %v: %v", portNum, err)
+	}
+	inherited := len(listeners) + len(packetConns)
+	if opts.socketName != "" && inherited == 0 {
+		return fmt.Errorf("No inherited sockets named %q for port %v", opts.socketName, portNum)
 	}
-	logger.Infof("Listening TCP and UDP on port %v", portNum)
-	port := &ssPort{cipherList: service.NewCipherList()}
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		for _, packetConn := range packetConns {
+			packetConn.Close()
+		}
+	}
+	if minPort := int(s.minNewPort.Load()); portNum < minPort && (len(listeners) == 0 || len(packetConns) == 0) {
+		closeAll()
+		return fmt.Errorf("Port %v can't be opened without privileges, which were dropped.  Use a port from %v, or an inherited socket", portNum, minPort)
+	}
+	// Sockets opened here are tracked, so that they are handed over in upgrades.
+	socketName := opts.socketName
+	if socketName == "" {
+		socketName = strconv.Itoa(portNum)
+	}
+	if len(listeners) == 0 {
+		if listeners, err = service.ListenTCPGroup(&net.TCPAddr{Port: portNum}, opts.tcpSocket, opts.listeners); err != nil {
+			closeAll()
+			return fmt.Errorf("Failed to start TCP on port %v: %v", portNum, err)
+		}
+		if err := s.sockets.track(socketName, listeners, nil); err != nil {
+			closeAll()
+			return fmt.Errorf("Failed to track TCP sockets on port %v: %v", portNum, err)
+		}
+	}
+	if len(packetConns) == 0 {
+		if packetConns, err = service.ListenUDPGroup(&net.UDPAddr{Port: portNum}, opts.listeners); err != nil {
+			closeAll()
+			s.sockets.release(portNum, opts.socketName)
+			return fmt.Errorf("Failed to start UDP on port %v: %v", portNum, err)
+		}
+		if err := s.sockets.track(socketName, nil, packetConns); err != nil {
+			closeAll()
+			s.sockets.release(portNum, opts.socketName)
+			return fmt.Errorf("Failed to track UDP sockets on port %v: %v", portNum, err)
+		}
+	}
+	if inherited > 0 {
+		logger.Infof("Listening TCP and UDP on port %v with %v inherited sockets", portNum, inherited)
+	} else if len(listeners) > 1 {
+		logger.Infof("Listening TCP and UDP on port %v with %v sockets each", portNum, len(listeners))
+	} else {
+		logger.Infof("Listening TCP and UDP on port %v", portNum)
+	}
+	port := &ssPort{cipherList: service.NewCipherList(), socketName: opts.socketName}
+	port.cipherList.Update(ciphers)
 	// TODO: Register initial data metrics at zero.
-	port.tcpService = service.NewTCPService(port.cipherList, &s.replayCache, s.m, tcpReadTimeout)
-	port.udpService = service.NewUDPService(s.natTimeout, port.cipherList, s.m)
+	for range listeners {
+		tcpService := service.NewTCPService(port.cipherList, &s.replayCache, s.m, tcpReadTimeout)
+		tcpService.SetProbeLog(s.probeLog)
+		port.tcpServices = append(port.tcpServices, tcpService)
+	}
+	for range packetConns {
+		udpService := service.NewUDPService(s.natTimeout, port.cipherList, s.m)
+		udpService.SetReplayCache(&s.udpReplayCache)
+		udpService.SetPipeline(opts.udpPipeline)
+		port.udpServices = append(port.udpServices, udpService)
+	}
+	// The first connections must already see the port's options.
+	port.apply(opts)
+	for i, listener := range listeners {
+		go port.tcpServices[i].Serve(listener)
+	}
+	for i, packetConn := range packetConns {
+		go port.udpServices[i].Serve(packetConn)
+	}
 	s.ports[portNum] = port
-	go port.tcpService.Serve(listener)
-	go port.udpService.Serve(packetConn)
 	return nil
 }
 
@@ -100,9 +356,19 @@ func (s *SSServer) removePort(portNum int) error {
 	if !ok {
 		return fmt.Errorf("Port %v doesn't exist", portNum)
 	}
-	tcpErr := port.tcpService.Stop()
-	udpErr := port.udpService.Stop()
+	var tcpErr, udpErr error
+	for _, tcpService := range port.tcpServices {
+		if err := tcpService.Stop(); err != nil && tcpErr == nil {
+			tcpErr = err
+		}
+	}
+	for _, udpService := range port.udpServices {
+		if err := udpService.Stop(); err != nil && udpErr == nil {
+			udpErr = err
+		}
+	}
 	delete(s.ports, portNum)
+	s.sockets.release(portNum, port.socketName)
 	if tcpErr != nil {
 		return fmt.Errorf("Failed to close listener on %v: %v", portNum, tcpErr)
 	}
@@ -114,6 +380,10 @@ func (s *SSServer) removePort(portNum int) error {
 }
 
 func (s *SSServer) loadConfig(config *Config) error {
+	marking, err := config.SaltMarking.marking()
+	if err != nil {
+		return fmt.Errorf("Invalid salt marking config: %v", err)
+	}
 	portChanges := make(map[int]int)
 	portCiphers := make(map[int]*list.List) // Values are *List of *CipherEntry.
 	for _, keyConfig := range config.Keys {
@@ -127,9 +397,23 @@ func (s *SSServer) loadConfig(config *Config) error {
 		if err != nil {
 			return fmt.Errorf("Failed to create cipher for key %v: %v", keyConfig.ID, err)
 		}
-		entry := service.MakeCipherEntry(keyConfig.ID, cipher, keyConfig.Secret)
+		entry := service.MakeMarkedCipherEntry(keyConfig.ID, cipher, keyConfig.Secret, marking)
+		if entry.Egress, err = keyConfig.Egress.policy(); err != nil {
+			return fmt.Errorf("Invalid egress config for key %v: %v", keyConfig.ID, err)
+		}
+		if entry.NATTimeouts, err = natTimeoutPolicy(keyConfig.NATTimeouts); err != nil {
+			return fmt.Errorf("Invalid NAT timeouts for key %v: %v", keyConfig.ID, err)
+		}
 		cipherList.PushBack(&entry)
 	}
+	portOpts := make(map[int]portOptions)
+	for _, portConfig := range config.Ports {
+		opts, err := portConfig.options()
+		if err != nil {
+			return fmt.Errorf("Invalid config for port %v: %v", portConfig.Port, err)
+		}
+		portOpts[portConfig.Port] = opts
+	}
 	for port := range s.ports {
 		portChanges[port] = portChanges[port] - 1
 	}
@@ -139,15 +423,18 @@ func (s *SSServer) loadConfig(config *Config) error {
 				return fmt.Errorf("Failed to remove port %v: %v", portNum, err)
 			}
 		} else if count == +1 {
-			if err := s.startPort(portNum); err != nil {
+			if err := s.startPort(portNum, portCiphers[portNum], portOpts[portNum]); err != nil {
 				return fmt.Errorf("Failed to start port %v: %v", portNum, err)
 			}
+		} else {
+			s.ports[portNum].cipherList.Update(portCiphers[portNum])
+			s.ports[portNum].apply(portOpts[portNum])
 		}
 	}
-	for portNum, cipherList := range portCiphers {
-		s.ports[portNum].cipherList.Update(cipherList)
-	}
 	logger.Infof("Loaded %v access keys", len(config.Keys))
+	if marking != nil {
+		logger.Infof("Marking server salts with %v-byte marks and %v previous secrets", marking.EffectiveMarkLen(), len(marking.Previous))
+	}
 	s.m.SetNumAccessKeys(len(config.Keys), len(portCiphers))
 	return nil
 }
@@ -165,34 +452,72 @@ func (s *SSServer) loadConfigFile(filename string) error {
 	return s.loadConfig(&config)
 }
 
-// Stop serving on all ports.
+// Stop serving on all ports, and save the replay caches.
 func (s *SSServer) Stop() error {
 	for portNum := range s.ports {
 		if err := s.removePort(portNum); err != nil {
 			return err
 		}
 	}
+	if s.stopSaving != nil {
+		close(s.stopSaving)
+		s.stopSaving = nil
+	}
+	s.saveReplayCaches()
+	if err := s.probeLog.Close(); err != nil {
+		return fmt.Errorf("Failed to close probe log: %v", err)
+	}
 	return nil
 }
 
 // RunSSServer starts a shadowsocks server running, and returns the server or an error.
-func RunSSServer(filename string, natTimeout time.Duration, sm metrics.ShadowsocksMetrics, replayHistory int) (*SSServer, error) {
+// `probeLog` records failed connections on all ports, and may be nil.  `sockets`
+// are the sockets inherited from another process, and may be nil.
+func RunSSServer(filename string, natTimeout time.Duration, sm metrics.ShadowsocksMetrics, replay replayOptions, probeLog *service.ProbeLog, sockets *socketSet) (*SSServer, error) {
+	for _, history := range []int{replay.history, replay.udpHistory} {
+		if history < 0 || history > service.MaxCapacity {
+			return nil, fmt.Errorf("Replay history must be between 0 and %v", service.MaxCapacity)
+		}
+	}
 	server := &SSServer{
-		natTimeout:  natTimeout,
-		m:           sm,
-		replayCache: service.NewReplayCache(replayHistory),
-		ports:       make(map[int]*ssPort),
+		natTimeout:     natTimeout,
+		m:              sm,
+		replayCache:    service.NewReplayCacheWithExpiry(replay.history, replay.expiry),
+		udpReplayCache: service.NewReplayCacheWithExpiry(replay.udpHistory, replay.expiry),
+		replay:         replay,
+		probeLog:       probeLog,
+		ports:          make(map[int]*ssPort),
+		sockets:        sockets,
+	}
+	if server.sockets == nil {
+		server.sockets = &socketSet{}
+	}
+	server.files.Store(&serverFiles{config: filename, replay: replay.file, udpReplay: replay.udpFile})
+	// Load the replay history before accepting any connections.
+	if err := server.loadReplayCaches(); err != nil {
+		return nil, err
+	}
+	sm.AddReplayCache("tcp", server.replayCache.Stats)
+	sm.AddReplayCache("udp", server.udpReplayCache.Stats)
+	sm.AddBufferPool("stream", ss.BufferBytesInUse)
+	sm.AddBufferPool("udp", service.UDPBufferBytesInUse)
+	if len(server.replayFiles()) > 0 && replay.saveInterval > 0 {
+		server.stopSaving = make(chan struct{})
+		go server.saveReplayCachesPeriodically(server.stopSaving)
 	}
 	err := server.loadConfigFile(filename)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to load config file %v: %v", filename, err)
 	}
+	for _, name := range sockets.unclaimed() {
+		logger.Warningf("Inherited socket %v does not match any port", name)
+	}
 	sigHup := make(chan os.Signal, 1)
 	signal.Notify(sigHup, syscall.SIGHUP)
 	go func() {
 		for range sigHup {
 			logger.Info("Updating config")
-			if err := server.loadConfigFile(filename); err != nil {
+			if err := server.loadConfigFile(server.files.Load().config); err != nil {
 				logger.Errorf("Could not reload config: %v", err)
 			}
 		}
@@ -204,25 +529,31 @@ var flags struct {
 	ConfigFile    string
 	ListenAddress string
 	natTimeout    time.Duration
-	replayHistory int
+	replay        replayOptions
+	probeLog      probeLogOptions
+	privileges    privilegeOptions
 	Verbose       bool
 	Version       bool
 }
 
-type Config struct {
-	Keys []struct {
-		ID     string
-		Port   int
-		Cipher string
-		Secret string
-	}
-}
-
 func main() {
 	flag.StringVar(&flags.ConfigFile, "config", "", "Configuration filename")
 	flag.StringVar(&flags.ListenAddress, "web.listen", "0.0.0.0:8080", "Address for the Prometheus metrics")
 	flag.DurationVar(&flags.natTimeout, "udptimeout", defaultNatTimeout, "UDP tunnel timeout")
-	flag.IntVar(&flags.replayHistory, "replay_history", 0, "Replay buffer size (# of handshakes)")
+	flag.IntVar(&flags.replay.history, "replay_history", 0, "Replay buffer size (# of handshakes)")
+	flag.IntVar(&flags.replay.udpHistory, "udp_replay_history", 0, "UDP replay buffer size (# of packets)")
+	flag.DurationVar(&flags.replay.expiry, "replay_expiry", 0, "Forget replay buffer entries after this long (0 to keep them until the buffer is full)")
+	flag.StringVar(&flags.replay.file, "replay_file", "", "File for saving the replay buffer across restarts")
+	flag.StringVar(&flags.replay.udpFile, "udp_replay_file", "", "File for saving the UDP replay buffer across restarts")
+	flag.DurationVar(&flags.replay.saveInterval, "replay_save_interval", time.Minute, "How often to save the replay buffers, in addition to shutdown")
+	flag.DurationVar(&flags.replay.maxAge, "replay_max_age", 0, "Ignore saved replay buffers older than this (0 for no limit)")
+	flag.BoolVar(&flags.replay.required, "replay_file_required", false, "Fail to start if a replay file is missing or corrupt")
+	flag.IntVar(&flags.probeLog.history, "probe_log", 0, "Number of recent failed connections to keep for /probes (0 to disable the probe log)")
+	flag.IntVar(&flags.probeLog.hashBytes, "probe_log_bytes", 32, "Number of initial bytes of each failed connection to hash in the probe log")
+	flag.StringVar(&flags.probeLog.file, "probe_log_file", "", "File for appending failed connections as JSON lines.  It is not rotated, but can be truncated")
+	flag.StringVar(&flags.privileges.user, "user", "", "User to run as once the initial ports are open")
+	flag.StringVar(&flags.privileges.group, "group", "", "Group to run as once the initial ports are open (default: the primary group of -user)")
+	flag.StringVar(&flags.privileges.chroot, "chroot", "", "Directory to chroot to once the initial ports are open.  The config and replay files must be inside it, and upgrades are not supported")
 	flag.BoolVar(&flags.Verbose, "verbose", false, "Enables verbose logging output")
 	flag.BoolVar(&flags.Version, "version", false, "The version of the server")
 
@@ -247,23 +578,141 @@ func main() {
 	http.Handle("/metrics", promhttp.Handler())
 	http.HandleFunc("/secrets", LoadSecretsHandler)
 	http.HandleFunc("/reset", ResetHandler)
+	http.HandleFunc("/probes", ProbesHandler)
 
+	previous, err := previousServer()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	sockets, err := listenFDs()
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if previous != nil {
+		if flags.replay.inherited, err = previous.replayState(); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	apiListener, err := listenAPI(flags.ListenAddress, sockets)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	apiServer := &http.Server{}
 	go func() {
-		logger.Fatal(http.ListenAndServe(flags.ListenAddress, nil))
+		if err := apiServer.Serve(apiListener); err != http.ErrServerClosed {
+			logger.Fatal(err)
+		}
 	}()
-	logger.Infof("Api server has started on http://%v/", flags.ListenAddress)
+	logger.Infof("Api server has started on http://%v/", apiListener.Addr())
 
-	var err error
 	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.DefaultRegisterer)
 	m.SetBuildInfo(version)
-	server, err = RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replayHistory)
+	probeLog, err := flags.probeLog.open()
 	if err != nil {
 		logger.Fatal(err)
 	}
+	// The files are opened again after the chroot, so they must be inside it.
+	chrootFiles, err := flags.privileges.chrootFiles(serverFiles{
+		config:    flags.ConfigFile,
+		replay:    flags.replay.file,
+		udpReplay: flags.replay.udpFile,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server, err = RunSSServer(flags.ConfigFile, flags.natTimeout, m, flags.replay, probeLog, sockets)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if flags.privileges.enabled() {
+		if err := flags.privileges.drop(); err != nil {
+			logger.Fatalf("Failed to drop privileges: %v", err)
+		}
+		server.files.Store(chrootFiles)
+		for path := range server.replayFiles() {
+			if err := checkWritableDir(filepath.Dir(path)); err != nil {
+				logger.Fatalf("Replay history can't be saved to %v as user %v: %v", path, os.Geteuid(), err)
+			}
+		}
+		if os.Geteuid() != 0 {
+			server.minNewPort.Store(int32(unprivilegedPortStart()))
+		}
+		logger.Infof("Running as user %v and group %v", os.Geteuid(), os.Getegid())
+	}
+	if previous != nil {
+		go previous.mergeReplayState(server)
+		if err := previous.done(); err != nil {
+			logger.Errorf("Failed to notify the previous server: %v", err)
+		}
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Warningf("Failed to notify the service manager: %v", err)
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
-	<-sigCh
+	upgradeCh := make(chan os.Signal, 1)
+	if len(upgradeSignals) > 0 {
+		signal.Notify(upgradeCh, upgradeSignals...)
+	}
+	for {
+		select {
+		case <-sigCh:
+			if err := server.Stop(); err != nil {
+				logger.Errorf("Failed to stop server: %v", err)
+			}
+			return
+		case <-upgradeCh:
+			if err := flags.privileges.canUpgrade(); err != nil {
+				logger.Errorf("Upgrade failed: %v", err)
+				continue
+			}
+			logger.Info("Upgrading server")
+			stream, err := server.upgrade()
+			if err != nil {
+				logger.Errorf("Upgrade failed: %v", err)
+				continue
+			}
+			apiServer.Close()
+			logger.Info("Draining connections")
+			server.drain(stream)
+			logger.Info("Drained all connections")
+			return
+		}
+	}
+}
+
+// The socket name of the API server in upgrades, and in socket activation.
+const apiSocketName = "api"
+
+// listenAPI returns the listener for the API server: an inherited socket named
+// apiSocketName, or a new one on `addr`, which is tracked in `sockets` so that
+// it is handed over in upgrades.
+func listenAPI(addr string, sockets *socketSet) (*net.TCPListener, error) {
+	listeners, _, err := sockets.take(0, apiSocketName)
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) > 0 {
+		for _, extra := range listeners[1:] {
+			extra.Close()
+		}
+		return listeners[0], nil
+	}
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := sockets.track(apiSocketName, []*net.TCPListener{listener}, nil); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
 }
 
 func LoadSecretsHandler(w http.ResponseWriter, r *http.Request) {
@@ -284,7 +733,7 @@ func LoadSecretsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	configByteArray, _ := yaml.Marshal(jsonConfig)
-	err = ioutil.WriteFile(flags.ConfigFile, configByteArray, 0644)
+	err = ioutil.WriteFile(server.files.Load().config, configByteArray, 0644)
 	if err != nil {
 		w.Write([]byte(fmt.Sprintf(`{"success":false,"error":"%v"}`, err)))
 		logger.Errorf("%s", err.Error())
@@ -293,6 +742,57 @@ func LoadSecretsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(fmt.Sprintf(`{"success":true,"response":"Loaded %v access keys"}`, len(jsonConfig.Keys))))
 }
 
+// ProbesHandler reports the sources with the most failed connections.  The query
+// parameters are `window`, a comma-separated list of durations (default 1h),
+// `limit` (default 20), and `group`, which is "ip" (the default) or "prefix".
+func ProbesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	windows := []string{"1h"}
+	if query.Get("window") != "" {
+		windows = strings.Split(query.Get("window"), ",")
+	}
+	limit := 20
+	if query.Get("limit") != "" {
+		var err error
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit < 0 {
+			probesError(w, fmt.Sprintf("Invalid limit: %v", query.Get("limit")))
+			return
+		}
+	}
+	var byPrefix bool
+	switch query.Get("group") {
+	case "", "ip":
+	case "prefix":
+		byPrefix = true
+	default:
+		probesError(w, fmt.Sprintf("Invalid group: %v", query.Get("group")))
+		return
+	}
+	top := make(map[string][]service.ProbeSource, len(windows))
+	for _, window := range windows {
+		d, err := time.ParseDuration(window)
+		if err != nil || d <= 0 {
+			probesError(w, fmt.Sprintf("Invalid window: %v", window))
+			return
+		}
+		var sources []service.ProbeSource
+		if server != nil {
+			sources = server.probeLog.Top(d, limit, byPrefix)
+		}
+		if sources == nil {
+			sources = []service.ProbeSource{}
+		}
+		top[window] = sources
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "response": top})
+}
+
+func probesError(w http.ResponseWriter, message string) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": message})
+}
+
 func ResetHandler(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Write([]byte(`{"success":true,"response":"ok"}`))
@@ -301,6 +801,7 @@ func ResetHandler(w http.ResponseWriter, _ *http.Request) {
 
 func reset() {
 	time.Sleep(100 * time.Millisecond)
+	server.saveReplayCaches()
 	logger.Info("Server has resetted")
 	os.Exit(1)
 }
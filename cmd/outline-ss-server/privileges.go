@@ -0,0 +1,144 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// privilegeOptions configures the user that the server runs as once it has
+// opened its ports.
+type privilegeOptions struct {
+	// User name or ID.  Empty to keep the current user.
+	user string
+	// Group name or ID.  Empty for the primary group of the user.
+	group string
+	// Directory to chroot to, or empty.
+	chroot string
+}
+
+func (o *privilegeOptions) enabled() bool {
+	return o.user != "" || o.group != "" || o.chroot != ""
+}
+
+// canUpgrade returns an error if the server can't be upgraded with these
+// options.  After a chroot, the executable and its libraries are out of reach.
+func (o *privilegeOptions) canUpgrade() error {
+	if o.chroot != "" {
+		return fmt.Errorf("Upgrades are not supported with -chroot %v.  Restart the server instead", o.chroot)
+	}
+	return nil
+}
+
+// inChroot returns `path` as it is seen after the chroot.  It is an error if
+// the path is outside of the chroot.
+func (o *privilegeOptions) inChroot(path string) (string, error) {
+	if o.chroot == "" || path == "" {
+		return path, nil
+	}
+	root, err := filepath.Abs(o.chroot)
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%v is outside of -chroot %v", path, o.chroot)
+	}
+	return filepath.Join(string(filepath.Separator), rel), nil
+}
+
+// chrootFiles returns `files` as they are seen after the chroot.
+func (o *privilegeOptions) chrootFiles(files serverFiles) (*serverFiles, error) {
+	var err error
+	if files.config, err = o.inChroot(files.config); err != nil {
+		return nil, err
+	}
+	if files.replay, err = o.inChroot(files.replay); err != nil {
+		return nil, err
+	}
+	if files.udpReplay, err = o.inChroot(files.udpReplay); err != nil {
+		return nil, err
+	}
+	return &files, nil
+}
+
+// checkWritableDir returns an error if the current user can't create files in
+// `dir`, as saving a file does.
+func checkWritableDir(dir string) error {
+	file, err := ioutil.TempFile(dir, ".outline-ss-server-check")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// ids returns the user and group IDs to switch to.  It must be called before
+// the chroot, which may hide the user database.
+func (o *privilegeOptions) ids() (uid, gid int, err error) {
+	if o.user == "" {
+		if o.group != "" {
+			return 0, 0, errors.New("A group requires a user")
+		}
+		return -1, -1, nil
+	}
+	u, err := user.Lookup(o.user)
+	if err != nil {
+		if u, err = user.LookupId(o.user); err != nil {
+			return 0, 0, fmt.Errorf("Unknown user %v", o.user)
+		}
+	}
+	if uid, err = strconv.Atoi(u.Uid); err != nil {
+		return 0, 0, fmt.Errorf("Unsupported user ID %v", u.Uid)
+	}
+	gidStr := u.Gid
+	if o.group != "" {
+		g, err := user.LookupGroup(o.group)
+		if err != nil {
+			if g, err = user.LookupGroupId(o.group); err != nil {
+				return 0, 0, fmt.Errorf("Unknown group %v", o.group)
+			}
+		}
+		gidStr = g.Gid
+	}
+	if gid, err = strconv.Atoi(gidStr); err != nil {
+		return 0, 0, fmt.Errorf("Unsupported group ID %v", gidStr)
+	}
+	return uid, gid, nil
+}
+
+// drop switches to the configured user and group, after the chroot if there
+// is one.  Ports that are opened later must not need privileges.
+func (o *privilegeOptions) drop() error {
+	uid, gid, err := o.ids()
+	if err != nil {
+		return err
+	}
+	return dropPrivileges(uid, gid, o.chroot)
+}
@@ -0,0 +1,67 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// dropPrivileges chroots to `chroot`, unless it is empty, and switches to
+// `uid` and `gid`, unless they are negative.  It is a no-op for a server that
+// already runs as the user, e.g. after an upgrade.  The syscall package applies
+// the changes to all threads.
+func dropPrivileges(uid, gid int, chroot string) error {
+	if chroot != "" {
+		if err := syscall.Chroot(chroot); err != nil {
+			return fmt.Errorf("Failed to chroot to %v: %v", chroot, err)
+		}
+		if err := os.Chdir("/"); err != nil {
+			return err
+		}
+	}
+	if gid >= 0 && (os.Getgid() != gid || os.Getegid() != gid) {
+		if err := syscall.Setgroups([]int{gid}); err != nil {
+			return fmt.Errorf("Failed to set groups: %v", err)
+		}
+		if err := syscall.Setresgid(gid, gid, gid); err != nil {
+			return fmt.Errorf("Failed to set group %v: %v", gid, err)
+		}
+	}
+	if uid >= 0 && (os.Getuid() != uid || os.Geteuid() != uid) {
+		if err := syscall.Setresuid(uid, uid, uid); err != nil {
+			return fmt.Errorf("Failed to set user %v: %v", uid, err)
+		}
+	}
+	return nil
+}
+
+// unprivilegedPortStart returns the lowest port that can be bound without
+// privileges.
+func unprivilegedPortStart() int {
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	port, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 1024
+	}
+	return port
+}
@@ -0,0 +1,127 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrivilegeOptionsIDs(t *testing.T) {
+	current, err := user.Current()
+	require.NoError(t, err)
+	uid, err := strconv.Atoi(current.Uid)
+	require.NoError(t, err)
+	gid, err := strconv.Atoi(current.Gid)
+	require.NoError(t, err)
+
+	opts := privilegeOptions{}
+	require.False(t, opts.enabled())
+	gotUID, gotGID, err := opts.ids()
+	require.NoError(t, err)
+	require.Equal(t, -1, gotUID)
+	require.Equal(t, -1, gotGID)
+
+	for _, name := range []string{current.Username, current.Uid} {
+		opts = privilegeOptions{user: name}
+		require.True(t, opts.enabled())
+		gotUID, gotGID, err = opts.ids()
+		require.NoError(t, err)
+		require.Equal(t, uid, gotUID)
+		require.Equal(t, gid, gotGID)
+	}
+
+	opts = privilegeOptions{user: current.Uid, group: current.Gid}
+	gotUID, gotGID, err = opts.ids()
+	require.NoError(t, err)
+	require.Equal(t, uid, gotUID)
+	require.Equal(t, gid, gotGID)
+
+	require.NoError(t, opts.canUpgrade())
+	require.Error(t, (&privilegeOptions{chroot: "/var/empty"}).canUpgrade())
+
+	_, _, err = (&privilegeOptions{group: current.Gid}).ids()
+	require.Error(t, err)
+	_, _, err = (&privilegeOptions{user: "no-such-user-for-outline"}).ids()
+	require.Error(t, err)
+	_, _, err = (&privilegeOptions{user: current.Uid, group: "no-such-group-for-outline"}).ids()
+	require.Error(t, err)
+}
+
+// After dropping privileges, low ports can only be added with inherited
+// sockets.
+func TestMinNewPort(t *testing.T) {
+	sockets, inheritedPort := makeSocketSet(t, "ss")
+	port := freePort(t)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("keys: []\n"), 0644))
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	server, err := RunSSServer(configFile, 30*time.Second, m, replayOptions{}, nil, sockets)
+	require.NoError(t, err)
+	defer server.Stop()
+	server.minNewPort.Store(65535)
+
+	keyConfig := "keys:\n  - id: user-0\n    port: %v\n    cipher: chacha20-ietf-poly1305\n    secret: Secret0\n"
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(fmt.Sprintf(keyConfig, port)), 0644))
+	require.Error(t, server.loadConfigFile(configFile))
+	require.NotContains(t, server.ports, port)
+
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(fmt.Sprintf(keyConfig, inheritedPort)), 0644))
+	require.NoError(t, server.loadConfigFile(configFile))
+	require.Contains(t, server.ports, inheritedPort)
+}
+
+func TestPrivilegeOptionsInChroot(t *testing.T) {
+	opts := privilegeOptions{chroot: "/srv/outline"}
+	path, err := opts.inChroot("/srv/outline/state/replay")
+	require.NoError(t, err)
+	require.Equal(t, "/state/replay", path)
+	path, err = opts.inChroot("")
+	require.NoError(t, err)
+	require.Equal(t, "", path)
+	_, err = opts.inChroot("/srv/outline-other/replay")
+	require.Error(t, err)
+	_, err = opts.inChroot("/srv/outline/../replay")
+	require.Error(t, err)
+
+	files, err := opts.chrootFiles(serverFiles{config: "/srv/outline/config.yml", replay: "/srv/outline/replay"})
+	require.NoError(t, err)
+	require.Equal(t, serverFiles{config: "/config.yml", replay: "/replay"}, *files)
+	_, err = opts.chrootFiles(serverFiles{config: "/etc/outline/config.yml"})
+	require.Error(t, err)
+
+	path, err = (&privilegeOptions{}).inChroot("replay")
+	require.NoError(t, err)
+	require.Equal(t, "replay", path)
+}
+
+func TestCheckWritableDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, checkWritableDir(dir))
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+	require.Error(t, checkWritableDir(filepath.Join(dir, "missing")))
+}
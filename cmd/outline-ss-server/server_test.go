@@ -15,16 +15,24 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-ss-server/service"
 	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRunSSServer(t *testing.T) {
 	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.DefaultRegisterer)
-	server, err := RunSSServer("config_example.yml", 30*time.Second, m, 10000)
+	server, err := RunSSServer("config_example.yml", 30*time.Second, m, replayOptions{history: 10000, udpHistory: 10000}, nil, nil)
 	if err != nil {
 		t.Fatalf("RunSSServer() error = %v", err)
 	}
@@ -32,3 +40,111 @@ func TestRunSSServer(t *testing.T) {
 		t.Errorf("Error while stopping server: %v", err)
 	}
 }
+
+func TestRunSSServerReplayFile(t *testing.T) {
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	dir := t.TempDir()
+	// No ports, so that the server can be restarted immediately.
+	configFile := filepath.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(configFile, []byte("keys: []\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "replay")
+	replay := replayOptions{history: 10, file: path, required: true}
+	if _, err := RunSSServer(configFile, 30*time.Second, m, replay, nil, nil); err == nil {
+		t.Fatal("Expected an error for a missing replay file")
+	}
+
+	replay.required = false
+	server, err := RunSSServer(configFile, 30*time.Second, m, replay, nil, nil)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	server.replayCache.Add("id", []byte("salt"))
+	if err := server.Stop(); err != nil {
+		t.Fatalf("Error while stopping server: %v", err)
+	}
+
+	replay.required = true
+	server, err = RunSSServer(configFile, 30*time.Second, m, replay, nil, nil)
+	if err != nil {
+		t.Fatalf("RunSSServer() error = %v", err)
+	}
+	defer server.Stop()
+	if server.replayCache.Add("id", []byte("salt")) {
+		t.Error("Replay history was not restored")
+	}
+}
+
+func TestRunSSServerReplayHistoryLimit(t *testing.T) {
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	_, err := RunSSServer("config_example.yml", 30*time.Second, m, replayOptions{history: service.MaxCapacity + 1}, nil, nil)
+	require.Error(t, err)
+	_, err = RunSSServer("config_example.yml", 30*time.Second, m, replayOptions{udpHistory: -1}, nil, nil)
+	require.Error(t, err)
+}
+
+func TestSplitNATLimits(t *testing.T) {
+	limits := service.NATLimits{MaxEntries: 1000, MaxEntriesPerClientIP: 10, MaxEntriesPerKey: 4}
+	for _, n := range []int{0, 1} {
+		split, exact := splitNATLimits(limits, n)
+		require.True(t, exact)
+		require.Equal(t, limits, split)
+	}
+	split, exact := splitNATLimits(limits, 4)
+	require.True(t, exact)
+	require.Equal(t, service.NATLimits{MaxEntries: 250, MaxEntriesPerClientIP: 2, MaxEntriesPerKey: 1}, split)
+	split, exact = splitNATLimits(service.NATLimits{}, 4)
+	require.True(t, exact)
+	require.Equal(t, service.NATLimits{}, split)
+
+	// A limit below the number of sockets allows more entries than configured.
+	split, exact = splitNATLimits(service.NATLimits{MaxEntriesPerKey: 1}, 4)
+	require.False(t, exact)
+	require.Equal(t, service.NATLimits{MaxEntriesPerKey: 1}, split)
+
+	config := PortConfig{Port: 9001, Listeners: 4, UDP: &UDPConfig{MaxNATEntriesPerKey: 1}}
+	_, err := config.options()
+	require.Error(t, err)
+	config.UDP.MaxNATEntriesPerKey = 4
+	_, err = config.options()
+	require.NoError(t, err)
+}
+
+func TestProbesHandler(t *testing.T) {
+	probeLog := service.NewProbeLog(10, 32)
+	probeLog.Add(net.ParseIP("192.0.2.1"), 443, "ERR_CIPHER", 10, "eof", nil)
+	probeLog.Add(net.ParseIP("192.0.2.2"), 443, "ERR_CIPHER", 10, "eof", nil)
+	probeLog.Add(net.ParseIP("192.0.2.2"), 443, "ERR_CIPHER", 10, "eof", nil)
+	server = &SSServer{probeLog: probeLog}
+	defer func() { server = nil }()
+
+	get := func(target string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		ProbesHandler(w, httptest.NewRequest("GET", target, nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	code, body := get("/probes?window=5m,1h&limit=1")
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, true, body["success"])
+	response := body["response"].(map[string]interface{})
+	require.Len(t, response, 2)
+	top := response["5m"].([]interface{})
+	require.Len(t, top, 1)
+	require.Equal(t, "192.0.2.2", top[0].(map[string]interface{})["source"])
+	require.Equal(t, float64(2), top[0].(map[string]interface{})["probes"])
+
+	_, body = get("/probes?group=prefix")
+	top = body["response"].(map[string]interface{})["1h"].([]interface{})
+	require.Equal(t, "192.0.2.0/24", top[0].(map[string]interface{})["source"])
+	require.Equal(t, float64(3), top[0].(map[string]interface{})["probes"])
+
+	for _, target := range []string{"/probes?window=x", "/probes?limit=-1", "/probes?group=port"} {
+		code, body = get(target)
+		require.Equal(t, http.StatusBadRequest, code, target)
+		require.Equal(t, false, body["success"], target)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Sockets passed with the socket activation protocol start at this fd.
+// See https://www.freedesktop.org/software/systemd/man/sd_listen_fds.html
+const listenFDsStart = 3
+
+// inheritedSocket is a TCP listener or UDP socket that was opened by another
+// process, such as systemd, or tracked to hand it over in an upgrade.
+type inheritedSocket struct {
+	name string
+	// The port that the socket is bound to.
+	port int
+	tcp  *net.TCPListener
+	udp  *net.UDPConn
+	// Whether a port has been served with the socket.
+	claimed bool
+	// Whether the socket stays open when its port is removed.  Sockets from
+	// systemd are kept, so that the port can be added back.  Those opened by
+	// this server, or a previous one, are closed.
+	keep bool
+}
+
+// socketSet holds the sockets that the server inherited, and those it opened.
+// Ports are served with copies of the sockets, so that the set can hand them
+// over in an upgrade.  Methods may be called on a nil set, which is empty.
+type socketSet struct {
+	mu      sync.Mutex
+	sockets []*inheritedSocket
+}
+
+// listenFDs returns the sockets passed in LISTEN_FDS, named by LISTEN_FDNAMES.
+// The variables are unset so that they aren't passed on to child processes.
+func listenFDs() (*socketSet, error) {
+	pid := os.Getenv("LISTEN_PID")
+	upgrade := os.Getenv(upgradeEnv)
+	if upgrade != "" {
+		// The previous server can't know the PID in advance.
+		pid = strconv.Itoa(os.Getpid())
+	}
+	names, err := listenFDNames(pid, os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(upgradeEnv)
+	if err != nil {
+		return nil, err
+	}
+	// Without an upgrade, all the sockets are from systemd.
+	kept := len(names)
+	if upgrade != "" {
+		if kept, err = strconv.Atoi(upgrade); err != nil || kept < 0 {
+			return nil, fmt.Errorf("Invalid %v %q", upgradeEnv, upgrade)
+		}
+	}
+	set := &socketSet{}
+	for i, name := range names {
+		file := os.NewFile(uintptr(listenFDsStart+i), name)
+		err := set.add(name, file, i < kept)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to use inherited socket %v (fd %v): %v", name, listenFDsStart+i, err)
+		}
+	}
+	return set, nil
+}
+
+// listenFDNames returns the names of the sockets passed to this process, given
+// the values of LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES.  Sockets without a
+// name are called "unknown", as in sd_listen_fds_with_names.
+func listenFDNames(pid, fds, names string) ([]string, error) {
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		// The sockets, if any, were meant for another process.
+		return nil, nil
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS %q", fds)
+	}
+	var list []string
+	if names != "" {
+		list = strings.Split(names, ":")
+	}
+	if len(list) > n {
+		list = list[:n]
+	}
+	for len(list) < n {
+		list = append(list, "unknown")
+	}
+	return list, nil
+}
+
+// add takes over the socket in `file`, which must be a TCP listener or a UDP
+// socket.  `file` can be closed afterwards.
+func (s *socketSet) add(name string, file *os.File, keep bool) error {
+	socket := &inheritedSocket{name: name, keep: keep}
+	if listener, err := net.FileListener(file); err == nil {
+		tcp, ok := listener.(*net.TCPListener)
+		if !ok {
+			listener.Close()
+			return fmt.Errorf("Unsupported listener on %v", listener.Addr())
+		}
+		socket.tcp = tcp
+		socket.port = tcp.Addr().(*net.TCPAddr).Port
+	} else if conn, err := net.FilePacketConn(file); err == nil {
+		udp, ok := conn.(*net.UDPConn)
+		if !ok {
+			conn.Close()
+			return fmt.Errorf("Unsupported socket on %v", conn.LocalAddr())
+		}
+		socket.udp = udp
+		socket.port = udp.LocalAddr().(*net.UDPAddr).Port
+	} else {
+		return errors.New("Not a TCP listener or UDP socket")
+	}
+	s.mu.Lock()
+	s.sockets = append(s.sockets, socket)
+	s.mu.Unlock()
+	return nil
+}
+
+// take returns copies of the sockets for a port: those named `name`, or if
+// `name` is empty, those bound to `portNum`.  Closing the copies doesn't close
+// the sockets in the set.
+func (s *socketSet) take(portNum int, name string) ([]*net.TCPListener, []*net.UDPConn, error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var listeners []*net.TCPListener
+	var packetConns []*net.UDPConn
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+		for _, packetConn := range packetConns {
+			packetConn.Close()
+		}
+	}
+	for _, socket := range s.sockets {
+		if (name != "" && socket.name != name) || (name == "" && socket.port != portNum) {
+			continue
+		}
+		if socket.tcp != nil {
+			listener, err := copyListener(socket.tcp)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			listeners = append(listeners, listener)
+		} else {
+			packetConn, err := copyPacketConn(socket.udp)
+			if err != nil {
+				closeAll()
+				return nil, nil, err
+			}
+			packetConns = append(packetConns, packetConn)
+		}
+		socket.claimed = true
+	}
+	return listeners, packetConns, nil
+}
+
+// track adds copies of sockets that the server opened, so that they are handed
+// over in an upgrade.
+func (s *socketSet) track(name string, listeners []*net.TCPListener, packetConns []*net.UDPConn) error {
+	if s == nil {
+		return nil
+	}
+	var sockets []*inheritedSocket
+	for _, listener := range listeners {
+		copied, err := copyListener(listener)
+		if err != nil {
+			closeSockets(sockets)
+			return err
+		}
+		sockets = append(sockets, &inheritedSocket{name: name, port: copied.Addr().(*net.TCPAddr).Port, tcp: copied, claimed: true})
+	}
+	for _, packetConn := range packetConns {
+		copied, err := copyPacketConn(packetConn)
+		if err != nil {
+			closeSockets(sockets)
+			return err
+		}
+		sockets = append(sockets, &inheritedSocket{name: name, port: copied.LocalAddr().(*net.UDPAddr).Port, udp: copied, claimed: true})
+	}
+	s.mu.Lock()
+	s.sockets = append(s.sockets, sockets...)
+	s.mu.Unlock()
+	return nil
+}
+
+// release closes the sockets of a removed port, selected as in take, unless
+// they are kept.
+func (s *socketSet) release(portNum int, name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var remaining, released []*inheritedSocket
+	for _, socket := range s.sockets {
+		if !socket.keep && ((name != "" && socket.name == name) || (name == "" && socket.port == portNum)) {
+			released = append(released, socket)
+		} else {
+			remaining = append(remaining, socket)
+		}
+	}
+	closeSockets(released)
+	s.sockets = remaining
+}
+
+// files returns copies of the sockets as files, with the kept sockets first,
+// their names, and the number of kept sockets.
+func (s *socketSet) files() ([]*os.File, []string, int, error) {
+	if s == nil {
+		return nil, nil, 0, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var files []*os.File
+	var names []string
+	var kept int
+	for _, keep := range []bool{true, false} {
+		for _, socket := range s.sockets {
+			if socket.keep != keep {
+				continue
+			}
+			var file *os.File
+			var err error
+			if socket.tcp != nil {
+				file, err = socket.tcp.File()
+			} else {
+				file, err = socket.udp.File()
+			}
+			if err != nil {
+				closeFiles(files)
+				return nil, nil, 0, err
+			}
+			files = append(files, file)
+			names = append(names, socket.name)
+			if keep {
+				kept++
+			}
+		}
+	}
+	return files, names, kept, nil
+}
+
+// unclaimed returns the names of the sockets that no port has been served
+// with.
+func (s *socketSet) unclaimed() []string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for _, socket := range s.sockets {
+		if !socket.claimed {
+			names = append(names, socket.name)
+		}
+	}
+	return names
+}
+
+// close closes the sockets in the set.  Copies that are being served are not
+// affected.
+func (s *socketSet) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	closeSockets(s.sockets)
+	s.sockets = nil
+}
+
+func closeSockets(sockets []*inheritedSocket) {
+	for _, socket := range sockets {
+		if socket.tcp != nil {
+			socket.tcp.Close()
+		} else {
+			socket.udp.Close()
+		}
+	}
+}
+
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+func copyListener(listener *net.TCPListener) (*net.TCPListener, error) {
+	file, err := listener.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	copied, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	return copied.(*net.TCPListener), nil
+}
+
+func copyPacketConn(conn *net.UDPConn) (*net.UDPConn, error) {
+	file, err := conn.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	copied, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	return copied.(*net.UDPConn), nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenFDNames(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+
+	names, err := listenFDNames(pid, "2", "ss-tcp:ss-udp")
+	require.NoError(t, err)
+	require.Equal(t, []string{"ss-tcp", "ss-udp"}, names)
+
+	names, err = listenFDNames(pid, "2", "")
+	require.NoError(t, err)
+	require.Equal(t, []string{"unknown", "unknown"}, names)
+
+	names, err = listenFDNames("1", "2", "ss-tcp:ss-udp")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	names, err = listenFDNames(pid, "", "")
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	_, err = listenFDNames(pid, "two", "")
+	require.Error(t, err)
+}
+
+// makeSocketSet returns a set with a TCP listener and a UDP socket bound to
+// the same localhost port, named `name`.
+func makeSocketSet(t *testing.T, name string) (*socketSet, int) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer listener.Close()
+	port := listener.Addr().(*net.TCPAddr).Port
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: port})
+	require.NoError(t, err)
+	defer packetConn.Close()
+
+	set := &socketSet{}
+	t.Cleanup(set.close)
+	for _, f := range []interface{ File() (*os.File, error) }{listener, packetConn} {
+		file, err := f.File()
+		require.NoError(t, err)
+		require.NoError(t, set.add(name, file, true))
+		file.Close()
+	}
+	return set, port
+}
+
+func TestSocketSetTake(t *testing.T) {
+	set, port := makeSocketSet(t, "ss")
+	require.Equal(t, []string{"ss", "ss"}, set.unclaimed())
+
+	listeners, packetConns, err := set.take(port+1, "")
+	require.NoError(t, err)
+	require.Empty(t, listeners)
+	require.Empty(t, packetConns)
+
+	listeners, packetConns, err = set.take(port, "")
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	require.Len(t, packetConns, 1)
+	require.Empty(t, set.unclaimed())
+	listeners[0].Close()
+	packetConns[0].Close()
+
+	// The inherited sockets are still open after their copies are closed.
+	listeners, packetConns, err = set.take(0, "ss")
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	require.Len(t, packetConns, 1)
+	defer listeners[0].Close()
+	defer packetConns[0].Close()
+	go func() {
+		conn, err := listeners[0].Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+	conn, err := net.Dial("tcp", listeners[0].Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestRunSSServerInheritedSockets(t *testing.T) {
+	set, port := makeSocketSet(t, "ss")
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	config := fmt.Sprintf("keys:\n  - id: user-0\n    port: %v\n    cipher: chacha20-ietf-poly1305\n    secret: Secret0\n", port)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+
+	server, err := RunSSServer(configFile, 30*time.Second, m, replayOptions{}, nil, set)
+	require.NoError(t, err)
+	defer server.Stop()
+	require.Empty(t, set.unclaimed())
+	port0 := server.ports[port]
+	require.NotNil(t, port0)
+	require.Len(t, port0.tcpServices, 1)
+	require.Len(t, port0.udpServices, 1)
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%v", port), time.Second)
+	require.NoError(t, err)
+	conn.Close()
+}
+
+func TestRunSSServerMissingSocketName(t *testing.T) {
+	set, port := makeSocketSet(t, "ss")
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	config := fmt.Sprintf("keys:\n  - id: user-0\n    port: %v\n    cipher: chacha20-ietf-poly1305\n    secret: Secret0\nports:\n  - port: %v\n    socket: other\n", port, port)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+
+	_, err := RunSSServer(configFile, 30*time.Second, m, replayOptions{}, nil, set)
+	require.Error(t, err)
+}
@@ -0,0 +1,307 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+)
+
+// An upgrade starts the new server with the sockets of the current one in
+// LISTEN_FDS, as in socket activation, followed by two pipes: one with the
+// replay caches, and one that the new server writes to once it is serving.
+// The current server sends the replay caches again when it stops accepting,
+// and once more when it has drained, so that the new server also learns the
+// salts seen in the meantime.
+// upgradeEnv is set for the new server.  Its value is the number of sockets,
+// at the start of LISTEN_FDS, that came from systemd.
+const upgradeEnv = "OUTLINE_SS_UPGRADE"
+
+// How long the current server waits for the new one to start serving.
+const upgradeTimeout = time.Minute
+
+// Upper bound on the size of each replay cache in a handoff.
+const maxReplayStateLen = 64 << 20
+
+// replayState holds the replay caches passed by the previous server, as saved
+// by ReplayCache.Save.
+type replayState struct {
+	tcp, udp []byte
+}
+
+// handoff is the state passed by the previous server in an upgrade.
+type handoff struct {
+	state *os.File
+	ready *os.File
+}
+
+// previousServer returns the handoff from the server that started this
+// process in an upgrade, or nil.  It must be called before listenFDs.
+func previousServer() (*handoff, error) {
+	if os.Getenv(upgradeEnv) == "" {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	return &handoff{
+		state: os.NewFile(uintptr(listenFDsStart+n), "replay state"),
+		ready: os.NewFile(uintptr(listenFDsStart+n+1), "ready"),
+	}, nil
+}
+
+// replayState reads the replay caches from the previous server.
+func (h *handoff) replayState() (*replayState, error) {
+	state, err := readReplayState(h.state)
+	if err != nil {
+		h.state.Close()
+	}
+	return state, err
+}
+
+// mergeReplayState adds the salts that the previous server sees until it has
+// drained to the replay caches of `s`.  It returns once the previous server has
+// exited.
+func (h *handoff) mergeReplayState(s *SSServer) {
+	defer h.state.Close()
+	for {
+		state, err := readReplayState(h.state)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			logger.Errorf("Failed to update replay history from the previous server: %v", err)
+			return
+		}
+		if err := s.replayCache.Merge(bytes.NewReader(state.tcp)); err != nil {
+			logger.Errorf("Failed to update replay history from the previous server: %v", err)
+		}
+		if err := s.udpReplayCache.Merge(bytes.NewReader(state.udp)); err != nil {
+			logger.Errorf("Failed to update UDP replay history from the previous server: %v", err)
+		}
+	}
+}
+
+// done tells the previous server that this one is serving, so it can stop
+// accepting.
+func (h *handoff) done() error {
+	defer h.ready.Close()
+	_, err := h.ready.Write([]byte{1})
+	return err
+}
+
+// writeReplayState writes each cache to `w`, preceded by its length.
+func writeReplayState(w io.Writer, caches ...*service.ReplayCache) error {
+	for _, cache := range caches {
+		var buf bytes.Buffer
+		if err := cache.Save(&buf); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, uint32(buf.Len())); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReplayState reads the caches written by writeReplayState.  It returns
+// io.EOF if `r` ends before the caches.
+func readReplayState(r io.Reader) (*replayState, error) {
+	var caches [2][]byte
+	for i := range caches {
+		var n uint32
+		if err := binary.Read(r, binary.BigEndian, &n); err == io.EOF && i == 0 {
+			return nil, err
+		} else if err != nil {
+			return nil, fmt.Errorf("Failed to read replay state: %v", err)
+		}
+		if n > maxReplayStateLen {
+			return nil, errors.New("Replay state is too long")
+		}
+		caches[i] = make([]byte, n)
+		if _, err := io.ReadFull(r, caches[i]); err != nil {
+			return nil, fmt.Errorf("Failed to read replay state: %v", err)
+		}
+	}
+	return &replayState{tcp: caches[0], udp: caches[1]}, nil
+}
+
+// replayStream sends the replay caches to the new server in an upgrade.
+type replayStream struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// send writes the current contents of the caches of `s`.
+func (r *replayStream) send(s *SSServer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return writeReplayState(r.file, &s.replayCache, &s.udpReplayCache)
+}
+
+func (r *replayStream) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+// upgrade starts a new server from the current executable, with the same
+// arguments, and hands over the sockets and the replay caches.  It returns
+// once the new server is serving, after which this one should drain with the
+// returned stream.  If the new server fails to start, this one keeps serving.
+func (s *SSServer) upgrade() (*replayStream, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	files, names, kept, err := s.sockets.files()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to copy sockets: %v", err)
+	}
+	defer closeFiles(files)
+	stateReader, stateWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stateReader.Close()
+	stream := &replayStream{file: stateWriter}
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		stream.close()
+		return nil, err
+	}
+	defer readyReader.Close()
+	defer readyWriter.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, stateReader, readyWriter)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("LISTEN_FDS=%v", len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		fmt.Sprintf("%v=%v", upgradeEnv, kept))
+	if err := cmd.Start(); err != nil {
+		stream.close()
+		return nil, fmt.Errorf("Failed to start %v: %v", exe, err)
+	}
+	// Only the new server holds the other ends now, so reads see EOF if it exits.
+	stateReader.Close()
+	readyWriter.Close()
+	// The new server reads the caches before it is ready, so this doesn't
+	// block the stream for long once the upgrade succeeds.
+	go func() {
+		if err := stream.send(s); err != nil {
+			logger.Errorf("Failed to send replay state: %v", err)
+		}
+	}()
+
+	ready := make(chan bool, 1)
+	go func() {
+		n, _ := readyReader.Read(make([]byte, 1))
+		ready <- n == 1
+	}()
+	select {
+	case ok := <-ready:
+		if ok {
+			logger.Infof("New server is running with PID %v", cmd.Process.Pid)
+			// Otherwise systemd stops the service, and the new server, when this
+			// one exits.
+			if err := sdNotify(fmt.Sprintf("MAINPID=%v", cmd.Process.Pid)); err != nil {
+				logger.Warningf("Failed to notify the service manager: %v", err)
+			}
+			// Reap the new server if it exits before this one.
+			go cmd.Wait()
+			return stream, nil
+		}
+		stream.close()
+		return nil, fmt.Errorf("New server failed to start: %v", cmd.Wait())
+	case <-time.After(upgradeTimeout):
+		stream.close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, errors.New("Timed out waiting for the new server")
+	}
+}
+
+// drain stops accepting on all ports after an upgrade, and returns once the
+// existing sessions have ended.  The replay caches are not saved, since the
+// new server has taken them over.  Instead, they are sent on `stream`, if it
+// isn't nil, once no more ports are accepting, and again at the end.
+func (s *SSServer) drain(stream *replayStream) {
+	if s.stopSaving != nil {
+		close(s.stopSaving)
+		s.stopSaving = nil
+	}
+	sendReplayState := func() {
+		if stream == nil {
+			return
+		}
+		if err := stream.send(s); err != nil {
+			logger.Errorf("Failed to send replay state: %v", err)
+		}
+	}
+	for _, port := range s.ports {
+		for _, tcpService := range port.tcpServices {
+			tcpService.Stop()
+		}
+		for _, udpService := range port.udpServices {
+			udpService.Stop()
+		}
+	}
+	// Handshakes that are in progress can still add salts.
+	sendReplayState()
+	var wg sync.WaitGroup
+	for _, port := range s.ports {
+		for _, tcpService := range port.tcpServices {
+			wg.Add(1)
+			go func(tcpService service.TCPService) {
+				defer wg.Done()
+				tcpService.GracefulStop()
+			}(tcpService)
+		}
+		for _, udpService := range port.udpServices {
+			wg.Add(1)
+			go func(udpService service.UDPService) {
+				defer wg.Done()
+				udpService.GracefulStop()
+			}(udpService)
+		}
+	}
+	wg.Wait()
+	sendReplayState()
+	if stream != nil {
+		stream.close()
+	}
+	if err := s.probeLog.Close(); err != nil {
+		logger.Errorf("Failed to close probe log: %v", err)
+	}
+	s.sockets.close()
+}
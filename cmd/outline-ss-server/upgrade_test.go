@@ -0,0 +1,159 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayState(t *testing.T) {
+	tcp := service.NewReplayCache(10)
+	udp := service.NewReplayCache(10)
+	tcp.Add("id", []byte("tcp salt"))
+	udp.Add("id", []byte("udp salt"))
+	var buf bytes.Buffer
+	require.NoError(t, writeReplayState(&buf, &tcp, &udp))
+
+	state, err := readReplayState(&buf)
+	require.NoError(t, err)
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("keys: []\n"), 0644))
+	replay := replayOptions{history: 10, udpHistory: 10, inherited: state}
+	server, err := RunSSServer(configFile, 30*time.Second, m, replay, nil, nil)
+	require.NoError(t, err)
+	defer server.Stop()
+	require.False(t, server.replayCache.Add("id", []byte("tcp salt")))
+	require.False(t, server.udpReplayCache.Add("id", []byte("udp salt")))
+
+	_, err = readReplayState(bytes.NewReader([]byte{0, 0, 0, 10, 1}))
+	require.Error(t, err)
+}
+
+// Salts that the previous server sees after the new one has started are sent
+// when the previous server drains.
+func TestReplayStateStream(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	require.NoError(t, ioutil.WriteFile(configFile, []byte("keys: []\n"), 0644))
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	replay := replayOptions{history: 10, udpHistory: 10}
+	oldServer, err := RunSSServer(configFile, 30*time.Second, m, replay, nil, nil)
+	require.NoError(t, err)
+	require.True(t, oldServer.replayCache.Add("id", []byte("first salt")))
+
+	reader, writer, err := os.Pipe()
+	require.NoError(t, err)
+	stream := &replayStream{file: writer}
+	previous := &handoff{state: reader}
+	go stream.send(oldServer)
+	replay.inherited, err = previous.replayState()
+	require.NoError(t, err)
+	newServer, err := RunSSServer(configFile, 30*time.Second, m, replay, nil, nil)
+	require.NoError(t, err)
+	defer newServer.Stop()
+	merged := make(chan struct{})
+	go func() {
+		previous.mergeReplayState(newServer)
+		close(merged)
+	}()
+
+	require.True(t, oldServer.replayCache.Add("id", []byte("tcp salt")))
+	require.True(t, oldServer.udpReplayCache.Add("id", []byte("udp salt")))
+	oldServer.drain(stream)
+	<-merged
+	require.False(t, newServer.replayCache.Add("id", []byte("first salt")))
+	require.False(t, newServer.replayCache.Add("id", []byte("tcp salt")))
+	require.False(t, newServer.udpReplayCache.Add("id", []byte("udp salt")))
+}
+
+// freePort returns a localhost port that is not in use.
+func freePort(t *testing.T) int {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// A server can take over the sockets of another one, and release them when the
+// port is removed.
+func TestSocketHandoff(t *testing.T) {
+	port := freePort(t)
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yml")
+	config := fmt.Sprintf("keys:\n  - id: user-0\n    port: %v\n    cipher: chacha20-ietf-poly1305\n    secret: Secret0\n", port)
+	require.NoError(t, ioutil.WriteFile(configFile, []byte(config), 0644))
+	emptyFile := filepath.Join(dir, "empty.yml")
+	require.NoError(t, ioutil.WriteFile(emptyFile, []byte("keys: []\n"), 0644))
+
+	m := metrics.NewPrometheusShadowsocksMetrics(prometheus.NewRegistry())
+	oldServer, err := RunSSServer(configFile, 30*time.Second, m, replayOptions{}, nil, nil)
+	require.NoError(t, err)
+	files, names, kept, err := oldServer.sockets.files()
+	require.NoError(t, err)
+	require.Equal(t, 0, kept)
+	require.Equal(t, []string{fmt.Sprint(port), fmt.Sprint(port)}, names)
+
+	sockets := &socketSet{}
+	for i, file := range files {
+		require.NoError(t, sockets.add(names[i], file, i < kept))
+		file.Close()
+	}
+	newServer, err := RunSSServer(configFile, 30*time.Second, m, replayOptions{}, nil, sockets)
+	require.NoError(t, err)
+	require.Empty(t, sockets.unclaimed())
+	oldServer.drain(nil)
+
+	conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%v", port), time.Second)
+	require.NoError(t, err)
+	conn.Close()
+
+	require.NoError(t, newServer.loadConfigFile(emptyFile))
+	defer newServer.Stop()
+	// The port is free once it is removed.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+	require.NoError(t, err)
+	listener.Close()
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	require.NoError(t, sdNotify("READY=1"))
+
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", path)
+	require.NoError(t, sdNotify("MAINPID=1234"))
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "MAINPID=1234", string(buf[:n]))
+}
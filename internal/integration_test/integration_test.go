@@ -249,6 +249,7 @@ func (m *fakeUDPMetrics) AddUDPPacketFromTarget(clientIp, accessKey, status stri
 func (m *fakeUDPMetrics) AddUDPNatEntry() {
 	m.natAdded++
 }
+func (m *fakeUDPMetrics) AddCipherLookup(proto, affinity string) {}
 func (m *fakeUDPMetrics) RemoveUDPNatEntry() {
 	// Not tested because it requires waiting for a long timeout.
 }
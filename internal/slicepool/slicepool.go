@@ -16,6 +16,7 @@ package slicepool
 
 import (
 	"sync"
+	"sync/atomic"
 )
 
 // Pool wraps a sync.Pool of *[]byte.  To encourage correct usage,
@@ -28,6 +29,8 @@ import (
 type Pool struct {
 	pool *sync.Pool
 	len  int
+	// Number of slices that are currently acquired.
+	inUse *int64
 }
 
 // MakePool returns a Pool of slices with the specified length.
@@ -42,11 +45,19 @@ func MakePool(sliceLen int) Pool {
 				return &slice
 			},
 		},
-		len: sliceLen,
+		len:   sliceLen,
+		inUse: new(int64),
 	}
 }
 
+// BytesInUse returns the total length of the slices that are currently
+// acquired from this Pool.
+func (p *Pool) BytesInUse() int64 {
+	return atomic.LoadInt64(p.inUse) * int64(p.len)
+}
+
 func (p *Pool) get() *[]byte {
+	atomic.AddInt64(p.inUse, 1)
 	return p.pool.Get().(*[]byte)
 }
 
@@ -54,6 +65,7 @@ func (p *Pool) put(b *[]byte) {
 	if len(*b) != p.len || cap(*b) != p.len {
 		panic("Buffer length mismatch")
 	}
+	atomic.AddInt64(p.inUse, -1)
 	p.pool.Put(b)
 }
 
@@ -28,6 +28,26 @@ func TestPool(t *testing.T) {
 	slice.Release()
 }
 
+func TestBytesInUse(t *testing.T) {
+	pool := MakePool(10)
+	a := pool.LazySlice()
+	b := pool.LazySlice()
+	a.Acquire()
+	b.Acquire()
+	if n := pool.BytesInUse(); n != 20 {
+		t.Errorf("Wrong bytes in use: %d", n)
+	}
+	a.Release()
+	a.Release()
+	if n := pool.BytesInUse(); n != 10 {
+		t.Errorf("Wrong bytes in use after release: %d", n)
+	}
+	b.Release()
+	if n := pool.BytesInUse(); n != 0 {
+		t.Errorf("Wrong bytes in use after releasing all: %d", n)
+	}
+}
+
 func BenchmarkPool(b *testing.B) {
 	pool := MakePool(10)
 	for i := 0; i < b.N; i++ {
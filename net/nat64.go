@@ -0,0 +1,65 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"fmt"
+	"net"
+)
+
+// ParseNAT64Prefix parses a NAT64 prefix in CIDR notation, such as the
+// Well-Known Prefix "64:ff9b::/96".  The prefix length must be one of the
+// lengths allowed by RFC 6052 Section 2.2.
+func ParseNAT64Prefix(cidr string) (*net.IPNet, error) {
+	ip, prefix, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	if ip.To4() != nil {
+		return nil, fmt.Errorf("NAT64 prefix must be IPv6: %s", cidr)
+	}
+	switch ones, _ := prefix.Mask.Size(); ones {
+	case 32, 40, 48, 56, 64, 96:
+		return prefix, nil
+	default:
+		return nil, fmt.Errorf("Invalid NAT64 prefix length %d in %s", ones, cidr)
+	}
+}
+
+// SynthesizeNAT64 embeds the IPv4 address `ip` in the NAT64 `prefix`, as
+// specified in RFC 6052 Section 2.2.  Bits 64 to 71 of the result are always
+// zero.  The prefix must have been validated by ParseNAT64Prefix.
+func SynthesizeNAT64(prefix *net.IPNet, ip net.IP) (net.IP, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("Not an IPv4 address: %s", ip)
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits != 8*net.IPv6len {
+		return nil, fmt.Errorf("NAT64 prefix must be IPv6: %s", prefix)
+	}
+	out := make(net.IP, net.IPv6len)
+	copy(out, prefix.IP.Mask(prefix.Mask))
+	// Copy the IPv4 address after the prefix, skipping the reserved octet "u".
+	i := ones / 8
+	for _, b := range ip4 {
+		if i == 8 {
+			i++
+		}
+		out[i] = b
+		i++
+	}
+	return out, nil
+}
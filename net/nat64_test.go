@@ -0,0 +1,68 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package net
+
+import (
+	"net"
+	"testing"
+)
+
+// Examples from RFC 6052 Section 2.4, for the IPv4 address 192.0.2.33.
+var nat64Tests = []struct {
+	prefix   string
+	expected string
+}{
+	{"2001:db8::/32", "2001:db8:c000:221::"},
+	{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+	{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+	{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+	{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+	{"2001:db8:122:344::/96", "2001:db8:122:344::192.0.2.33"},
+	{"64:ff9b::/96", "64:ff9b::192.0.2.33"},
+}
+
+func TestSynthesizeNAT64(t *testing.T) {
+	ip := net.ParseIP("192.0.2.33")
+	for _, tt := range nat64Tests {
+		prefix, err := ParseNAT64Prefix(tt.prefix)
+		if err != nil {
+			t.Errorf("ParseNAT64Prefix(%s): %v", tt.prefix, err)
+			continue
+		}
+		actual, err := SynthesizeNAT64(prefix, ip)
+		if err != nil {
+			t.Errorf("SynthesizeNAT64(%s): %v", tt.prefix, err)
+			continue
+		}
+		if !actual.Equal(net.ParseIP(tt.expected)) {
+			t.Errorf("SynthesizeNAT64(%s): expected %s, actual %s", tt.prefix, tt.expected, actual)
+		}
+	}
+}
+
+func TestSynthesizeNAT64IPv6(t *testing.T) {
+	prefix, _ := ParseNAT64Prefix("64:ff9b::/96")
+	if _, err := SynthesizeNAT64(prefix, net.ParseIP("2001:db8::1")); err == nil {
+		t.Error("Expected error for IPv6 input")
+	}
+}
+
+func TestParseNAT64PrefixInvalid(t *testing.T) {
+	for _, cidr := range []string{"64:ff9b::/80", "192.0.2.0/24", "64:ff9b::"} {
+		if _, err := ParseNAT64Prefix(cidr); err == nil {
+			t.Errorf("Expected error for %s", cidr)
+		}
+	}
+}
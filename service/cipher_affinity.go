@@ -0,0 +1,133 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"net"
+	"time"
+)
+
+const (
+	// Number of addresses and networks remembered by each cipher list.
+	maxAffinityAddrs = 10000
+	// Number of keys remembered for each address or network, so that a few
+	// users can share a network, or a key can be shared by a household.
+	maxAffinityKeys = 4
+	// Addresses and networks that have not used a key for this long are
+	// forgotten.
+	affinityTTL = time.Hour
+)
+
+// The networks that a client is likely to keep when its address changes.
+var (
+	affinityPrefixV4 = net.CIDRMask(24, 32)
+	affinityPrefixV6 = net.CIDRMask(56, 128)
+)
+
+func affinityAddrKey(ip net.IP) string {
+	return string(ip.To16())
+}
+
+func affinityPrefixKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "v4/" + string(ip4.Mask(affinityPrefixV4))
+	}
+	return "v6/" + string(ip.Mask(affinityPrefixV6))
+}
+
+// affinityIndex remembers the keys recently used from each client address and
+// network.  When it is full, the least recently used address or network is
+// forgotten.  It is not thread-safe.
+type affinityIndex struct {
+	entries map[string]*list.Element
+	// Values are *affinityEntry, most recently used first.
+	lru      *list.List
+	maxAddrs int
+	ttl      time.Duration
+}
+
+type affinityEntry struct {
+	key string
+	// Most recently used first.
+	ids    []string
+	expiry time.Time
+}
+
+func newAffinityIndex(maxAddrs int, ttl time.Duration) *affinityIndex {
+	return &affinityIndex{
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		maxAddrs: maxAddrs,
+		ttl:      ttl,
+	}
+}
+
+// get returns the IDs of the keys recently used from `key`, most recent first.
+// The result must not be modified.
+func (idx *affinityIndex) get(key string, now time.Time) []string {
+	e := idx.entries[key]
+	if e == nil {
+		return nil
+	}
+	entry := e.Value.(*affinityEntry)
+	if now.After(entry.expiry) {
+		return nil
+	}
+	return entry.ids
+}
+
+// add records the use of key `id` from `key`.
+func (idx *affinityIndex) add(key, id string, now time.Time) {
+	var entry *affinityEntry
+	if e := idx.entries[key]; e != nil {
+		idx.lru.MoveToFront(e)
+		entry = e.Value.(*affinityEntry)
+		if now.After(entry.expiry) {
+			entry.ids = nil
+		}
+	} else {
+		for idx.lru.Len() >= idx.maxAddrs {
+			oldest := idx.lru.Remove(idx.lru.Back()).(*affinityEntry)
+			delete(idx.entries, oldest.key)
+		}
+		entry = &affinityEntry{key: key}
+		idx.entries[key] = idx.lru.PushFront(entry)
+	}
+	entry.expiry = now.Add(idx.ttl)
+	// Move or insert `id` at the front, dropping the least recent if full.
+	i := 0
+	for i < len(entry.ids) && entry.ids[i] != id {
+		i++
+	}
+	if i == len(entry.ids) {
+		if len(entry.ids) < maxAffinityKeys {
+			entry.ids = append(entry.ids, "")
+		} else {
+			i--
+		}
+	}
+	copy(entry.ids[1:i+1], entry.ids[:i])
+	entry.ids[0] = id
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -18,6 +18,8 @@ import (
 	"container/list"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 )
@@ -26,20 +28,29 @@ import (
 const minSaltEntropy = 16
 
 // CipherEntry holds a Cipher with an identifier.
-// The public fields are constant, but lastClientIP is mutable under cipherList.mu.
+// The public fields are constant.
 type CipherEntry struct {
 	ID            string
 	Cipher        *ss.Cipher
 	SaltGenerator ServerSaltGenerator
-	lastClientIP  net.IP
+	// Egress overrides the port's EgressPolicy for this key, if not nil.
+	Egress *EgressPolicy
+	// NATTimeouts overrides the port's NATTimeoutPolicy for this key, if not nil.
+	NATTimeouts *NATTimeoutPolicy
 }
 
 // MakeCipherEntry constructs a CipherEntry.
 func MakeCipherEntry(id string, cipher *ss.Cipher, secret string) CipherEntry {
+	return MakeMarkedCipherEntry(id, cipher, secret, nil)
+}
+
+// MakeMarkedCipherEntry is like MakeCipherEntry, but marks server salts according
+// to `marking`, which may be nil.
+func MakeMarkedCipherEntry(id string, cipher *ss.Cipher, secret string, marking *SaltMarking) CipherEntry {
 	var saltGenerator ServerSaltGenerator
-	if cipher.SaltSize()-serverSaltMarkLen >= minSaltEntropy {
+	if cipher.SaltSize()-marking.EffectiveMarkLen() >= minSaltEntropy {
 		// Mark salts with a tag for reverse replay protection.
-		saltGenerator = NewServerSaltGenerator(secret)
+		saltGenerator = NewMarkedServerSaltGenerator(secret, marking)
 	} else {
 		// Adding a tag would leave too little randomness to protect
 		// against accidental salt reuse, so don't mark the salts.
@@ -52,67 +63,211 @@ func MakeCipherEntry(id string, cipher *ss.Cipher, secret string) CipherEntry {
 	}
 }
 
+// CipherAffinity describes whether a key was expected for a client, because
+// the key was recently used from the client's IP address or network.
+type CipherAffinity string
+
+const (
+	ClientIPAffinity CipherAffinity = "client_ip"
+	PrefixAffinity   CipherAffinity = "prefix"
+	NoAffinity       CipherAffinity = "none"
+)
+
 // CipherList is a thread-safe collection of CipherEntry elements that allows for
 // snapshotting and moving to front.
 type CipherList interface {
-	// Returns a snapshot of the cipher list optimized for this client IP
+	// Returns a snapshot of the cipher list optimized for this client IP.  The
+	// keys recently used from the IP address come first, then those recently
+	// used from its network, and then the rest, most recently used first.  The
+	// snapshot may be shared, and must not be modified.
 	SnapshotForClientIP(clientIP net.IP) []*list.Element
-	MarkUsedByClientIP(e *list.Element, clientIP net.IP)
+	// MarkUsedByClientIP moves the entry to the front, and remembers that it
+	// was used from the client IP.  It returns the affinity of the entry for
+	// the client before this call.  Snapshots may take a moment to reflect the
+	// new order.
+	MarkUsedByClientIP(e *list.Element, clientIP net.IP) CipherAffinity
 	// Update replaces the current contents of the CipherList with `contents`,
 	// which is a List of *CipherEntry.  Update takes ownership of `contents`,
 	// which must not be read or written after this call.
 	Update(contents *list.List)
 }
 
+// Snapshots are rebuilt at most this often to reflect the use of keys.
+const cipherSnapshotInterval = 100 * time.Millisecond
+
+// cipherSnapshot is an immutable copy of the cipher list.
+type cipherSnapshot struct {
+	// Most recently used first.
+	elements []*list.Element
+	// Elements by ID, to find the keys in the affinity index.
+	byID  map[string]*list.Element
+	taken time.Time
+}
+
 type cipherList struct {
 	CipherList
+	snapshot atomic.Pointer[cipherSnapshot]
+	// Set when the list has been reordered since the snapshot was taken.
+	stale    atomic.Bool
+	interval time.Duration
+	// Protects list.
+	mu   sync.Mutex
 	list *list.List
-	mu   sync.RWMutex
+	// Protects affinity.
+	affinityMu sync.RWMutex
+	affinity   *affinityIndex
 }
 
 // NewCipherList creates an empty CipherList
 func NewCipherList() CipherList {
-	return &cipherList{list: list.New()}
+	cl := &cipherList{
+		interval: cipherSnapshotInterval,
+		list:     list.New(),
+		affinity: newAffinityIndex(maxAffinityAddrs, affinityTTL),
+	}
+	cl.snapshot.Store(&cipherSnapshot{byID: make(map[string]*list.Element)})
+	return cl
 }
 
-func matchesIP(e *list.Element, clientIP net.IP) bool {
-	c := e.Value.(*CipherEntry)
-	return clientIP != nil && clientIP.Equal(c.lastClientIP)
+// takeSnapshot copies the list.  The caller must hold mu.
+func (cl *cipherList) takeSnapshot(byID map[string]*list.Element) {
+	elements := make([]*list.Element, 0, cl.list.Len())
+	for e := cl.list.Front(); e != nil; e = e.Next() {
+		elements = append(elements, e)
+	}
+	cl.stale.Store(false)
+	cl.snapshot.Store(&cipherSnapshot{elements: elements, byID: byID, taken: time.Now()})
 }
 
-func (cl *cipherList) SnapshotForClientIP(clientIP net.IP) []*list.Element {
-	cl.mu.RLock()
-	defer cl.mu.RUnlock()
-	cipherArray := make([]*list.Element, cl.list.Len())
-	i := 0
-	// First pass: put all ciphers with matching last known IP at the front.
-	for e := cl.list.Front(); e != nil; e = e.Next() {
-		if matchesIP(e, clientIP) {
-			cipherArray[i] = e
-			i++
+// currentSnapshot returns the snapshot, after refreshing it if it is stale and
+// old enough.  Only one goroutine refreshes it at a time, and the others use
+// the stale snapshot meanwhile.
+func (cl *cipherList) currentSnapshot() *cipherSnapshot {
+	snapshot := cl.snapshot.Load()
+	if cl.stale.Load() && time.Since(snapshot.taken) >= cl.interval && cl.mu.TryLock() {
+		cl.takeSnapshot(snapshot.byID)
+		cl.mu.Unlock()
+		snapshot = cl.snapshot.Load()
+	}
+	return snapshot
+}
+
+// keyOrder is the order in which to try the keys for a client: the candidates
+// from the affinity index, and then all the keys, skipping the candidates.
+type keyOrder struct {
+	candidates []*list.Element
+	all        []*list.Element
+}
+
+func (o keyOrder) len() int {
+	return len(o.candidates) + len(o.all)
+}
+
+// at returns the `i`th key to try, or nil if it's a candidate that was already
+// tried.
+func (o keyOrder) at(i int) *list.Element {
+	if i < len(o.candidates) {
+		return o.candidates[i]
+	}
+	e := o.all[i-len(o.candidates)]
+	if containsElement(o.candidates, e) {
+		return nil
+	}
+	return e
+}
+
+// orderForClientIP returns the order in which to try the keys for `clientIP`,
+// without copying the list.
+func (cl *cipherList) orderForClientIP(clientIP net.IP) keyOrder {
+	snapshot := cl.currentSnapshot()
+	order := keyOrder{all: snapshot.elements}
+	if clientIP == nil {
+		return order
+	}
+	now := time.Now()
+	cl.affinityMu.RLock()
+	order.candidates = appendCandidates(order.candidates, snapshot.byID, cl.affinity.get(affinityAddrKey(clientIP), now))
+	order.candidates = appendCandidates(order.candidates, snapshot.byID, cl.affinity.get(affinityPrefixKey(clientIP), now))
+	cl.affinityMu.RUnlock()
+	return order
+}
+
+// appendCandidates appends the elements of the keys in `ids` that are not
+// already in `candidates`.
+func appendCandidates(candidates []*list.Element, byID map[string]*list.Element, ids []string) []*list.Element {
+	for _, id := range ids {
+		if e := byID[id]; e != nil && !containsElement(candidates, e) {
+			candidates = append(candidates, e)
 		}
 	}
-	// Second pass: include all remaining ciphers in recency order.
-	for e := cl.list.Front(); e != nil; e = e.Next() {
-		if !matchesIP(e, clientIP) {
-			cipherArray[i] = e
-			i++
+	return candidates
+}
+
+func containsElement(elements []*list.Element, e *list.Element) bool {
+	for _, element := range elements {
+		if element == e {
+			return true
+		}
+	}
+	return false
+}
+
+// orderForClientIP returns the order in which to try the keys in
+// `ciphers`, without copying the list if possible.
+func orderForClientIP(ciphers CipherList, clientIP net.IP) keyOrder {
+	if cl, ok := ciphers.(*cipherList); ok {
+		return cl.orderForClientIP(clientIP)
+	}
+	return keyOrder{all: ciphers.SnapshotForClientIP(clientIP)}
+}
+
+func (cl *cipherList) SnapshotForClientIP(clientIP net.IP) []*list.Element {
+	order := cl.orderForClientIP(clientIP)
+	if len(order.candidates) == 0 {
+		return order.all
+	}
+	cipherArray := make([]*list.Element, 0, len(order.all))
+	for i := 0; i < order.len(); i++ {
+		if e := order.at(i); e != nil {
+			cipherArray = append(cipherArray, e)
 		}
 	}
 	return cipherArray
 }
 
-func (cl *cipherList) MarkUsedByClientIP(e *list.Element, clientIP net.IP) {
+func (cl *cipherList) MarkUsedByClientIP(e *list.Element, clientIP net.IP) CipherAffinity {
 	cl.mu.Lock()
-	defer cl.mu.Unlock()
-	cl.list.MoveToFront(e)
-
-	c := e.Value.(*CipherEntry)
-	c.lastClientIP = clientIP
+	if cl.list.Front() != e {
+		cl.list.MoveToFront(e)
+		cl.stale.Store(true)
+	}
+	cl.mu.Unlock()
+	if clientIP == nil {
+		return NoAffinity
+	}
+	id := e.Value.(*CipherEntry).ID
+	now := time.Now()
+	addrKey, prefixKey := affinityAddrKey(clientIP), affinityPrefixKey(clientIP)
+	cl.affinityMu.Lock()
+	defer cl.affinityMu.Unlock()
+	affinity := NoAffinity
+	if containsString(cl.affinity.get(addrKey, now), id) {
+		affinity = ClientIPAffinity
+	} else if containsString(cl.affinity.get(prefixKey, now), id) {
+		affinity = PrefixAffinity
+	}
+	cl.affinity.add(addrKey, id, now)
+	cl.affinity.add(prefixKey, id, now)
+	return affinity
 }
 
 func (cl *cipherList) Update(src *list.List) {
+	byID := make(map[string]*list.Element, src.Len())
+	for e := src.Front(); e != nil; e = e.Next() {
+		byID[e.Value.(*CipherEntry).ID] = e
+	}
 	cl.mu.Lock()
+	defer cl.mu.Unlock()
 	cl.list = src
-	cl.mu.Unlock()
+	cl.takeSnapshot(byID)
 }
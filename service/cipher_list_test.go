@@ -15,11 +15,14 @@
 package service
 
 import (
+	"container/list"
 	"math/rand"
 	"net"
 	"testing"
+	"time"
 
 	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/require"
 )
 
 func BenchmarkLocking(b *testing.B) {
@@ -45,7 +48,8 @@ func BenchmarkSnapshot(b *testing.B) {
 
 	// Shuffling simulates the behavior of a real server, where successive
 	// ciphers are not expected to be nearby in memory.
-	entries := ciphers.SnapshotForClientIP(nil)
+	// Snapshots must not be modified, so shuffle a copy.
+	entries := append([]*list.Element{}, ciphers.SnapshotForClientIP(nil)...)
 	rand.Shuffle(N, func(i, j int) {
 		entries[i], entries[j] = entries[j], entries[i]
 	})
@@ -62,3 +66,117 @@ func BenchmarkSnapshot(b *testing.B) {
 		}
 	})
 }
+
+func entryID(e *list.Element) string {
+	return e.Value.(*CipherEntry).ID
+}
+
+func TestSnapshotAffinity(t *testing.T) {
+	ciphers, err := MakeTestCiphers(ss.MakeTestSecrets(10))
+	require.NoError(t, err)
+	// Reflect every use in the snapshots.
+	ciphers.(*cipherList).interval = 0
+	entries := ciphers.SnapshotForClientIP(nil)
+	wifi := net.ParseIP("192.0.2.1")
+	mobile := net.ParseIP("198.51.100.1")
+	neighbor := net.ParseIP("192.0.2.2")
+
+	require.Equal(t, NoAffinity, ciphers.MarkUsedByClientIP(entries[5], wifi))
+	require.Equal(t, NoAffinity, ciphers.MarkUsedByClientIP(entries[7], mobile))
+	require.Equal(t, NoAffinity, ciphers.MarkUsedByClientIP(entries[3], mobile))
+	// The key used from wifi is no longer the most recent, but it is still first.
+	snapshot := ciphers.SnapshotForClientIP(wifi)
+	require.Len(t, snapshot, 10)
+	require.Equal(t, "id-5", entryID(snapshot[0]))
+	require.Equal(t, "id-3", entryID(snapshot[1]))
+	// Both keys used from mobile come first.
+	snapshot = ciphers.SnapshotForClientIP(mobile)
+	require.Equal(t, []string{"id-3", "id-7", "id-5"}, []string{entryID(snapshot[0]), entryID(snapshot[1]), entryID(snapshot[2])})
+	// The neighbor is on the same network as wifi.
+	require.Equal(t, "id-5", entryID(ciphers.SnapshotForClientIP(neighbor)[0]))
+
+	require.Equal(t, ClientIPAffinity, ciphers.MarkUsedByClientIP(entries[7], mobile))
+	require.Equal(t, PrefixAffinity, ciphers.MarkUsedByClientIP(entries[5], neighbor))
+	require.Equal(t, NoAffinity, ciphers.MarkUsedByClientIP(entries[1], neighbor))
+}
+
+func TestSnapshotAffinityAfterUpdate(t *testing.T) {
+	ciphers, err := MakeTestCiphers(ss.MakeTestSecrets(3))
+	require.NoError(t, err)
+	ip := net.ParseIP("2001:db8::1")
+	entries := ciphers.SnapshotForClientIP(nil)
+	ciphers.MarkUsedByClientIP(entries[0], ip)
+	ciphers.MarkUsedByClientIP(entries[2], nil)
+	require.Equal(t, "id-0", entryID(ciphers.SnapshotForClientIP(ip)[0]))
+
+	// The new list has new entries for id-1 and id-0, in that order, and no id-2.
+	update, err := MakeTestCiphers([]string{"a", "b"})
+	require.NoError(t, err)
+	l := list.New()
+	for _, e := range update.SnapshotForClientIP(nil) {
+		l.PushFront(e.Value)
+	}
+	ciphers.Update(l)
+	snapshot := ciphers.SnapshotForClientIP(ip)
+	require.Len(t, snapshot, 2)
+	require.Equal(t, "id-0", entryID(snapshot[0]))
+	require.Equal(t, "id-1", entryID(snapshot[1]))
+	require.Equal(t, "id-0", entryID(ciphers.SnapshotForClientIP(net.ParseIP("2001:db8:0:ff::1"))[0]))
+}
+
+func TestSnapshotRefresh(t *testing.T) {
+	ciphers, err := MakeTestCiphers(ss.MakeTestSecrets(3))
+	require.NoError(t, err)
+	cl := ciphers.(*cipherList)
+	cl.interval = time.Hour
+	first := ciphers.SnapshotForClientIP(nil)
+	require.Equal(t, "id-0", entryID(first[0]))
+	ciphers.MarkUsedByClientIP(first[2], nil)
+	// The snapshot is shared until it is refreshed.
+	second := ciphers.SnapshotForClientIP(nil)
+	require.Equal(t, &first[0], &second[0])
+
+	cl.interval = 0
+	third := ciphers.SnapshotForClientIP(nil)
+	require.Equal(t, []string{"id-2", "id-0", "id-1"}, []string{entryID(third[0]), entryID(third[1]), entryID(third[2])})
+	// The old snapshot didn't change.
+	require.Equal(t, "id-0", entryID(first[0]))
+}
+
+func TestAffinityIndex(t *testing.T) {
+	idx := newAffinityIndex(2, time.Minute)
+	now := time.Now()
+	for _, id := range []string{"a", "b", "c", "d", "e", "c"} {
+		idx.add("x", id, now)
+	}
+	require.Equal(t, []string{"c", "e", "d", "b"}, idx.get("x", now))
+	require.Nil(t, idx.get("x", now.Add(2*time.Minute)))
+
+	idx.add("y", "a", now)
+	idx.get("x", now)
+	idx.add("z", "a", now)
+	// Looking up x didn't make it more recent than y.
+	require.Nil(t, idx.get("x", now))
+	require.Equal(t, []string{"a"}, idx.get("y", now))
+	require.Equal(t, []string{"a"}, idx.get("z", now))
+
+	// An expired entry starts over.
+	idx.add("z", "b", now.Add(2*time.Minute))
+	require.Equal(t, []string{"b"}, idx.get("z", now.Add(2*time.Minute)))
+}
+
+func BenchmarkSnapshotAffinity(b *testing.B) {
+	const N = 1e3
+	ciphers, _ := MakeTestCiphers(ss.MakeTestSecrets(N))
+	entries := ciphers.SnapshotForClientIP(nil)
+	ips := make([]net.IP, 256)
+	for i := range ips {
+		ips[i] = net.IPv4(192, 0, 2, byte(i))
+		ciphers.MarkUsedByClientIP(entries[rand.Intn(N)], ips[i])
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		// The order that the services use, without copying the snapshot.
+		orderForClientIP(ciphers, ips[n%len(ips)])
+	}
+}
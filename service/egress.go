@@ -0,0 +1,363 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// IPFamily selects the address families used for outbound connections.
+type IPFamily int
+
+const (
+	// IPFamilyAny uses Go's default dual-stack behavior.
+	IPFamilyAny IPFamily = iota
+	IPFamilyPreferIPv4
+	IPFamilyPreferIPv6
+	IPFamilyIPv4Only
+	IPFamilyIPv6Only
+)
+
+var ipFamilyNames = map[string]IPFamily{
+	"":            IPFamilyAny,
+	"any":         IPFamilyAny,
+	"prefer_ipv4": IPFamilyPreferIPv4,
+	"prefer_ipv6": IPFamilyPreferIPv6,
+	"ipv4_only":   IPFamilyIPv4Only,
+	"ipv6_only":   IPFamilyIPv6Only,
+}
+
+// ParseIPFamily converts a configuration string such as "prefer_ipv4" to an IPFamily.
+func ParseIPFamily(name string) (IPFamily, error) {
+	family, ok := ipFamilyNames[name]
+	if !ok {
+		return IPFamilyAny, fmt.Errorf("Unknown IP family %q", name)
+	}
+	return family, nil
+}
+
+// EgressPolicy controls how the proxy resolves and connects to targets.
+// The nil and zero values use Go's default dual-stack behavior.
+type EgressPolicy struct {
+	Family IPFamily
+	// FallbackDelay is the Happy Eyeballs delay (RFC 8305) before the other
+	// address family is tried.  Zero means the Go default of 300 ms, and a
+	// negative value disables the race, so addresses are tried in order.
+	FallbackDelay time.Duration
+	// NAT64Prefix, if set, is used to synthesize IPv6 addresses (RFC 6052) for
+	// IPv4 targets.  It is only allowed with IPFamilyIPv6Only.
+	NAT64Prefix *net.IPNet
+}
+
+// Validate checks that the policy is self-consistent.
+func (p *EgressPolicy) Validate() error {
+	if p == nil || p.NAT64Prefix == nil {
+		return nil
+	}
+	if p.Family != IPFamilyIPv6Only {
+		return errors.New("NAT64 prefix requires the ipv6_only family")
+	}
+	if _, bits := p.NAT64Prefix.Mask.Size(); bits != 8*net.IPv6len {
+		return fmt.Errorf("NAT64 prefix must be IPv6: %v", p.NAT64Prefix)
+	}
+	return nil
+}
+
+func (p *EgressPolicy) isDefault() bool {
+	return p == nil || (p.Family == IPFamilyAny && p.NAT64Prefix == nil)
+}
+
+// egressAddr is a candidate target address.  `original` is the IPv4 address
+// that `ip` was synthesized from, or nil if `ip` was not synthesized.
+type egressAddr struct {
+	ip       net.IP
+	original net.IP
+}
+
+// lookupIP resolves host names for the policies.  Tests replace it.
+var lookupIP = net.DefaultResolver.LookupIP
+
+// resolve looks up `host` and returns the candidate addresses, split into the
+// preferred family (`primaries`) and the other family (`fallbacks`).
+func (p *EgressPolicy) resolve(ctx context.Context, host string) (primaries, fallbacks []egressAddr, err error) {
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		network := "ip"
+		if p.Family == IPFamilyIPv4Only {
+			network = "ip4"
+		} else if p.Family == IPFamilyIPv6Only && p.NAT64Prefix == nil {
+			network = "ip6"
+		}
+		if ips, err = lookupIP(ctx, network, host); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var ipv4, ipv6 []egressAddr
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			ipv4 = append(ipv4, egressAddr{ip: ip})
+		} else {
+			ipv6 = append(ipv6, egressAddr{ip: ip})
+		}
+	}
+
+	switch p.Family {
+	case IPFamilyIPv4Only:
+		primaries = ipv4
+	case IPFamilyIPv6Only:
+		primaries = ipv6
+		if len(primaries) == 0 && p.NAT64Prefix != nil {
+			// Synthesize addresses only if the target has no native IPv6, as in DNS64.
+			for _, a := range ipv4 {
+				synthesized, err := onet.SynthesizeNAT64(p.NAT64Prefix, a.ip)
+				if err != nil {
+					return nil, nil, err
+				}
+				primaries = append(primaries, egressAddr{ip: synthesized, original: a.ip})
+			}
+		}
+	case IPFamilyPreferIPv4:
+		primaries, fallbacks = ipv4, ipv6
+	case IPFamilyPreferIPv6:
+		primaries, fallbacks = ipv6, ipv4
+	default:
+		// Like Go, prefer the family of the first address.
+		if len(ips) > 0 && ips[0].To4() == nil {
+			primaries, fallbacks = ipv6, ipv4
+		} else {
+			primaries, fallbacks = ipv4, ipv6
+		}
+	}
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+	if len(primaries) == 0 {
+		return nil, nil, fmt.Errorf("No suitable address found for %s", host)
+	}
+	return primaries, fallbacks, nil
+}
+
+// validateEgressAddr applies the validator to the address that will be used,
+// and also to the IPv4 address it was synthesized from, so that NAT64 can't be
+// used to reach addresses that the validator would otherwise reject.
+func validateEgressAddr(a egressAddr, targetIPValidator onet.TargetIPValidator) *onet.ConnectionError {
+	if a.original != nil {
+		if err := targetIPValidator(a.original); err != nil {
+			return err
+		}
+	}
+	return targetIPValidator(a.ip)
+}
+
+// resolveUDP returns the address to use for the UDP target `tgtAddr`.
+func (p *EgressPolicy) resolveUDP(tgtAddr string, targetIPValidator onet.TargetIPValidator) (*net.UDPAddr, *onet.ConnectionError) {
+	if p.isDefault() {
+		tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr)
+		if err != nil {
+			return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+		}
+		if err := targetIPValidator(tgtUDPAddr.IP); err != nil {
+			return nil, err
+		}
+		return tgtUDPAddr, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(tgtAddr)
+	if err != nil {
+		return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+	}
+	port, err := net.LookupPort("udp", portStr)
+	if err != nil {
+		return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+	}
+	primaries, _, err := p.resolve(context.Background(), host)
+	if err != nil {
+		return nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
+	}
+	// UDP has no handshake to race, so we always use the first preferred address.
+	if err := validateEgressAddr(primaries[0], targetIPValidator); err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: primaries[0].ip, Port: port}, nil
+}
+
+// targetIPError carries a rejection by the TargetIPValidator through net.Dialer.
+type targetIPError struct {
+	connErr *onet.ConnectionError
+}
+
+func (e *targetIPError) Error() string {
+	return e.connErr.Message
+}
+
+// dialTCP connects to `tgtAddr` according to the policy and the connect
+// settings in `timeouts`.  The validator is applied to every address before it
+// is dialed.  `sockopts`, which may be nil, is applied to the socket before it connects.
+func (p *EgressPolicy) dialTCP(ctx context.Context, tgtAddr string, targetIPValidator onet.TargetIPValidator, timeouts TCPTimeouts, sockopts *TCPSocketOptions) (*net.TCPConn, *onet.ConnectionError) {
+	if p == nil {
+		p = &EgressPolicy{}
+	}
+	sockControl := sockopts.dialControl()
+	dialer := net.Dialer{FallbackDelay: p.FallbackDelay, Control: sockControl}
+	var conn net.Conn
+	var err error
+	if p.isDefault() && timeouts.Connect == 0 && timeouts.ConnectAttempts == 0 {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			ip, _, _ := net.SplitHostPort(address)
+			if ipError := targetIPValidator(net.ParseIP(ip)); ipError != nil {
+				return &targetIPError{ipError}
+			}
+			if sockControl != nil {
+				return sockControl(network, address, c)
+			}
+			return nil
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", tgtAddr)
+	} else {
+		conn, err = p.dialResolved(ctx, &dialer, tgtAddr, targetIPValidator, timeouts)
+	}
+	if err != nil {
+		var ipError *targetIPError
+		if errors.As(err, &ipError) {
+			return nil, ipError.connErr
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			return nil, onet.NewConnectionError("ERR_CONNECT_TIMEOUT", "Timed out connecting to target", err)
+		}
+		return nil, onet.NewConnectionError("ERR_CONNECT", "Failed to connect to target", err)
+	}
+	return conn.(*net.TCPConn), nil
+}
+
+func (p *EgressPolicy) dialResolved(ctx context.Context, dialer *net.Dialer, tgtAddr string, targetIPValidator onet.TargetIPValidator, timeouts TCPTimeouts) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(tgtAddr)
+	if err != nil {
+		return nil, err
+	}
+	primaries, fallbacks, err := p.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if n := timeouts.ConnectAttempts; n > 0 {
+		if len(primaries) > n {
+			primaries = primaries[:n]
+		}
+		if len(fallbacks) > n {
+			fallbacks = fallbacks[:n]
+		}
+	}
+	dialOne := func(ctx context.Context, a egressAddr) (net.Conn, error) {
+		if ipError := validateEgressAddr(a, targetIPValidator); ipError != nil {
+			return nil, &targetIPError{ipError}
+		}
+		if timeouts.Connect > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeouts.Connect)
+			defer cancel()
+		}
+		return dialer.DialContext(ctx, "tcp", net.JoinHostPort(a.ip.String(), port))
+	}
+	dialSerial := func(ctx context.Context, addrs []egressAddr) (net.Conn, error) {
+		var firstErr error
+		for _, a := range addrs {
+			conn, err := dialOne(ctx, a)
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, firstErr
+	}
+	if len(fallbacks) == 0 || p.FallbackDelay < 0 {
+		return dialSerial(ctx, append(primaries, fallbacks...))
+	}
+	return dialHappyEyeballs(ctx, primaries, fallbacks, p.FallbackDelay, dialSerial)
+}
+
+// dialHappyEyeballs races the primary and fallback addresses, giving the
+// primaries a head start of `delay`, following the approach of Go's net package.
+func dialHappyEyeballs(ctx context.Context, primaries, fallbacks []egressAddr, delay time.Duration,
+	dialSerial func(context.Context, []egressAddr) (net.Conn, error)) (net.Conn, error) {
+	if delay == 0 {
+		delay = 300 * time.Millisecond
+	}
+	returned := make(chan struct{})
+	defer close(returned)
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan dialResult)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := func(addrs []egressAddr, primary bool) {
+		conn, err := dialSerial(ctx, addrs)
+		select {
+		case results <- dialResult{conn, err, primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+	go start(primaries, true)
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	fallbackStarted := false
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				go start(fallbacks, false)
+			}
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if primaryErr != nil && fallbackErr != nil {
+				return nil, primaryErr
+			}
+			if res.primary && !fallbackStarted {
+				// Start the fallback immediately if the primaries failed.
+				fallbackStarted = true
+				go start(fallbacks, false)
+			}
+		}
+	}
+}
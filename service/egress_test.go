@@ -0,0 +1,102 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIPFamily(t *testing.T) {
+	family, err := ParseIPFamily("ipv6_only")
+	require.NoError(t, err)
+	assert.Equal(t, IPFamilyIPv6Only, family)
+	_, err = ParseIPFamily("ipv5_only")
+	assert.Error(t, err)
+}
+
+func TestEgressPolicyValidate(t *testing.T) {
+	prefix, err := onet.ParseNAT64Prefix("64:ff9b::/96")
+	require.NoError(t, err)
+	assert.NoError(t, (&EgressPolicy{Family: IPFamilyIPv6Only, NAT64Prefix: prefix}).Validate())
+	assert.Error(t, (&EgressPolicy{Family: IPFamilyPreferIPv6, NAT64Prefix: prefix}).Validate())
+}
+
+func TestEgressIPv4Only(t *testing.T) {
+	p := &EgressPolicy{Family: IPFamilyIPv4Only}
+	_, _, err := p.resolve(context.Background(), "2001:db8::1")
+	assert.Error(t, err, "IPv6 target should be rejected")
+	primaries, fallbacks, err := p.resolve(context.Background(), "192.0.2.1")
+	require.NoError(t, err)
+	assert.Len(t, primaries, 1)
+	assert.Empty(t, fallbacks)
+}
+
+func TestEgressNAT64(t *testing.T) {
+	prefix, _ := onet.ParseNAT64Prefix("64:ff9b::/96")
+	p := &EgressPolicy{Family: IPFamilyIPv6Only, NAT64Prefix: prefix}
+	var validated []net.IP
+	validator := func(ip net.IP) *onet.ConnectionError {
+		validated = append(validated, ip)
+		return onet.RequirePublicIP(ip)
+	}
+
+	udpAddr, connErr := p.resolveUDP("8.8.8.8:53", validator)
+	require.Nil(t, connErr)
+	assert.Equal(t, net.ParseIP("64:ff9b::808:808"), udpAddr.IP)
+	assert.Equal(t, 53, udpAddr.Port)
+	require.Len(t, validated, 2)
+	assert.True(t, validated[1].Equal(udpAddr.IP), "Synthesized address was not validated")
+
+	// Private IPv4 addresses must not be reachable through the NAT64 gateway.
+	_, connErr = p.resolveUDP("192.168.0.1:53", validator)
+	require.NotNil(t, connErr)
+	assert.Equal(t, "ERR_ADDRESS_PRIVATE", connErr.Status)
+}
+
+func TestEgressDialIPv4Only(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	p := &EgressPolicy{Family: IPFamilyIPv4Only}
+	conn, connErr := p.dialTCP(context.Background(), listener.Addr().String(), allowAll, TCPTimeouts{}, nil)
+	require.Nil(t, connErr)
+	conn.Close()
+
+	p = &EgressPolicy{Family: IPFamilyIPv6Only}
+	_, connErr = p.dialTCP(context.Background(), listener.Addr().String(), allowAll, TCPTimeouts{}, nil)
+	require.NotNil(t, connErr)
+	assert.Equal(t, "ERR_CONNECT", connErr.Status)
+}
+
+func TestEgressDialRejected(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	defer listener.Close()
+	p := &EgressPolicy{Family: IPFamilyPreferIPv6}
+	_, connErr := p.dialTCP(context.Background(), listener.Addr().String(), onet.RequirePublicIP, TCPTimeouts{}, nil)
+	require.NotNil(t, connErr)
+	assert.Equal(t, "ERR_ADDRESS_INVALID", connErr.Status)
+}
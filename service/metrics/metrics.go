@@ -19,6 +19,7 @@ import (
 	"io"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
@@ -36,13 +37,42 @@ type ShadowsocksMetrics interface {
 	// TCP metrics
 	AddOpenTCPConnection(clientIp, accessKey string)
 	AddClosedTCPConnection(clientIp, accessKey, status string, data ProxyMetrics, timeToCipher, duration time.Duration)
-	AddTCPProbe(status, drainResult string, port int, data ProxyMetrics)
+	AddTCPProbe(status, drainResult, closeStyle string, port int, data ProxyMetrics)
+	// AddTCPFallback reports a connection with `status` that was forwarded to
+	// the fallback service.
+	AddTCPFallback(status string, data ProxyMetrics)
 
 	// UDP metrics
 	AddUDPPacketFromClient(clientIp, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration)
 	AddUDPPacketFromTarget(clientIp, accessKey, status string, targetProxyBytes, proxyClientBytes int)
 	AddUDPNatEntry()
 	RemoveUDPNatEntry()
+	// AddUDPNatEviction reports an entry removed from the NAT table to make
+	// room for a new one.  `limit` is the limit that was reached.
+	AddUDPNatEviction(limit string)
+	// AddUDPPacketDropped reports a packet that was not relayed for `reason`.
+	AddUDPPacketDropped(reason string)
+
+	// AddCipherLookup reports an access key found for a client, and whether the
+	// key was a candidate because it was recently used from the client's IP
+	// address ("client_ip") or network ("prefix"), or not ("none").
+	AddCipherLookup(proto, affinity string)
+
+	// AddReplayCache reports the state of a replay cache, as returned by `stats`,
+	// whenever metrics are collected.  `proto` distinguishes the caches.
+	AddReplayCache(proto string, stats func() ReplayCacheStats)
+	// AddBufferPool reports the memory held by the buffers acquired from a
+	// pool, as returned by `bytesInUse`, whenever metrics are collected.
+	AddBufferPool(pool string, bytesInUse func() int64)
+}
+
+// ReplayCacheStats is a snapshot of the state of a replay cache.
+type ReplayCacheStats struct {
+	Capacity int
+	// Number of entries in the active and archive sets.
+	Active, Archive int
+	// Number of replays detected.
+	Hits uint64
 }
 
 type shadowsocksMetrics struct {
@@ -51,15 +81,90 @@ type shadowsocksMetrics struct {
 	ports          prometheus.Gauge
 	dataBytes      *prometheus.CounterVec
 	timeToCipherMs *prometheus.HistogramVec
+	cipherLookups  *prometheus.CounterVec
 	// TODO: Add time to first byte.
 
 	tcpProbes               *prometheus.HistogramVec
 	tcpOpenConnections      *prometheus.CounterVec
 	tcpClosedConnections    *prometheus.CounterVec
 	tcpConnectionDurationMs *prometheus.HistogramVec
+	tcpFallbackConnections  *prometheus.CounterVec
+	tcpFallbackBytes        *prometheus.CounterVec
 
 	udpAddedNatEntries   prometheus.Counter
 	udpRemovedNatEntries prometheus.Counter
+	udpNatEntries        prometheus.Gauge
+	udpEvictedNatEntries *prometheus.CounterVec
+	udpDroppedPackets    *prometheus.CounterVec
+
+	replayCaches *replayCacheCollector
+	bufferPools  *bufferPoolCollector
+}
+
+// replayCacheCollector reads the replay caches when metrics are collected.
+type replayCacheCollector struct {
+	mu        sync.Mutex
+	stats     map[string]func() ReplayCacheStats
+	capacity  *prometheus.Desc
+	occupancy *prometheus.Desc
+	hits      *prometheus.Desc
+}
+
+func newReplayCacheCollector() *replayCacheCollector {
+	return &replayCacheCollector{
+		stats: make(map[string]func() ReplayCacheStats),
+		capacity: prometheus.NewDesc("shadowsocks_replay_cache_capacity",
+			"Number of salts that each set of the replay cache can hold", []string{"proto"}, nil),
+		occupancy: prometheus.NewDesc("shadowsocks_replay_cache_entries",
+			"Number of salts in the replay cache", []string{"proto", "set"}, nil),
+		hits: prometheus.NewDesc("shadowsocks_replay_cache_hits",
+			"Replays detected by the replay cache", []string{"proto"}, nil),
+	}
+}
+
+func (c *replayCacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.capacity
+	ch <- c.occupancy
+	ch <- c.hits
+}
+
+func (c *replayCacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for proto, getStats := range c.stats {
+		stats := getStats()
+		ch <- prometheus.MustNewConstMetric(c.capacity, prometheus.GaugeValue, float64(stats.Capacity), proto)
+		ch <- prometheus.MustNewConstMetric(c.occupancy, prometheus.GaugeValue, float64(stats.Active), proto, "active")
+		ch <- prometheus.MustNewConstMetric(c.occupancy, prometheus.GaugeValue, float64(stats.Archive), proto, "archive")
+		ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits), proto)
+	}
+}
+
+// bufferPoolCollector reads the buffer pools when metrics are collected.
+type bufferPoolCollector struct {
+	mu         sync.Mutex
+	bytesInUse map[string]func() int64
+	desc       *prometheus.Desc
+}
+
+func newBufferPoolCollector() *bufferPoolCollector {
+	return &bufferPoolCollector{
+		bytesInUse: make(map[string]func() int64),
+		desc: prometheus.NewDesc("shadowsocks_buffer_bytes",
+			"Memory held by the relay buffers that are in use, by pool", []string{"pool"}, nil),
+	}
+}
+
+func (c *bufferPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *bufferPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for pool, bytesInUse := range c.bytesInUse {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(bytesInUse()), pool)
+	}
 }
 
 func newShadowsocksMetrics() *shadowsocksMetrics {
@@ -85,7 +190,7 @@ func newShadowsocksMetrics() *shadowsocksMetrics {
 			Name:      "tcp_probes",
 			Buckets:   []float64{0, 49, 50, 51, 73, 91},
 			Help:      "Histogram of number of bytes from client to proxy, for detecting possible probes",
-		}, []string{"port", "status", "error"}),
+		}, []string{"port", "status", "error", "close"}),
 		tcpOpenConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Namespace: "shadowsocks",
 			Subsystem: "tcp",
@@ -113,6 +218,18 @@ func newShadowsocksMetrics() *shadowsocksMetrics {
 					float64(7 * 24 * time.Hour.Milliseconds()), // Week
 				},
 			}, []string{"status"}),
+		tcpFallbackConnections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "tcp",
+			Name:      "fallback_connections",
+			Help:      "Count of unauthenticated TCP connections forwarded to the fallback service",
+		}, []string{"status"}),
+		tcpFallbackBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "shadowsocks",
+			Subsystem: "tcp",
+			Name:      "fallback_bytes",
+			Help:      "Bytes transferred between unauthenticated clients and the fallback service",
+		}, []string{"dir", "status"}),
 		dataBytes: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: "shadowsocks",
@@ -126,6 +243,12 @@ func newShadowsocksMetrics() *shadowsocksMetrics {
 				Help:      "Time needed to find the cipher",
 				Buckets:   []float64{0.1, 1, 10, 100, 1000},
 			}, []string{"proto", "found_key"}),
+		cipherLookups: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Name:      "cipher_lookups",
+				Help:      "Access keys found, by whether the client's IP address or network recently used the key",
+			}, []string{"proto", "affinity"}),
 		udpAddedNatEntries: prometheus.NewCounter(
 			prometheus.CounterOpts{
 				Namespace: "shadowsocks",
@@ -140,6 +263,29 @@ func newShadowsocksMetrics() *shadowsocksMetrics {
 				Name:      "nat_entries_removed",
 				Help:      "Entries removed from the UDP NAT table",
 			}),
+		udpNatEntries: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "nat_entries",
+				Help:      "Current number of entries in the UDP NAT table",
+			}),
+		udpEvictedNatEntries: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "nat_entries_evicted",
+				Help:      "Entries evicted from the UDP NAT table because a limit was reached",
+			}, []string{"limit"}),
+		udpDroppedPackets: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "shadowsocks",
+				Subsystem: "udp",
+				Name:      "packets_dropped",
+				Help:      "UDP packets that were not relayed, by reason",
+			}, []string{"reason"}),
+		replayCaches: newReplayCacheCollector(),
+		bufferPools:  newBufferPoolCollector(),
 	}
 }
 
@@ -148,7 +294,8 @@ func NewPrometheusShadowsocksMetrics(registerer prometheus.Registerer) Shadowsoc
 	m := newShadowsocksMetrics()
 	// TODO: Is it possible to pass where to register the collectors?
 	registerer.MustRegister(m.buildInfo, m.accessKeys, m.ports, m.tcpProbes, m.tcpOpenConnections, m.tcpClosedConnections, m.tcpConnectionDurationMs,
-		m.dataBytes, m.timeToCipherMs, m.udpAddedNatEntries, m.udpRemovedNatEntries)
+		m.tcpFallbackConnections, m.tcpFallbackBytes,
+		m.dataBytes, m.timeToCipherMs, m.cipherLookups, m.udpAddedNatEntries, m.udpRemovedNatEntries, m.udpNatEntries, m.udpEvictedNatEntries, m.udpDroppedPackets, m.replayCaches, m.bufferPools)
 	return m
 }
 
@@ -192,8 +339,16 @@ func (m *shadowsocksMetrics) AddClosedTCPConnection(clientIp, accessKey, status
 	addIfNonZero(data.ProxyClient, m.dataBytes, "c<p", "tcp", accessKey, clientIp)
 }
 
-func (m *shadowsocksMetrics) AddTCPProbe(status, drainResult string, port int, data ProxyMetrics) {
-	m.tcpProbes.WithLabelValues(strconv.Itoa(port), status, drainResult).Observe(float64(data.ClientProxy))
+func (m *shadowsocksMetrics) AddTCPProbe(status, drainResult, closeStyle string, port int, data ProxyMetrics) {
+	m.tcpProbes.WithLabelValues(strconv.Itoa(port), status, drainResult, closeStyle).Observe(float64(data.ClientProxy))
+}
+
+func (m *shadowsocksMetrics) AddTCPFallback(status string, data ProxyMetrics) {
+	m.tcpFallbackConnections.WithLabelValues(status).Inc()
+	addIfNonZero(data.ClientProxy, m.tcpFallbackBytes, "c>p", status)
+	addIfNonZero(data.ProxyTarget, m.tcpFallbackBytes, "p>t", status)
+	addIfNonZero(data.TargetProxy, m.tcpFallbackBytes, "p<t", status)
+	addIfNonZero(data.ProxyClient, m.tcpFallbackBytes, "c<p", status)
 }
 
 func (m *shadowsocksMetrics) AddUDPPacketFromClient(clientIp, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
@@ -209,10 +364,36 @@ func (m *shadowsocksMetrics) AddUDPPacketFromTarget(clientIp, accessKey, status
 
 func (m *shadowsocksMetrics) AddUDPNatEntry() {
 	m.udpAddedNatEntries.Inc()
+	m.udpNatEntries.Inc()
 }
 
 func (m *shadowsocksMetrics) RemoveUDPNatEntry() {
 	m.udpRemovedNatEntries.Inc()
+	m.udpNatEntries.Dec()
+}
+
+func (m *shadowsocksMetrics) AddUDPNatEviction(limit string) {
+	m.udpEvictedNatEntries.WithLabelValues(limit).Inc()
+}
+
+func (m *shadowsocksMetrics) AddUDPPacketDropped(reason string) {
+	m.udpDroppedPackets.WithLabelValues(reason).Inc()
+}
+
+func (m *shadowsocksMetrics) AddCipherLookup(proto, affinity string) {
+	m.cipherLookups.WithLabelValues(proto, affinity).Inc()
+}
+
+func (m *shadowsocksMetrics) AddReplayCache(proto string, stats func() ReplayCacheStats) {
+	m.replayCaches.mu.Lock()
+	defer m.replayCaches.mu.Unlock()
+	m.replayCaches.stats[proto] = stats
+}
+
+func (m *shadowsocksMetrics) AddBufferPool(pool string, bytesInUse func() int64) {
+	m.bufferPools.mu.Lock()
+	defer m.bufferPools.mu.Unlock()
+	m.bufferPools.bytesInUse[pool] = bytesInUse
 }
 
 type ProxyMetrics struct {
@@ -249,6 +430,16 @@ func (c *measuredConn) WriteTo(w io.Writer) (int64, error) {
 	return n, err
 }
 
+// WaitRead implements shadowsocks.ReadWaiter, if the inner connection does.
+// Otherwise, it returns immediately.
+func (c *measuredConn) WaitRead() error {
+	// The same as shadowsocks.ReadWaiter, which this package doesn't import.
+	if waiter, ok := c.DuplexConn.(interface{ WaitRead() error }); ok {
+		return waiter.WaitRead()
+	}
+	return nil
+}
+
 func (c *measuredConn) Write(b []byte) (int, error) {
 	n, err := c.DuplexConn.Write(b)
 	*c.writeCount += int64(n)
@@ -270,8 +461,9 @@ func MeasureConn(conn onet.DuplexConn, bytesSent, bytesReceived *int64) onet.Dup
 type NoOpMetrics struct{}
 
 func (m *NoOpMetrics) SetBuildInfo(version string) {}
-func (m *NoOpMetrics) AddTCPProbe(status, drainResult string, port int, data ProxyMetrics) {
+func (m *NoOpMetrics) AddTCPProbe(status, drainResult, closeStyle string, port int, data ProxyMetrics) {
 }
+func (m *NoOpMetrics) AddTCPFallback(status string, data ProxyMetrics) {}
 func (m *NoOpMetrics) AddClosedTCPConnection(clientIp, accessKey, status string, data ProxyMetrics, timeToCipher, duration time.Duration) {
 }
 func (m *NoOpMetrics) GetIpAddress(net.Addr) string {
@@ -283,5 +475,10 @@ func (m *NoOpMetrics) AddUDPPacketFromClient(clientIp, accessKey, status string,
 }
 func (m *NoOpMetrics) AddUDPPacketFromTarget(clientIp, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
 }
-func (m *NoOpMetrics) AddUDPNatEntry()    {}
-func (m *NoOpMetrics) RemoveUDPNatEntry() {}
+func (m *NoOpMetrics) AddUDPNatEntry()                                            {}
+func (m *NoOpMetrics) RemoveUDPNatEntry()                                         {}
+func (m *NoOpMetrics) AddUDPNatEviction(limit string)                             {}
+func (m *NoOpMetrics) AddUDPPacketDropped(reason string)                          {}
+func (m *NoOpMetrics) AddCipherLookup(proto, affinity string)                     {}
+func (m *NoOpMetrics) AddReplayCache(proto string, stats func() ReplayCacheStats) {}
+func (m *NoOpMetrics) AddBufferPool(pool string, bytesInUse func() int64)         {}
@@ -18,7 +18,7 @@ func TestMethodsDontPanic(t *testing.T) {
 	ssMetrics.SetNumAccessKeys(20, 2)
 	ssMetrics.AddOpenTCPConnection("127.0.0.1")
 	ssMetrics.AddClosedTCPConnection("127.0.0.1", "1", "OK", proxyMetrics, 10*time.Millisecond, 100*time.Millisecond)
-	ssMetrics.AddTCPProbe("ERR_CIPHER", "eof", 443, proxyMetrics)
+	ssMetrics.AddTCPProbe("ERR_CIPHER", "eof", "fin", 443, proxyMetrics)
 	ssMetrics.AddUDPPacketFromClient("127.0.0.1", "2", "OK", 10, 20, 10*time.Millisecond)
 	ssMetrics.AddUDPPacketFromTarget("127.0.0.1", "3", "OK", 10, 20)
 	ssMetrics.AddUDPNatEntry()
@@ -55,7 +55,7 @@ func BenchmarkProbe(b *testing.B) {
 	data := ProxyMetrics{}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		ssMetrics.AddTCPProbe(status, drainResult, port, data)
+		ssMetrics.AddTCPProbe(status, drainResult, "fin", port, data)
 	}
 }
 
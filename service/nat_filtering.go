@@ -0,0 +1,136 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// NATFiltering selects which inbound packets on a NAT entry are relayed to
+// the client, as defined in RFC 4787 Section 5.
+type NATFiltering int
+
+const (
+	// EndpointIndependentFiltering relays packets from any source (full cone).
+	EndpointIndependentFiltering NATFiltering = iota
+	// AddressDependentFiltering relays packets only from IP addresses that the
+	// client has sent to (address-restricted cone).
+	AddressDependentFiltering
+	// AddressAndPortDependentFiltering relays packets only from IP addresses
+	// and ports that the client has sent to (port-restricted cone).
+	AddressAndPortDependentFiltering
+)
+
+// ParseNATFiltering parses "endpoint_independent", "address_dependent" or
+// "address_and_port_dependent".  The empty string selects endpoint-independent
+// filtering.
+func ParseNATFiltering(s string) (NATFiltering, error) {
+	switch s {
+	case "", "endpoint_independent":
+		return EndpointIndependentFiltering, nil
+	case "address_dependent":
+		return AddressDependentFiltering, nil
+	case "address_and_port_dependent":
+		return AddressAndPortDependentFiltering, nil
+	default:
+		return 0, fmt.Errorf("Unknown NAT filtering behavior: %s", s)
+	}
+}
+
+func (f NATFiltering) String() string {
+	switch f {
+	case EndpointIndependentFiltering:
+		return "endpoint_independent"
+	case AddressDependentFiltering:
+		return "address_dependent"
+	case AddressAndPortDependentFiltering:
+		return "address_and_port_dependent"
+	default:
+		return fmt.Sprintf("NATFiltering(%d)", int(f))
+	}
+}
+
+// Maximum number of destinations remembered for each NAT entry.  When it is
+// reached, the destination that was least recently sent to is forgotten.
+const maxNATDestinations = 1024
+
+// natFilter remembers the destinations of a NAT entry.  Upstream packets are
+// recorded by the service loop, and downstream packets are checked by the copy
+// loop, so it is safe for concurrent use.
+type natFilter struct {
+	filtering NATFiltering
+	mu        sync.Mutex
+	// Elements of `lru` by destination.
+	destinations map[string]*list.Element
+	// Destinations ordered by last packet sent, most recent first.
+	lru *list.List
+}
+
+func newNATFilter(filtering NATFiltering) *natFilter {
+	if filtering == EndpointIndependentFiltering {
+		return nil
+	}
+	return &natFilter{filtering: filtering, destinations: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (f *natFilter) key(addr net.Addr) string {
+	if f.filtering == AddressAndPortDependentFiltering {
+		return addr.String()
+	}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// onWrite records a destination.  A nil filter does nothing.
+func (f *natFilter) onWrite(addr net.Addr) {
+	if f == nil {
+		return
+	}
+	key := f.key(addr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if elt, ok := f.destinations[key]; ok {
+		f.lru.MoveToFront(elt)
+		return
+	}
+	if f.lru.Len() >= maxNATDestinations {
+		oldest := f.lru.Back()
+		delete(f.destinations, oldest.Value.(string))
+		f.lru.Remove(oldest)
+	}
+	f.destinations[key] = f.lru.PushFront(key)
+}
+
+// allows reports whether a packet from `addr` may be relayed.  A nil filter
+// allows all packets.
+func (f *natFilter) allows(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+	key := f.key(addr)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.destinations[key]
+	return ok
+}
@@ -0,0 +1,77 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseNATFiltering(t *testing.T) {
+	for _, f := range []NATFiltering{EndpointIndependentFiltering, AddressDependentFiltering, AddressAndPortDependentFiltering} {
+		parsed, err := ParseNATFiltering(f.String())
+		require.NoError(t, err)
+		require.Equal(t, f, parsed)
+	}
+	f, err := ParseNATFiltering("")
+	require.NoError(t, err)
+	require.Equal(t, EndpointIndependentFiltering, f)
+	_, err = ParseNATFiltering("symmetric")
+	require.Error(t, err)
+}
+
+func TestNATFilterEndpointIndependent(t *testing.T) {
+	f := newNATFilter(EndpointIndependentFiltering)
+	require.Nil(t, f)
+	f.onWrite(&targetAddr)
+	require.True(t, f.allows(&dnsAddr))
+}
+
+func TestNATFilterAddressDependent(t *testing.T) {
+	f := newNATFilter(AddressDependentFiltering)
+	require.False(t, f.allows(&targetAddr))
+	f.onWrite(&targetAddr)
+	require.True(t, f.allows(&targetAddr))
+	require.True(t, f.allows(&net.UDPAddr{IP: targetAddr.IP, Port: 1}))
+	require.False(t, f.allows(&dnsAddr))
+}
+
+func TestNATFilterAddressAndPortDependent(t *testing.T) {
+	f := newNATFilter(AddressAndPortDependentFiltering)
+	f.onWrite(&targetAddr)
+	require.True(t, f.allows(&targetAddr))
+	require.False(t, f.allows(&net.UDPAddr{IP: targetAddr.IP, Port: 1}))
+}
+
+func TestNATFilterCapacity(t *testing.T) {
+	f := newNATFilter(AddressAndPortDependentFiltering)
+	first := &net.UDPAddr{IP: targetAddr.IP, Port: 1}
+	second := &net.UDPAddr{IP: targetAddr.IP, Port: 2}
+	f.onWrite(first)
+	f.onWrite(second)
+	for port := 3; port <= maxNATDestinations; port++ {
+		f.onWrite(&net.UDPAddr{IP: targetAddr.IP, Port: port})
+	}
+	// Sending to the first destination again makes the second the oldest.
+	f.onWrite(first)
+	f.onWrite(&net.UDPAddr{IP: targetAddr.IP, Port: maxNATDestinations + 1})
+	require.Len(t, f.destinations, maxNATDestinations)
+	require.Equal(t, maxNATDestinations, f.lru.Len())
+	require.True(t, f.allows(first))
+	require.False(t, f.allows(second))
+	require.True(t, f.allows(&net.UDPAddr{IP: targetAddr.IP, Port: maxNATDestinations + 1}))
+}
@@ -0,0 +1,115 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// NATTimeoutRule sets the NAT timeout after a packet to a matching destination.
+type NATTimeoutRule struct {
+	// Ports matches destination ports.  Empty matches any port.
+	Ports []int
+	// Networks matches destination IP addresses.  Empty matches any address.
+	Networks []*net.IPNet
+	// Timeout is the NAT timeout after sending to a matching destination.
+	// Zero selects the service's default timeout.
+	Timeout time.Duration
+	// FastClose closes the NAT entry after the first response if the client has
+	// only sent one packet, to a destination matching this rule.  This suits
+	// single request protocols like DNS and NTP.
+	FastClose bool
+}
+
+func (r *NATTimeoutRule) matches(addr *net.UDPAddr) bool {
+	if len(r.Ports) > 0 {
+		found := false
+		for _, port := range r.Ports {
+			if port == addr.Port {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(r.Networks) > 0 {
+		for _, network := range r.Networks {
+			if network.Contains(addr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// dnsTimeoutRule shortens the timeout for DNS as required by RFC 5452 Section 10.
+var dnsTimeoutRule = NATTimeoutRule{Ports: []int{53}, Timeout: 17 * time.Second, FastClose: true}
+
+// NATTimeoutPolicy selects the NAT timeout from the destination of each
+// upstream packet.  The first matching rule applies.  Destinations that match
+// no rule use the built-in DNS rule if on port 53, or the default timeout.
+// A NAT entry never expires earlier than the deadline set by a previous packet.
+type NATTimeoutPolicy struct {
+	Rules []NATTimeoutRule
+}
+
+// Validate checks that the rules are well formed.
+func (p *NATTimeoutPolicy) Validate() error {
+	if p == nil {
+		return nil
+	}
+	for _, rule := range p.Rules {
+		if rule.Timeout < 0 {
+			return errors.New("NAT timeout must not be negative")
+		}
+		for _, port := range rule.Ports {
+			if port <= 0 || port > 65535 {
+				return errors.New("Invalid port " + strconv.Itoa(port))
+			}
+		}
+	}
+	return nil
+}
+
+// match returns the rule that applies to `addr`, or nil if the default timeout
+// applies.  A nil policy only has the DNS rule.
+func (p *NATTimeoutPolicy) match(addr net.Addr) *NATTimeoutRule {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		host, portStr, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		port, _ := strconv.Atoi(portStr)
+		udpAddr = &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+	}
+	if p != nil {
+		for i := range p.Rules {
+			if p.Rules[i].matches(udpAddr) {
+				return &p.Rules[i]
+			}
+		}
+	}
+	if dnsTimeoutRule.matches(udpAddr) {
+		return &dnsTimeoutRule
+	}
+	return nil
+}
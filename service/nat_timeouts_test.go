@@ -0,0 +1,63 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNATTimeoutPolicyMatch(t *testing.T) {
+	_, private, _ := net.ParseCIDR("10.0.0.0/8")
+	policy := &NATTimeoutPolicy{Rules: []NATTimeoutRule{
+		{Ports: []int{51820}, Networks: []*net.IPNet{private}, Timeout: time.Hour},
+		{Ports: []int{51820, 51821}, Timeout: time.Minute},
+		{Networks: []*net.IPNet{private}, Timeout: time.Second},
+	}}
+	check := func(ip string, port int, expected time.Duration) {
+		rule := policy.match(&net.UDPAddr{IP: net.ParseIP(ip), Port: port})
+		if expected == 0 {
+			require.Nil(t, rule, "%v:%v", ip, port)
+		} else {
+			require.NotNil(t, rule, "%v:%v", ip, port)
+			require.Equal(t, expected, rule.Timeout, "%v:%v", ip, port)
+		}
+	}
+	check("10.1.2.3", 51820, time.Hour)
+	check("192.0.2.1", 51820, time.Minute)
+	check("192.0.2.1", 51821, time.Minute)
+	check("10.1.2.3", 51822, time.Second)
+	check("192.0.2.1", 51822, 0)
+	// The DNS rule applies unless a configured rule matches first.
+	check("192.0.2.1", 53, 17*time.Second)
+	check("10.1.2.3", 53, time.Second)
+}
+
+func TestNATTimeoutPolicyNil(t *testing.T) {
+	var policy *NATTimeoutPolicy
+	require.NoError(t, policy.Validate())
+	require.Nil(t, policy.match(&targetAddr))
+	require.Equal(t, &dnsTimeoutRule, policy.match(&dnsAddr))
+}
+
+func TestNATTimeoutPolicyValidate(t *testing.T) {
+	require.Error(t, (&NATTimeoutPolicy{Rules: []NATTimeoutRule{{Timeout: -time.Second}}}).Validate())
+	require.Error(t, (&NATTimeoutPolicy{Rules: []NATTimeoutRule{{Ports: []int{0}}}}).Validate())
+	require.Error(t, (&NATTimeoutPolicy{Rules: []NATTimeoutRule{{Ports: []int{65536}}}}).Validate())
+	require.NoError(t, (&NATTimeoutPolicy{Rules: []NATTimeoutRule{{Ports: []int{443}, Timeout: time.Hour}}}).Validate())
+}
@@ -0,0 +1,271 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Prefix lengths used to group probing sources.
+const (
+	probeIPv4PrefixLen = 24
+	probeIPv6PrefixLen = 48
+)
+
+// ProbeRecord describes a connection that failed to authenticate.
+type ProbeRecord struct {
+	Time time.Time `json:"time"`
+	// IP is the address of the client, and Prefix the network containing it.
+	IP     string `json:"ip"`
+	Prefix string `json:"prefix"`
+	Port   int    `json:"port"`
+	// Status is "ERR_CIPHER", "ERR_REPLAY_CLIENT" or "ERR_REPLAY_SERVER".
+	Status string `json:"status"`
+	// Bytes is the number of bytes received from the client.
+	Bytes int64 `json:"bytes"`
+	// Drain is what ended the probe, as in the tcp_probes metric.
+	Drain string `json:"drain"`
+	// Hash is the hex SHA-256 of the first bytes sent by the client, which
+	// identifies repeated probes without storing their content.
+	Hash string `json:"hash"`
+}
+
+// ProbeSource summarizes the probes from one IP address or prefix.
+type ProbeSource struct {
+	Source   string    `json:"source"`
+	Probes   int       `json:"probes"`
+	Bytes    int64     `json:"bytes"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Number of records that can wait to be written.  Records are dropped when
+// the writer falls further behind.
+const probeLogQueueLen = 1024
+
+// ProbeLog keeps the most recent probes in a fixed-size ring, and optionally
+// appends them to a JSONL file.  It is safe for concurrent use.
+// The nil value is a disabled log.
+type ProbeLog struct {
+	mu      sync.Mutex
+	records []ProbeRecord
+	// Index of the next record to overwrite, once `records` is full.
+	next      int
+	capacity  int
+	hashBytes int
+	writer    io.Writer
+	now       func() time.Time
+	// Records waiting to be written by writeRecords, or nil without a writer.
+	queue chan ProbeRecord
+	// Closed when writeRecords returns.
+	written chan struct{}
+	// Whether records are being dropped because the queue is full.
+	dropping bool
+}
+
+// NewProbeLog returns a log that remembers the most recent `capacity` probes,
+// and hashes the first `hashBytes` bytes of each.
+func NewProbeLog(capacity, hashBytes int) *ProbeLog {
+	return &ProbeLog{
+		records:   make([]ProbeRecord, 0, capacity),
+		capacity:  capacity,
+		hashBytes: hashBytes,
+		now:       time.Now,
+	}
+}
+
+// SetWriter sets where each record is written as a line of JSON.  Nil disables
+// writing.  Records are written in the background, so that a slow writer
+// doesn't hold up connections, and are dropped if it falls too far behind.
+// The previous writer is closed as in Close.  Files are not rotated, but can be
+// truncated, since they are expected to be opened with O_APPEND.
+func (l *ProbeLog) SetWriter(w io.Writer) error {
+	err := l.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writer = w
+	if w != nil {
+		l.queue = make(chan ProbeRecord, probeLogQueueLen)
+		l.written = make(chan struct{})
+		go l.writeRecords(w, l.queue, l.written)
+	}
+	return err
+}
+
+// writeRecords writes the records in `queue` to `w` until `queue` is closed.
+func (l *ProbeLog) writeRecords(w io.Writer, queue <-chan ProbeRecord, written chan<- struct{}) {
+	defer close(written)
+	for record := range queue {
+		line, _ := json.Marshal(record)
+		if _, err := w.Write(append(line, '\n')); err != nil {
+			logger.Warningf("Failed to write probe log: %v", err)
+		}
+	}
+}
+
+// Close writes the pending records, and stops writing.  The writer is closed
+// if it is an io.Closer.
+func (l *ProbeLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	writer, queue, written := l.writer, l.queue, l.written
+	l.writer, l.queue, l.written = nil, nil, nil
+	l.mu.Unlock()
+	if queue == nil {
+		return nil
+	}
+	close(queue)
+	<-written
+	if closer, ok := writer.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// HashBytes returns how many bytes of each probe are hashed.
+func (l *ProbeLog) HashBytes() int {
+	if l == nil {
+		return 0
+	}
+	return l.hashBytes
+}
+
+// probePrefix returns the network of `ip` used to group probing sources.
+func probePrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return (&net.IPNet{IP: ip4.Mask(net.CIDRMask(probeIPv4PrefixLen, 32)), Mask: net.CIDRMask(probeIPv4PrefixLen, 32)}).String()
+	}
+	return (&net.IPNet{IP: ip.Mask(net.CIDRMask(probeIPv6PrefixLen, 128)), Mask: net.CIDRMask(probeIPv6PrefixLen, 128)}).String()
+}
+
+// Add records a probe from `clientIP`, whose first bytes were `firstBytes`.
+func (l *ProbeLog) Add(clientIP net.IP, port int, status string, bytes int64, drain string, firstBytes []byte) {
+	if l == nil {
+		return
+	}
+	if len(firstBytes) > l.hashBytes {
+		firstBytes = firstBytes[:l.hashBytes]
+	}
+	hash := sha256.Sum256(firstBytes)
+	record := ProbeRecord{
+		Port:   port,
+		Status: status,
+		Bytes:  bytes,
+		Drain:  drain,
+		Hash:   hex.EncodeToString(hash[:]),
+	}
+	if clientIP != nil {
+		record.IP = clientIP.String()
+		record.Prefix = probePrefix(clientIP)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	record.Time = l.now()
+	if l.capacity > 0 {
+		if len(l.records) < l.capacity {
+			l.records = append(l.records, record)
+		} else {
+			l.records[l.next] = record
+			l.next = (l.next + 1) % l.capacity
+		}
+	}
+	if l.queue != nil {
+		select {
+		case l.queue <- record:
+			l.dropping = false
+		default:
+			if !l.dropping {
+				logger.Warning("Probe log writer is behind.  Dropping records")
+				l.dropping = true
+			}
+		}
+	}
+}
+
+// Top returns up to `limit` sources with the most probes in the last `window`,
+// grouped by IP address, or by prefix if `byPrefix` is set.  Only the probes
+// still in memory are counted, so long windows may be incomplete.
+func (l *ProbeLog) Top(window time.Duration, limit int, byPrefix bool) []ProbeSource {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	since := l.now().Add(-window)
+	sources := make(map[string]*ProbeSource)
+	for _, record := range l.records {
+		if record.Time.Before(since) {
+			continue
+		}
+		key := record.IP
+		if byPrefix {
+			key = record.Prefix
+		}
+		source, ok := sources[key]
+		if !ok {
+			source = &ProbeSource{Source: key}
+			sources[key] = source
+		}
+		source.Probes++
+		source.Bytes += record.Bytes
+		if record.Time.After(source.LastSeen) {
+			source.LastSeen = record.Time
+		}
+	}
+	top := make([]ProbeSource, 0, len(sources))
+	for _, source := range sources {
+		top = append(top, *source)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Probes != top[j].Probes {
+			return top[i].Probes > top[j].Probes
+		}
+		if top[i].Bytes != top[j].Bytes {
+			return top[i].Bytes > top[j].Bytes
+		}
+		return top[i].Source < top[j].Source
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
+
+// prefixRecorder keeps the first bytes read through it, for the probe log.
+type prefixRecorder struct {
+	io.Reader
+	prefix []byte
+	max    int
+}
+
+func (r *prefixRecorder) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if missing := r.max - len(r.prefix); missing > 0 {
+		if missing > n {
+			missing = n
+		}
+		r.prefix = append(r.prefix, b[:missing]...)
+	}
+	return n, err
+}
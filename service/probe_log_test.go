@@ -0,0 +1,188 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeLogRing(t *testing.T) {
+	probeLog := NewProbeLog(3, 4)
+	for i := 0; i < 5; i++ {
+		probeLog.Add(net.IPv4(192, 0, 2, byte(i)), 443, "ERR_CIPHER", int64(i), "timeout", nil)
+	}
+	require.Len(t, probeLog.records, 3)
+	top := probeLog.Top(time.Hour, 0, false)
+	require.Len(t, top, 3)
+	// Sorted by bytes when the counts are equal.
+	require.Equal(t, "192.0.2.4", top[0].Source)
+	require.Equal(t, "192.0.2.3", top[1].Source)
+	require.Equal(t, "192.0.2.2", top[2].Source)
+}
+
+func TestProbeLogTop(t *testing.T) {
+	probeLog := NewProbeLog(100, 4)
+	now := time.Now()
+	probeLog.now = func() time.Time { return now }
+	add := func(ip string) {
+		probeLog.Add(net.ParseIP(ip), 443, "ERR_CIPHER", 50, "eof", nil)
+	}
+	add("192.0.2.1")
+	add("192.0.2.1")
+	add("2001:db8:1:2::1")
+	now = now.Add(2 * time.Hour)
+	add("192.0.2.2")
+	add("192.0.2.3")
+	add("198.51.100.1")
+	add("2001:db8:1:3::1")
+
+	top := probeLog.Top(time.Hour, 0, false)
+	require.Len(t, top, 4)
+	for _, source := range top {
+		require.Equal(t, 1, source.Probes)
+		require.Equal(t, now, source.LastSeen)
+	}
+
+	top = probeLog.Top(time.Hour, 2, true)
+	require.Equal(t, []ProbeSource{
+		{Source: "192.0.2.0/24", Probes: 2, Bytes: 100, LastSeen: now},
+		{Source: "198.51.100.0/24", Probes: 1, Bytes: 50, LastSeen: now},
+	}, top)
+
+	top = probeLog.Top(3*time.Hour, 1, true)
+	require.Equal(t, []ProbeSource{{Source: "192.0.2.0/24", Probes: 4, Bytes: 200, LastSeen: now}}, top)
+	top = probeLog.Top(3*time.Hour, 0, false)
+	require.Equal(t, ProbeSource{Source: "192.0.2.1", Probes: 2, Bytes: 100, LastSeen: now.Add(-2 * time.Hour)}, top[0])
+	top = probeLog.Top(3*time.Hour, 0, true)
+	require.Equal(t, "2001:db8:1::/48", top[1].Source)
+	require.Equal(t, 2, top[1].Probes)
+}
+
+func TestProbeLogWriter(t *testing.T) {
+	probeLog := NewProbeLog(0, 4)
+	var out bytes.Buffer
+	probeLog.SetWriter(&out)
+	probeLog.Add(net.ParseIP("192.0.2.1"), 443, "ERR_REPLAY_CLIENT", 100, "max_bytes", []byte("GET / HTTP/1.1"))
+	probeLog.Add(nil, 8443, "ERR_CIPHER", 0, "eof", nil)
+	// Nothing is kept in memory.
+	require.Empty(t, probeLog.Top(time.Hour, 0, false))
+	require.NoError(t, probeLog.Close())
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	var record ProbeRecord
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &record))
+	hash := sha256.Sum256([]byte("GET "))
+	require.Equal(t, "192.0.2.1", record.IP)
+	require.Equal(t, "192.0.2.0/24", record.Prefix)
+	require.Equal(t, 443, record.Port)
+	require.Equal(t, "ERR_REPLAY_CLIENT", record.Status)
+	require.Equal(t, int64(100), record.Bytes)
+	require.Equal(t, "max_bytes", record.Drain)
+	require.Equal(t, hex.EncodeToString(hash[:]), record.Hash)
+}
+
+// blockingWriter counts the writes that it lets through, and is closed once.
+type blockingWriter struct {
+	unblock chan struct{}
+	writes  int
+	closed  int
+}
+
+func (w *blockingWriter) Write(b []byte) (int, error) {
+	<-w.unblock
+	w.writes++
+	return len(b), nil
+}
+
+func (w *blockingWriter) Close() error {
+	w.closed++
+	return nil
+}
+
+func TestProbeLogWriterBehind(t *testing.T) {
+	probeLog := NewProbeLog(0, 4)
+	w := &blockingWriter{unblock: make(chan struct{})}
+	require.NoError(t, probeLog.SetWriter(w))
+	// The writer takes one record, and the rest wait in the queue or are dropped.
+	for i := 0; i < 2*probeLogQueueLen; i++ {
+		probeLog.Add(net.ParseIP("192.0.2.1"), 443, "ERR_CIPHER", 0, "eof", nil)
+	}
+	close(w.unblock)
+	require.NoError(t, probeLog.Close())
+	require.GreaterOrEqual(t, w.writes, probeLogQueueLen)
+	require.LessOrEqual(t, w.writes, probeLogQueueLen+1)
+	require.Equal(t, 1, w.closed)
+
+	// Records are no longer written after Close.
+	probeLog.Add(nil, 8443, "ERR_CIPHER", 0, "eof", nil)
+	require.NoError(t, probeLog.Close())
+	require.Equal(t, 1, w.closed)
+}
+
+func TestProbeLogNil(t *testing.T) {
+	var probeLog *ProbeLog
+	probeLog.Add(net.ParseIP("192.0.2.1"), 443, "ERR_CIPHER", 0, "eof", nil)
+	require.Nil(t, probeLog.Top(time.Hour, 10, false))
+	require.Equal(t, 0, probeLog.HashBytes())
+	require.NoError(t, probeLog.Close())
+}
+
+func TestPrefixRecorder(t *testing.T) {
+	recorder := &prefixRecorder{Reader: strings.NewReader("abcdefghij"), max: 4}
+	buf := make([]byte, 3)
+	recorder.Read(buf)
+	recorder.Read(buf)
+	require.Equal(t, []byte("abcd"), recorder.prefix)
+	rest, err := ioutil.ReadAll(recorder)
+	require.NoError(t, err)
+	require.Equal(t, []byte("ghij"), rest)
+	require.Equal(t, []byte("abcd"), recorder.prefix)
+}
+
+func TestTCPProbeLog(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	s := NewTCPService(cipherList, nil, &probeTestMetrics{}, 200*time.Millisecond)
+	probeLog := NewProbeLog(10, 64)
+	s.SetProbeLog(probeLog)
+	go s.Serve(listener)
+
+	payload := ss.MakeTestPayload(100)
+	require.NoError(t, probe(listener.Addr().(*net.TCPAddr), payload))
+	s.GracefulStop()
+
+	require.Len(t, probeLog.records, 1)
+	record := probeLog.records[0]
+	hash := sha256.Sum256(payload[:64])
+	require.Equal(t, "127.0.0.1", record.IP)
+	require.Equal(t, listener.Addr().(*net.TCPAddr).Port, record.Port)
+	require.Equal(t, "ERR_CIPHER", record.Status)
+	require.Equal(t, int64(100), record.Bytes)
+	require.Equal(t, "eof", record.Drain)
+	require.Equal(t, hex.EncodeToString(hash[:]), record.Hash)
+}
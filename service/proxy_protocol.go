@@ -0,0 +1,268 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolPolicy controls the PROXY protocol headers that load balancers
+// put at the start of each connection, or UDP packet, to report the address
+// of the client.  See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+//
+// Connections and packets from trusted sources must start with a header, and
+// are served as if they came from the address in the header.  Those from other
+// sources are served as if there was no load balancer, so they can't
+// impersonate other clients.
+type ProxyProtocolPolicy struct {
+	// TrustedNetworks are the sources that send headers.
+	TrustedNetworks []*net.IPNet
+}
+
+// Validate checks that the policy trusts some sources.
+func (p *ProxyProtocolPolicy) Validate() error {
+	if len(p.TrustedNetworks) == 0 {
+		return errors.New("PROXY protocol requires trusted networks")
+	}
+	return nil
+}
+
+// trusts returns whether `addr` must send a header.  `p` may be nil.
+func (p *ProxyProtocolPolicy) trusts(addr net.Addr) bool {
+	if p == nil {
+		return false
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		return false
+	}
+	for _, network := range p.TrustedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const (
+	// The longest v1 header, including the CRLF.
+	maxProxyV1HeaderLen = 107
+	// The length of the fixed part of a v2 header.
+	proxyV2FixedLen = 16
+	// Longer v2 headers are rejected.  The addresses take up to 216 bytes, and
+	// the rest is for TLVs.
+	maxProxyV2HeaderLen = 2048
+)
+
+// errProxyHeaderIncomplete is returned by parseProxyHeader when the header may
+// be valid, but continues after the end of the buffer.
+var errProxyHeaderIncomplete = errors.New("PROXY protocol header is incomplete")
+
+// proxySource is the client address reported by a header.
+type proxySource struct {
+	IP   net.IP
+	Port int
+}
+
+// parseProxyHeader parses the PROXY protocol header at the start of `buf`.  It
+// returns the client address, or nil if the header doesn't report one, and the
+// length of the header.  Version 1 headers are only accepted if `allowV1` is
+// set.
+func parseProxyHeader(buf []byte, allowV1 bool) (*proxySource, int, error) {
+	switch {
+	case hasPrefix(buf, proxyV2Signature):
+		return parseProxyV2Header(buf)
+	case allowV1 && hasPrefix(buf, proxyV1Prefix):
+		return parseProxyV1Header(buf)
+	default:
+		return nil, 0, errors.New("Missing PROXY protocol header")
+	}
+}
+
+// hasPrefix returns whether `buf` starts with `prefix`, or could start with it
+// when more data arrives.
+func hasPrefix(buf, prefix []byte) bool {
+	if len(buf) < len(prefix) {
+		return bytes.Equal(buf, prefix[:len(buf)])
+	}
+	return bytes.HasPrefix(buf, prefix)
+}
+
+// parseProxyV1Header parses a header such as
+// "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n".
+func parseProxyV1Header(buf []byte) (*proxySource, int, error) {
+	end := bytes.Index(buf, []byte("\r\n"))
+	if end < 0 {
+		if len(buf) >= maxProxyV1HeaderLen {
+			return nil, 0, errors.New("PROXY protocol v1 header is too long")
+		}
+		return nil, 0, errProxyHeaderIncomplete
+	}
+	headerLen := end + 2
+	if headerLen > maxProxyV1HeaderLen {
+		return nil, 0, errors.New("PROXY protocol v1 header is too long")
+	}
+	fields := strings.Split(string(buf[len(proxyV1Prefix):end]), " ")
+	if fields[0] == "UNKNOWN" {
+		// The rest of the line is ignored.
+		return nil, headerLen, nil
+	}
+	if len(fields) != 5 || (fields[0] != "TCP4" && fields[0] != "TCP6") {
+		return nil, 0, fmt.Errorf("Invalid PROXY protocol v1 header %q", buf[:end])
+	}
+	ip := net.ParseIP(fields[1])
+	if ip == nil || (ip.To4() != nil) != (fields[0] == "TCP4") {
+		return nil, 0, fmt.Errorf("Invalid source address %q in PROXY protocol header", fields[1])
+	}
+	port, err := strconv.ParseUint(fields[3], 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid source port %q in PROXY protocol header", fields[3])
+	}
+	return &proxySource{IP: ip, Port: int(port)}, headerLen, nil
+}
+
+// parseProxyV2Header parses a binary header.
+func parseProxyV2Header(buf []byte) (*proxySource, int, error) {
+	if len(buf) < proxyV2FixedLen {
+		return nil, 0, errProxyHeaderIncomplete
+	}
+	verCmd, family := buf[12], buf[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, fmt.Errorf("Unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	headerLen := proxyV2FixedLen + int(binary.BigEndian.Uint16(buf[14:16]))
+	if headerLen > maxProxyV2HeaderLen {
+		return nil, 0, errors.New("PROXY protocol v2 header is too long")
+	}
+	if len(buf) < headerLen {
+		return nil, 0, errProxyHeaderIncomplete
+	}
+	addrs := buf[proxyV2FixedLen:headerLen]
+	switch verCmd & 0xf {
+	case 0:
+		// LOCAL: the connection was made by the load balancer itself, e.g. for
+		// health checks.
+		return nil, headerLen, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, 0, fmt.Errorf("Unsupported PROXY protocol command %d", verCmd&0xf)
+	}
+	switch family >> 4 {
+	case 1: // AF_INET
+		if len(addrs) < 12 {
+			return nil, 0, errors.New("PROXY protocol header is too short for IPv4 addresses")
+		}
+		ip := make(net.IP, net.IPv4len)
+		copy(ip, addrs[:4])
+		return &proxySource{IP: ip, Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, headerLen, nil
+	case 2: // AF_INET6
+		if len(addrs) < 36 {
+			return nil, 0, errors.New("PROXY protocol header is too short for IPv6 addresses")
+		}
+		ip := make(net.IP, net.IPv6len)
+		copy(ip, addrs[:16])
+		return &proxySource{IP: ip, Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, headerLen, nil
+	default:
+		// Unspecified or Unix addresses don't identify a client.
+		return nil, headerLen, nil
+	}
+}
+
+// proxiedConn is a connection from a load balancer, after its PROXY protocol
+// header.  RemoteAddr returns the client address from the header.
+type proxiedConn struct {
+	*net.TCPConn
+	remoteAddr net.Addr
+	// Data that was read after the header.
+	leftover []byte
+}
+
+// readProxyHeader reads the header at the start of `conn`, and returns a
+// connection that yields the data after it.
+func readProxyHeader(conn *net.TCPConn) (*proxiedConn, error) {
+	buf := make([]byte, 0, 256)
+	for {
+		if len(buf) == cap(buf) {
+			// Only v2 headers with many TLVs are this long.
+			buf = append(make([]byte, 0, maxProxyV2HeaderLen), buf...)
+		}
+		n, readErr := conn.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		src, headerLen, err := parseProxyHeader(buf, true)
+		if err == nil {
+			proxied := &proxiedConn{TCPConn: conn, remoteAddr: conn.RemoteAddr()}
+			if src != nil {
+				proxied.remoteAddr = &net.TCPAddr{IP: src.IP, Port: src.Port}
+			}
+			if headerLen < len(buf) {
+				proxied.leftover = buf[headerLen:]
+			}
+			return proxied, nil
+		}
+		if err != errProxyHeaderIncomplete {
+			return nil, err
+		}
+		if readErr == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		} else if readErr != nil {
+			return nil, readErr
+		}
+	}
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if len(c.leftover) == 0 {
+		return c.TCPConn.Read(b)
+	}
+	n := copy(b, c.leftover)
+	c.leftover = c.leftover[n:]
+	return n, nil
+}
+
+func (c *proxiedConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	if len(c.leftover) > 0 {
+		n, err := w.Write(c.leftover)
+		written += int64(n)
+		c.leftover = c.leftover[n:]
+		if err != nil {
+			return written, err
+		}
+	}
+	n, err := io.Copy(w, c.TCPConn)
+	return written + n, err
+}
@@ -0,0 +1,320 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+// makeProxyV2Header returns a v2 PROXY header for a connection from `ip`:`port`,
+// followed by a TLV of `tlvLen` bytes.
+func makeProxyV2Header(ip net.IP, port int, tlvLen int) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	var addrs []byte
+	if ip4 := ip.To4(); ip4 != nil {
+		header = append(header, 0x21, 0x11)
+		addrs = append(append(addrs, ip4...), 192, 0, 2, 1)
+	} else {
+		header = append(header, 0x21, 0x21)
+		addrs = append(append(addrs, ip...), net.ParseIP("2001:db8::1")...)
+	}
+	addrs = binary.BigEndian.AppendUint16(addrs, uint16(port))
+	addrs = binary.BigEndian.AppendUint16(addrs, 443)
+	if tlvLen > 0 {
+		addrs = append(addrs, 0xEE)
+		addrs = binary.BigEndian.AppendUint16(addrs, uint16(tlvLen))
+		addrs = append(addrs, make([]byte, tlvLen)...)
+	}
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addrs)))
+	return append(header, addrs...)
+}
+
+func TestParseProxyHeaderV1(t *testing.T) {
+	src, n, err := parseProxyHeader([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\nDATA"), true)
+	require.NoError(t, err)
+	require.Equal(t, 44, n)
+	require.Equal(t, "203.0.113.7", src.IP.String())
+	require.Equal(t, 56324, src.Port)
+
+	src, _, err = parseProxyHeader([]byte("PROXY TCP6 2001:db8::7 2001:db8::1 56324 443\r\n"), true)
+	require.NoError(t, err)
+	require.Equal(t, "2001:db8::7", src.IP.String())
+
+	src, n, err = parseProxyHeader([]byte("PROXY UNKNOWN ignored\r\n"), true)
+	require.NoError(t, err)
+	require.Nil(t, src)
+	require.Equal(t, 23, n)
+
+	_, _, err = parseProxyHeader([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56"), true)
+	require.Equal(t, errProxyHeaderIncomplete, err)
+	_, _, err = parseProxyHeader([]byte("PRO"), true)
+	require.Equal(t, errProxyHeaderIncomplete, err)
+
+	for _, header := range []string{
+		"PROXY TCP4 2001:db8::7 192.0.2.1 56324 443\r\n",
+		"PROXY TCP4 203.0.113.7 192.0.2.1 99999 443\r\n",
+		"PROXY TCP4 203.0.113.7\r\n",
+		"PROXY UDP4 203.0.113.7 192.0.2.1 56324 443\r\n",
+		"GET / HTTP/1.1\r\n",
+	} {
+		_, _, err = parseProxyHeader([]byte(header), true)
+		require.Error(t, err, header)
+		require.NotEqual(t, errProxyHeaderIncomplete, err, header)
+	}
+
+	// v1 is not allowed for UDP.
+	_, _, err = parseProxyHeader([]byte("PROXY TCP4 203.0.113.7 192.0.2.1 56324 443\r\n"), false)
+	require.Error(t, err)
+}
+
+func TestParseProxyHeaderV2(t *testing.T) {
+	header := makeProxyV2Header(net.ParseIP("203.0.113.7"), 56324, 0)
+	src, n, err := parseProxyHeader(append(header, "DATA"...), false)
+	require.NoError(t, err)
+	require.Equal(t, len(header), n)
+	require.Equal(t, "203.0.113.7", src.IP.String())
+	require.Equal(t, 56324, src.Port)
+
+	header = makeProxyV2Header(net.ParseIP("2001:db8::7"), 1234, 20)
+	src, n, err = parseProxyHeader(header, false)
+	require.NoError(t, err)
+	require.Equal(t, len(header), n)
+	require.Equal(t, "2001:db8::7", src.IP.String())
+	require.Equal(t, 1234, src.Port)
+
+	for i := 0; i < len(header); i++ {
+		_, _, err = parseProxyHeader(header[:i], false)
+		require.Equal(t, errProxyHeaderIncomplete, err, i)
+	}
+
+	local := append(append([]byte{}, proxyV2Signature...), 0x20, 0x00, 0, 0)
+	src, n, err = parseProxyHeader(local, false)
+	require.NoError(t, err)
+	require.Nil(t, src)
+	require.Equal(t, 16, n)
+
+	badVersion := append([]byte{}, header...)
+	badVersion[12] = 0x11
+	_, _, err = parseProxyHeader(badVersion, false)
+	require.Error(t, err)
+
+	tooLong := makeProxyV2Header(net.ParseIP("203.0.113.7"), 56324, maxProxyV2HeaderLen)
+	_, _, err = parseProxyHeader(tooLong, false)
+	require.Error(t, err)
+	require.NotEqual(t, errProxyHeaderIncomplete, err)
+}
+
+func TestProxyProtocolPolicyTrusts(t *testing.T) {
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	policy := &ProxyProtocolPolicy{TrustedNetworks: []*net.IPNet{network}}
+	require.NoError(t, policy.Validate())
+	require.True(t, policy.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	require.True(t, policy.trusts(&net.UDPAddr{IP: net.ParseIP("10.1.2.3")}))
+	require.False(t, policy.trusts(&net.TCPAddr{IP: net.ParseIP("192.0.2.1")}))
+	var nilPolicy *ProxyProtocolPolicy
+	require.False(t, nilPolicy.trusts(&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}))
+	require.Error(t, (&ProxyProtocolPolicy{}).Validate())
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	defer listener.Close()
+	clientConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer clientConn.Close()
+	serverConn, err := listener.AcceptTCP()
+	require.NoError(t, err)
+	defer serverConn.Close()
+
+	// The header arrives in two segments, and is followed by data.
+	header := makeProxyV2Header(net.ParseIP("203.0.113.7"), 56324, 300)
+	go func() {
+		clientConn.Write(header[:10])
+		time.Sleep(10 * time.Millisecond)
+		clientConn.Write(append(header[10:], "DATA"...))
+		clientConn.CloseWrite()
+	}()
+	proxied, err := readProxyHeader(serverConn)
+	require.NoError(t, err)
+	require.Equal(t, "203.0.113.7:56324", proxied.RemoteAddr().String())
+	data, err := ioutil.ReadAll(proxied)
+	require.NoError(t, err)
+	require.Equal(t, "DATA", string(data))
+}
+
+// Connections from trusted sources without a header are closed.
+func TestTCPProxyProtocolMissingHeader(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 5*time.Second)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.SetProxyProtocol(&ProxyProtocolPolicy{TrustedNetworks: []*net.IPNet{loopback}})
+	go s.Serve(listener)
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	ssw := ss.NewShadowsocksWriter(conn, firstCipher(cipherList))
+	_, err = ssw.Write(socks.ParseAddr("192.0.2.1:443"))
+	require.NoError(t, err)
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+	s.GracefulStop()
+
+	require.Equal(t, []string{"ERR_PROXY_PROTOCOL"}, testMetrics.closeStatus)
+	require.Empty(t, testMetrics.probeStatus)
+}
+
+// udpAddrMetrics reports the client address in place of its location.
+type udpAddrMetrics struct {
+	natTestMetrics
+}
+
+func (m *udpAddrMetrics) GetIpAddress(addr net.Addr) string {
+	return addr.String()
+}
+
+func TestUDPProxyProtocol(t *testing.T) {
+	ciphers, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	cipher := firstCipher(ciphers)
+	balancerConn := makeLocalhostPacketConn(t)
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	echoConn := makeLocalhostPacketConn(t)
+	go func() {
+		buf := make([]byte, serverUDPBufferSize)
+		for {
+			n, addr, err := echoConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	testMetrics := &udpAddrMetrics{}
+	s := NewUDPService(timeout, ciphers, testMetrics)
+	s.SetTargetIPValidator(allowAll)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.SetProxyProtocol(&ProxyProtocolPolicy{TrustedNetworks: []*net.IPNet{loopback}})
+	go s.Serve(proxyConn)
+	defer s.GracefulStop()
+
+	targetAddr := socks.ParseAddr(echoConn.LocalAddr().String())
+	plaintext := append(append([]byte{}, targetAddr...), "ping"...)
+	pkt, err := ss.Pack(make([]byte, serverUDPBufferSize), plaintext, cipher)
+	require.NoError(t, err)
+	// Packets without a header are dropped.
+	_, err = balancerConn.WriteTo(pkt, proxyConn.LocalAddr())
+	require.NoError(t, err)
+	header := makeProxyV2Header(net.ParseIP("203.0.113.7"), 56324, 0)
+	_, err = balancerConn.WriteTo(append(header, pkt...), proxyConn.LocalAddr())
+	require.NoError(t, err)
+
+	// The response goes to the load balancer, without a header.
+	balancerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, serverUDPBufferSize)
+	n, _, err := balancerConn.ReadFrom(buf)
+	require.NoError(t, err)
+	response, err := ss.Unpack(nil, buf[:n], cipher)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(response[len(targetAddr):]))
+
+	// The packet is reported after it is sent.
+	require.Eventually(t, func() bool {
+		testMetrics.mu.Lock()
+		defer testMetrics.mu.Unlock()
+		return len(testMetrics.upstreamPackets) == 2
+	}, time.Second, 10*time.Millisecond)
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Equal(t, "ERR_PROXY_PROTOCOL", testMetrics.upstreamPackets[0].status)
+	require.Equal(t, "OK", testMetrics.upstreamPackets[1].status)
+	require.Equal(t, "203.0.113.7:56324", testMetrics.upstreamPackets[1].clientIp)
+	require.Equal(t, len(pkt), testMetrics.upstreamPackets[1].clientProxyBytes)
+}
+
+// Clients that the load balancer sends from the same address have their own
+// NAT entries.
+func TestUDPProxyProtocolSharedAddress(t *testing.T) {
+	secrets := ss.MakeTestSecrets(2)
+	ciphers, err := MakeTestCiphers(secrets)
+	require.NoError(t, err)
+	balancerConn := makeLocalhostPacketConn(t)
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	echoConn := makeLocalhostPacketConn(t)
+	go func() {
+		buf := make([]byte, serverUDPBufferSize)
+		for {
+			n, addr, err := echoConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	testMetrics := &udpAddrMetrics{}
+	s := NewUDPService(timeout, ciphers, testMetrics)
+	s.SetTargetIPValidator(allowAll)
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	s.SetProxyProtocol(&ProxyProtocolPolicy{TrustedNetworks: []*net.IPNet{loopback}})
+	go s.Serve(proxyConn)
+	defer s.GracefulStop()
+
+	targetAddr := socks.ParseAddr(echoConn.LocalAddr().String())
+	for i, secret := range secrets {
+		cipher, err := ss.NewCipher(ss.TestCipher, secret)
+		require.NoError(t, err)
+		plaintext := append(append([]byte{}, targetAddr...), "ping"...)
+		pkt, err := ss.Pack(make([]byte, serverUDPBufferSize), plaintext, cipher)
+		require.NoError(t, err)
+		header := makeProxyV2Header(net.IPv4(203, 0, 113, byte(7+i)), 56324, 0)
+		_, err = balancerConn.WriteTo(append(header, pkt...), proxyConn.LocalAddr())
+		require.NoError(t, err)
+
+		balancerConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, serverUDPBufferSize)
+		n, _, err := balancerConn.ReadFrom(buf)
+		require.NoError(t, err)
+		response, err := ss.Unpack(nil, buf[:n], cipher)
+		require.NoError(t, err)
+		require.Equal(t, "ping", string(response[len(targetAddr):]))
+	}
+
+	require.Eventually(t, func() bool {
+		testMetrics.mu.Lock()
+		defer testMetrics.mu.Unlock()
+		return len(testMetrics.upstreamPackets) == 2
+	}, time.Second, 10*time.Millisecond)
+	testMetrics.mu.Lock()
+	defer testMetrics.mu.Unlock()
+	require.Equal(t, "OK", testMetrics.upstreamPackets[0].status)
+	require.Equal(t, "203.0.113.7:56324", testMetrics.upstreamPackets[0].clientIp)
+	require.Equal(t, "OK", testMetrics.upstreamPackets[1].status)
+	require.Equal(t, "203.0.113.8:56324", testMetrics.upstreamPackets[1].clientIp)
+}
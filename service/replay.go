@@ -15,66 +15,126 @@
 package service
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"hash/maphash"
 	"sync"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 )
 
 // MaxCapacity is the largest allowed size of ReplayCache.
 //
-// Capacities in excess of 20,000 are not recommended, due to the false
-// positive rate of up to 2 * capacity / 2^32 = 1 / 100,000.  If larger
-// capacities are desired, the key type should be changed to uint64.
-const MaxCapacity = 20_000
+// Salts are reduced to 64-bit fingerprints, so the false positive rate is at
+// most 2 * capacity / 2^64, which is negligible.  The limit bounds memory use.
+const MaxCapacity = 1_000_000
 
 type empty struct{}
 
 // ReplayCache allows us to check whether a handshake salt was used within
-// the last `capacity` handshakes.  It requires approximately 20*capacity
-// bytes of memory (as measured by BenchmarkReplayCache_Creation).
+// the last `capacity` handshakes, and optionally within some time.  It
+// requires approximately 40*capacity bytes of memory (as measured by
+// BenchmarkReplayCache_Creation).
 //
 // The nil and zero values represent a cache with capacity 0, i.e. no cache.
 type ReplayCache struct {
 	mutex    sync.Mutex
 	capacity int
-	active   map[uint32]empty
-	archive  map[uint32]empty
+	// Entries are forgotten between `expiry` and 2*`expiry` after they were
+	// added.  Zero means they are only forgotten when the capacity is exceeded.
+	expiry time.Duration
+	// Key for the fingerprints.
+	k0, k1  uint64
+	active  map[uint64]empty
+	archive map[uint64]empty
+	// Time when `active` was created.
+	activeStart time.Time
+	// Times of the most recent additions to `active` and `archive`.
+	activeNewest, archiveNewest time.Time
+	hits                        uint64
+	now                         func() time.Time
 }
 
 // NewReplayCache returns a fresh ReplayCache that promises to remember at least
 // the most recent `capacity` handshakes.
 func NewReplayCache(capacity int) ReplayCache {
+	return NewReplayCacheWithExpiry(capacity, 0)
+}
+
+// NewReplayCacheWithExpiry is like NewReplayCache, but also forgets handshakes
+// between `expiry` and 2*`expiry` after they were added, to free memory.
+// Replays older than `expiry` may not be detected.  A capacity above
+// MaxCapacity is reduced to MaxCapacity.
+func NewReplayCacheWithExpiry(capacity int, expiry time.Duration) ReplayCache {
 	if capacity > MaxCapacity {
-		panic("ReplayCache capacity would result in too many false positives")
+		capacity = MaxCapacity
+	} else if capacity < 0 {
+		capacity = 0
 	}
+	k0, k1 := fingerprintKey()
 	return ReplayCache{
 		capacity: capacity,
-		active:   make(map[uint32]empty, capacity),
+		expiry:   expiry,
+		k0:       k0,
+		k1:       k1,
+		active:   make(map[uint64]empty, capacity),
 		// `archive` is read-only and initially empty.
+		now: time.Now,
 	}
 }
 
-// Trivially reduces the key and salt to a uint32, avoiding collisions
-// in case of salts with a shared prefix or suffix.  Salts are normally
-// random, but in principle a client might use a counter instead, so
-// using only the prefix or suffix is not sufficient.  Including the key
-// ID in the hash avoids accidental collisions when the same salt is used
-// by different access keys, as might happen in the case of a counter.
-//
-// Secure hashing is not required, because only authenticated handshakes
-// are added to the cache.  A hostile client could produce colliding salts,
-// but this would not impact other users.  Each map uses a new random hash
-// function, so it is not trivial for a hostile client to mount an
-// algorithmic complexity attack with nearly-colliding hashes:
-// https://dave.cheney.net/2018/05/29/how-the-go-runtime-implements-maps-efficiently-without-generics
-func preHash(id string, salt []byte) uint32 {
-	buf := [4]byte{}
-	for i := 0; i < len(id); i++ {
-		buf[i&0x3] ^= id[i]
+// fingerprintKey returns a random key for the fingerprints.  If the system's
+// random source fails, it falls back to the runtime's random hash seeds, which
+// are still unknown to clients.
+func fingerprintKey() (k0, k1 uint64) {
+	var key [16]byte
+	if _, err := rand.Read(key[:]); err == nil {
+		return binary.LittleEndian.Uint64(key[:8]), binary.LittleEndian.Uint64(key[8:])
+	}
+	logger.Warning("Failed to read a random replay cache key.  Using a weaker one")
+	var h0, h1 maphash.Hash
+	return h0.Sum64(), h1.Sum64()
+}
+
+// fingerprint reduces the key ID and salt to a uint64 with a keyed hash.
+// Including the key ID in the hash avoids accidental collisions when the same
+// salt is used by different access keys, as might happen in the case of a
+// counter.  The hash is keyed, so a hostile client cannot produce colliding
+// salts, or mount an algorithmic complexity attack on the maps.
+func (c *ReplayCache) fingerprint(id string, salt []byte) uint64 {
+	h := newSipHash(c.k0, c.k1)
+	var idLen [4]byte
+	binary.BigEndian.PutUint32(idLen[:], uint32(len(id)))
+	h.write(idLen[:])
+	h.writeString(id)
+	h.write(salt)
+	return h.sum64()
+}
+
+// expire forgets entries that are older than the expiry.  It must be called
+// with the mutex held.
+func (c *ReplayCache) expire(now time.Time) {
+	if c.expiry == 0 {
+		return
 	}
-	for i, v := range salt {
-		buf[i&0x3] ^= v
+	if len(c.archive) > 0 && now.Sub(c.archiveNewest) >= c.expiry {
+		c.archive = nil
 	}
-	return binary.BigEndian.Uint32(buf[:])
+	if len(c.active) > 0 && now.Sub(c.activeNewest) >= c.expiry {
+		c.archive = nil
+		c.active = make(map[uint64]empty, c.capacity)
+		c.activeStart = now
+	}
+}
+
+// rotate discards the archive and moves active to archive.  It must be called
+// with the mutex held.
+func (c *ReplayCache) rotate(now time.Time) {
+	c.archive = c.active
+	c.archiveNewest = c.activeNewest
+	c.active = make(map[uint64]empty, c.capacity)
+	c.activeStart = now
 }
 
 // Add a handshake with this key ID and salt to the cache.
@@ -84,19 +144,54 @@ func (c *ReplayCache) Add(id string, salt []byte) bool {
 		// Cache is disabled, so every salt is new.
 		return true
 	}
-	hash := preHash(id, salt)
+	hash := c.fingerprint(id, salt)
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+	if !c.insert(hash) {
+		c.hits++
+		return false
+	}
+	return true
+}
+
+// insert adds a fingerprint to the cache.  It returns false if it was already
+// present.  It must be called with the mutex held.
+func (c *ReplayCache) insert(hash uint64) bool {
+	var now time.Time
+	if c.expiry > 0 {
+		now = c.now()
+		c.expire(now)
+		if len(c.active) == 0 {
+			c.activeStart = now
+		}
+	}
 	if _, ok := c.active[hash]; ok {
-		// Fast replay: `salt` is already in the active set.
+		// Fast replay: `hash` is already in the active set.
 		return false
 	}
 	_, inArchive := c.archive[hash]
-	if len(c.active) == c.capacity {
-		// Discard the archive and move active to archive.
-		c.archive = c.active
-		c.active = make(map[uint32]empty, c.capacity)
+	if len(c.active) == c.capacity || (c.expiry > 0 && now.Sub(c.activeStart) >= c.expiry) {
+		c.rotate(now)
 	}
 	c.active[hash] = empty{}
+	c.activeNewest = now
 	return !inArchive
 }
+
+// Stats returns the capacity, occupancy and number of replays detected.
+func (c *ReplayCache) Stats() metrics.ReplayCacheStats {
+	if c == nil {
+		return metrics.ReplayCacheStats{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.expiry > 0 && c.capacity > 0 {
+		c.expire(c.now())
+	}
+	return metrics.ReplayCacheStats{
+		Capacity: c.capacity,
+		Active:   len(c.active),
+		Archive:  len(c.archive),
+		Hits:     c.hits,
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// A saved ReplayCache has the layout
+// [magic][header][active...][archive...][checksum]
+// where the integers are big-endian, and the checksum is the SHA-256 of
+// everything before it.  The file includes the fingerprint key, so it must
+// be kept private.
+var replayFileMagic = []byte("ssreplay")
+
+const replayFileVersion = 2
+
+// Upper bound on the number of entries in a file, to avoid huge allocations
+// when reading a corrupt file.
+const maxReplayFileEntries = 2 * MaxCapacity
+
+// ErrReplayFileCorrupt is returned when a saved ReplayCache fails the integrity check.
+var ErrReplayFileCorrupt = errors.New("replay cache file is corrupt")
+
+// ErrReplayFileStale is returned when a saved ReplayCache is too old, or
+// claims to be from the future.
+var ErrReplayFileStale = errors.New("replay cache file is stale")
+
+type replayFileHeader struct {
+	Version   uint8
+	Timestamp int64
+	Capacity  uint32
+	K0, K1    uint64
+	// Times in UnixNano, or zero.
+	ActiveStart, ActiveNewest, ArchiveNewest int64
+	ActiveLen                                uint32
+	ArchiveLen                               uint32
+}
+
+func unixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Save writes the contents of the cache to `w`, with the current time.
+func (c *ReplayCache) Save(w io.Writer) error {
+	c.mutex.Lock()
+	header := replayFileHeader{
+		Version:       replayFileVersion,
+		Timestamp:     time.Now().UnixNano(),
+		Capacity:      uint32(c.capacity),
+		K0:            c.k0,
+		K1:            c.k1,
+		ActiveStart:   unixNano(c.activeStart),
+		ActiveNewest:  unixNano(c.activeNewest),
+		ArchiveNewest: unixNano(c.archiveNewest),
+		ActiveLen:     uint32(len(c.active)),
+		ArchiveLen:    uint32(len(c.archive)),
+	}
+	hashes := make([]uint64, 0, len(c.active)+len(c.archive))
+	for hash := range c.active {
+		hashes = append(hashes, hash)
+	}
+	for hash := range c.archive {
+		hashes = append(hashes, hash)
+	}
+	c.mutex.Unlock()
+
+	checksum := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, checksum))
+	bw.Write(replayFileMagic)
+	binary.Write(bw, binary.BigEndian, header)
+	if err := binary.Write(bw, binary.BigEndian, hashes); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(checksum.Sum(nil))
+	return err
+}
+
+// readSaved reads a cache written by Save, and returns its header and the
+// fingerprints in the active and archive sets.
+func readSaved(r io.Reader) (*replayFileHeader, []uint64, []uint64, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if len(data) < sha256.Size {
+		return nil, nil, nil, ErrReplayFileCorrupt
+	}
+	content, checksum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if sum := sha256.Sum256(content); !bytes.Equal(sum[:], checksum) {
+		return nil, nil, nil, ErrReplayFileCorrupt
+	}
+	if !bytes.HasPrefix(content, replayFileMagic) {
+		return nil, nil, nil, ErrReplayFileCorrupt
+	}
+	reader := bytes.NewReader(content[len(replayFileMagic):])
+	var header replayFileHeader
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return nil, nil, nil, ErrReplayFileCorrupt
+	}
+	if header.Version != replayFileVersion {
+		return nil, nil, nil, fmt.Errorf("Unsupported replay cache file version %d", header.Version)
+	}
+	total := uint64(header.ActiveLen) + uint64(header.ArchiveLen)
+	if total > maxReplayFileEntries || uint64(reader.Len()) != 8*total {
+		return nil, nil, nil, ErrReplayFileCorrupt
+	}
+	hashes := make([]uint64, total)
+	binary.Read(reader, binary.BigEndian, hashes)
+	return &header, hashes[:header.ActiveLen], hashes[header.ActiveLen:], nil
+}
+
+// Load replaces the contents of the cache with a cache saved by Save.  If the
+// saved cache is older than `maxAge`, it returns ErrReplayFileStale and the
+// cache is unchanged.  A zero `maxAge` accepts any age.  If the capacity is
+// smaller than when the cache was saved, some entries are discarded.
+func (c *ReplayCache) Load(r io.Reader, maxAge time.Duration) error {
+	if c == nil || c.capacity == 0 {
+		return nil
+	}
+	header, activeHashes, archiveHashes, err := readSaved(r)
+	if err != nil {
+		return err
+	}
+	age := time.Since(time.Unix(0, header.Timestamp))
+	if age < 0 || (maxAge > 0 && age > maxAge) {
+		return ErrReplayFileStale
+	}
+
+	active := make(map[uint64]empty, c.capacity)
+	var archive map[uint64]empty
+	if len(activeHashes) < c.capacity {
+		for _, hash := range activeHashes {
+			active[hash] = empty{}
+		}
+		if len(archiveHashes) > c.capacity {
+			archiveHashes = archiveHashes[:c.capacity]
+		}
+		archive = make(map[uint64]empty, len(archiveHashes))
+		for _, hash := range archiveHashes {
+			archive[hash] = empty{}
+		}
+	} else {
+		// The order within a set is unknown, so keep an arbitrary subset.
+		archive = make(map[uint64]empty, c.capacity)
+		for _, hash := range activeHashes[:c.capacity] {
+			archive[hash] = empty{}
+		}
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.active, c.archive = active, archive
+	c.k0, c.k1 = header.K0, header.K1
+	c.activeStart = fromUnixNano(header.ActiveStart)
+	c.activeNewest = fromUnixNano(header.ActiveNewest)
+	c.archiveNewest = fromUnixNano(header.ArchiveNewest)
+	if len(activeHashes) >= c.capacity {
+		c.archiveNewest = c.activeNewest
+	}
+	return nil
+}
+
+// Merge adds the entries of a cache saved by Save that this one doesn't have,
+// as if they were added now.  The saved cache must have the same fingerprint key, as when this
+// cache was loaded from an earlier save of the same cache.
+func (c *ReplayCache) Merge(r io.Reader) error {
+	if c == nil || c.capacity == 0 {
+		return nil
+	}
+	header, activeHashes, archiveHashes, err := readSaved(r)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if header.K0 != c.k0 || header.K1 != c.k1 {
+		return errors.New("Saved replay cache has a different key")
+	}
+	// Add the older entries first, so that they are rotated out first.
+	for _, hashes := range [][]uint64{archiveHashes, activeHashes} {
+		for _, hash := range hashes {
+			if _, ok := c.archive[hash]; !ok {
+				c.insert(hash)
+			}
+		}
+	}
+	return nil
+}
+
+// SaveFile writes the cache to `path`.  The file is replaced atomically, so a
+// crash while saving leaves the previous file intact.
+func (c *ReplayCache) SaveFile(path string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := c.Save(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadFile loads the cache from `path`, as in Load.  If the file doesn't exist,
+// the returned error satisfies errors.Is(err, os.ErrNotExist).
+func (c *ReplayCache) LoadFile(path string, maxAge time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Load(f, maxAge)
+}
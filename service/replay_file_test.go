@@ -0,0 +1,149 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayCache_SaveLoad(t *testing.T) {
+	salts := makeSalts(15)
+	cache := NewReplayCache(10)
+	for _, salt := range salts {
+		require.True(t, cache.Add(keyID, salt))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, cache.Save(&buf))
+
+	loaded := NewReplayCache(10)
+	require.NoError(t, loaded.Load(bytes.NewReader(buf.Bytes()), time.Minute))
+	require.Equal(t, cache.active, loaded.active)
+	require.Equal(t, cache.archive, loaded.archive)
+	require.False(t, loaded.Add(keyID, salts[0]))
+	require.True(t, loaded.Add(keyID, makeSalts(1)[0]))
+}
+
+func TestReplayCache_LoadSmallerCapacity(t *testing.T) {
+	cache := NewReplayCache(10)
+	for _, salt := range makeSalts(15) {
+		cache.Add(keyID, salt)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, cache.Save(&buf))
+
+	loaded := NewReplayCache(3)
+	require.NoError(t, loaded.Load(&buf, 0))
+	require.Len(t, loaded.active, 0)
+	require.Len(t, loaded.archive, 3)
+}
+
+func TestReplayCache_LoadCorrupt(t *testing.T) {
+	cache := NewReplayCache(10)
+	for _, salt := range makeSalts(5) {
+		cache.Add(keyID, salt)
+	}
+	var buf bytes.Buffer
+	require.NoError(t, cache.Save(&buf))
+	data := buf.Bytes()
+
+	for _, corrupt := range [][]byte{
+		nil,
+		data[:len(data)-1],
+		append(append([]byte{}, data[:30]...), data[31:]...),
+		append([]byte{0}, data...),
+	} {
+		loaded := NewReplayCache(10)
+		require.True(t, errors.Is(loaded.Load(bytes.NewReader(corrupt), 0), ErrReplayFileCorrupt))
+	}
+	flipped := append([]byte{}, data...)
+	flipped[len(replayFileMagic)+20] ^= 1
+	loaded := NewReplayCache(10)
+	require.Equal(t, ErrReplayFileCorrupt, loaded.Load(bytes.NewReader(flipped), 0))
+	// The cache is unchanged.
+	require.Len(t, loaded.active, 0)
+}
+
+func TestReplayCache_LoadStale(t *testing.T) {
+	cache := NewReplayCache(10)
+	cache.Add(keyID, makeSalts(1)[0])
+	var buf bytes.Buffer
+	require.NoError(t, cache.Save(&buf))
+	time.Sleep(10 * time.Millisecond)
+
+	loaded := NewReplayCache(10)
+	require.Equal(t, ErrReplayFileStale, loaded.Load(bytes.NewReader(buf.Bytes()), time.Millisecond))
+	require.Len(t, loaded.active, 0)
+	require.NoError(t, loaded.Load(bytes.NewReader(buf.Bytes()), time.Hour))
+	require.Len(t, loaded.active, 1)
+}
+
+func TestReplayCache_SaveLoadFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "replay")
+	cache := NewReplayCache(10)
+	require.True(t, errors.Is(cache.LoadFile(path, 0), os.ErrNotExist))
+
+	salt := makeSalts(1)[0]
+	cache.Add(keyID, salt)
+	require.NoError(t, cache.SaveFile(path))
+	// Saving again replaces the file.
+	require.NoError(t, cache.SaveFile(path))
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	loaded := NewReplayCache(10)
+	require.NoError(t, loaded.LoadFile(path, 0))
+	require.False(t, loaded.Add(keyID, salt))
+}
+
+func TestReplayCache_Merge(t *testing.T) {
+	salts := makeSalts(8)
+	cache := NewReplayCache(10)
+	for _, salt := range salts[:4] {
+		require.True(t, cache.Add(keyID, salt))
+	}
+	var buf bytes.Buffer
+	require.NoError(t, cache.Save(&buf))
+	loaded := NewReplayCache(10)
+	require.NoError(t, loaded.Load(&buf, 0))
+
+	// Salts seen by both caches after the first save.
+	for _, salt := range salts[4:6] {
+		require.True(t, cache.Add(keyID, salt))
+	}
+	require.True(t, loaded.Add(keyID, salts[6]))
+	buf.Reset()
+	require.NoError(t, cache.Save(&buf))
+	require.NoError(t, loaded.Merge(&buf))
+	require.Len(t, loaded.active, 7)
+	for _, salt := range salts[:7] {
+		require.False(t, loaded.Add(keyID, salt))
+	}
+	require.True(t, loaded.Add(keyID, salts[7]))
+
+	// Caches with another key can't be merged.
+	other := NewReplayCache(10)
+	buf.Reset()
+	require.NoError(t, other.Save(&buf))
+	require.Error(t, loaded.Merge(&buf))
+}
@@ -17,6 +17,9 @@ package service
 import (
 	"encoding/binary"
 	"testing"
+	"time"
+
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 )
 
 const keyID = "the key"
@@ -91,6 +94,91 @@ func TestReplayCache_Archive(t *testing.T) {
 	}
 }
 
+func TestReplayCache_KeyedFingerprint(t *testing.T) {
+	salt := makeSalts(1)[0]
+	cache1 := NewReplayCache(10)
+	cache2 := NewReplayCache(10)
+	if cache1.fingerprint(keyID, salt) == cache2.fingerprint(keyID, salt) {
+		t.Error("Fingerprints should depend on the cache's key")
+	}
+	if cache1.fingerprint("a", []byte("bc")) == cache1.fingerprint("ab", []byte("c")) {
+		t.Error("Fingerprints should separate the key ID from the salt")
+	}
+}
+
+func TestReplayCache_Expiry(t *testing.T) {
+	salts := makeSalts(3)
+	cache := NewReplayCacheWithExpiry(10, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	if !cache.Add(keyID, salts[0]) {
+		t.Error("Addition of a new vector should succeed")
+	}
+	now = now.Add(30 * time.Second)
+	if cache.Add(keyID, salts[0]) {
+		t.Error("Duplicate add should fail before the expiry")
+	}
+	if !cache.Add(keyID, salts[2]) {
+		t.Error("Addition of a new vector should succeed")
+	}
+	// The active set is older than the expiry, so it moves to the archive.
+	now = now.Add(40 * time.Second)
+	if !cache.Add(keyID, salts[1]) {
+		t.Error("Addition of a new vector should succeed")
+	}
+	if stats := cache.Stats(); stats.Active != 1 || stats.Archive != 2 {
+		t.Errorf("Unexpected occupancy: %+v", stats)
+	}
+	// The newest salt in the archive was added more than a minute ago.
+	now = now.Add(40 * time.Second)
+	if stats := cache.Stats(); stats.Active != 1 || stats.Archive != 0 {
+		t.Errorf("Unexpected occupancy: %+v", stats)
+	}
+	if !cache.Add(keyID, salts[0]) {
+		t.Error("Expired vector should have been forgotten")
+	}
+	// Everything expires on an idle server.
+	now = now.Add(2 * time.Minute)
+	if stats := cache.Stats(); stats.Active != 0 || stats.Archive != 0 {
+		t.Errorf("Unexpected occupancy: %+v", stats)
+	}
+	if !cache.Add(keyID, salts[1]) {
+		t.Error("Expired vector should have been forgotten")
+	}
+}
+
+func TestReplayCache_Stats(t *testing.T) {
+	salts := makeSalts(12)
+	cache := NewReplayCache(10)
+	for _, s := range salts {
+		cache.Add(keyID, s)
+	}
+	cache.Add(keyID, salts[0])
+	cache.Add(keyID, salts[11])
+	stats := cache.Stats()
+	if stats.Capacity != 10 || stats.Active != 3 || stats.Archive != 10 || stats.Hits != 2 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+	var nilCache *ReplayCache
+	if nilCache.Stats() != (metrics.ReplayCacheStats{}) {
+		t.Error("Expected empty stats for a nil cache")
+	}
+}
+
+func TestReplayCache_Capacity(t *testing.T) {
+	if cache := NewReplayCache(MaxCapacity + 1); cache.capacity != MaxCapacity {
+		t.Errorf("Capacity is %d, expected %d", cache.capacity, MaxCapacity)
+	}
+	cache := NewReplayCache(-1)
+	if cache.capacity != 0 {
+		t.Errorf("Capacity is %d, expected 0", cache.capacity)
+	}
+	if !cache.Add(keyID, makeSalts(1)[0]) {
+		t.Error("Cache with no capacity rejected a salt")
+	}
+}
+
 // Benchmark to determine the memory usage of ReplayCache.
 // Note that NewReplayCache only allocates the active set,
 // so the eventual memory usage will be roughly double.
@@ -0,0 +1,76 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+)
+
+// ListenTCPGroup opens `n` TCP listeners on `addr`, with the options of a port,
+// which may be nil.  If `n` is more than one, the listeners share the address
+// with SO_REUSEPORT, and the kernel spreads new connections among them.  This
+// is only supported on Linux.
+func ListenTCPGroup(addr *net.TCPAddr, opts *TCPSocketOptions, n int) ([]*net.TCPListener, error) {
+	if n <= 1 {
+		listener, err := ListenTCP(addr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.TCPListener{listener}, nil
+	}
+	listeners := make([]*net.TCPListener, 0, n)
+	for i := 0; i < n; i++ {
+		listener, err := listenTCP(addr, opts, true)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+		// The rest must use the same port, in case `addr` has port 0.
+		addr = &net.TCPAddr{IP: addr.IP, Port: listener.Addr().(*net.TCPAddr).Port, Zone: addr.Zone}
+	}
+	return listeners, nil
+}
+
+// ListenUDPGroup is like ListenTCPGroup, for UDP sockets.  The kernel sends the
+// packets from each client address to the same socket, as long as the group
+// does not change.
+func ListenUDPGroup(addr *net.UDPAddr, n int) ([]*net.UDPConn, error) {
+	if n <= 1 {
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	conns := make([]*net.UDPConn, 0, n)
+	for i := 0; i < n; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		udpConn := conn.(*net.UDPConn)
+		conns = append(conns, udpConn)
+		addr = &net.UDPAddr{IP: addr.IP, Port: udpConn.LocalAddr().(*net.UDPAddr).Port, Zone: addr.Zone}
+	}
+	return conns, nil
+}
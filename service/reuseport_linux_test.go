@@ -0,0 +1,94 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestListenTCPGroup(t *testing.T) {
+	listeners, err := ListenTCPGroup(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil, 4)
+	require.NoError(t, err)
+	require.Len(t, listeners, 4)
+	port := listeners[0].Addr().(*net.TCPAddr).Port
+	for _, listener := range listeners {
+		defer listener.Close()
+		require.Equal(t, port, listener.Addr().(*net.TCPAddr).Port)
+		require.Equal(t, 1, getsockopt(t, listener, unix.SOL_SOCKET, unix.SO_REUSEPORT))
+	}
+
+	// Every connection is accepted by one of the listeners.
+	accepted := make(chan int)
+	for i, listener := range listeners {
+		go func(i int, listener *net.TCPListener) {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				conn.Close()
+				accepted <- i
+			}
+		}(i, listener)
+	}
+	for i := 0; i < 20; i++ {
+		conn, err := net.DialTCP("tcp", nil, listeners[0].Addr().(*net.TCPAddr))
+		require.NoError(t, err)
+		conn.Close()
+		<-accepted
+	}
+}
+
+func TestListenTCPGroupSingle(t *testing.T) {
+	listeners, err := ListenTCPGroup(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil, 0)
+	require.NoError(t, err)
+	require.Len(t, listeners, 1)
+	defer listeners[0].Close()
+	require.Equal(t, 0, getsockopt(t, listeners[0], unix.SOL_SOCKET, unix.SO_REUSEPORT))
+}
+
+func TestListenUDPGroup(t *testing.T) {
+	conns, err := ListenUDPGroup(&net.UDPAddr{IP: net.ParseIP("127.0.0.1")}, 3)
+	require.NoError(t, err)
+	require.Len(t, conns, 3)
+	port := conns[0].LocalAddr().(*net.UDPAddr).Port
+	received := make(chan string)
+	for _, conn := range conns {
+		defer conn.Close()
+		require.Equal(t, port, conn.LocalAddr().(*net.UDPAddr).Port)
+		require.Equal(t, 1, getsockopt(t, conn, unix.SOL_SOCKET, unix.SO_REUSEPORT))
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, 100)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				received <- string(buf[:n])
+			}
+		}(conn)
+	}
+
+	client, err := net.DialUDP("udp", nil, conns[0].LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", <-received)
+}
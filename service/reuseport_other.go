@@ -0,0 +1,32 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePort = errors.New("Multiple listeners per port are only supported on Linux")
+
+func setReusePort(fd int) error {
+	return errReusePort
+}
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errReusePort
+}
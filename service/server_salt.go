@@ -19,8 +19,10 @@ import (
 	"crypto"
 	"crypto/hmac"
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 
 	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
 	"golang.org/x/crypto/hkdf"
@@ -53,44 +55,124 @@ var RandomServerSaltGenerator ServerSaltGenerator = randomServerSaltGenerator{}
 
 // serverSaltGenerator generates unique salts that are secretly marked.
 type serverSaltGenerator struct {
-	key []byte
+	key     []byte
+	markLen int
+	// Keys from previous marking secrets, which are still recognized until they expire.
+	previous []expiringSaltKey
 }
 
-// serverSaltMarkLen is the number of bytes of salt to use as a marker.
+type expiringSaltKey struct {
+	key    []byte
+	expiry time.Time
+}
+
+// serverSaltMarkLen is the default number of bytes of salt to use as a marker.
 // Increasing this value reduces the false positive rate, but increases
 // the likelihood of salt collisions.
-const serverSaltMarkLen = 4 // Must be less than or equal to SHA1.Size()
+const serverSaltMarkLen = 4
+
+// MaxServerSaltMarkLen is the longest mark that leaves enough entropy in
+// the longest salt.  Shorter salts are not marked if the mark would leave
+// too little entropy.
+const MaxServerSaltMarkLen = 32 - minSaltEntropy // Must be less than or equal to SHA1.Size()
 
 // Constant to identify this marking scheme.
 var serverSaltLabel = []byte("outline-server-salt")
 
-// NewServerSaltGenerator returns a SaltGenerator whose output is apparently
-// random, but is secretly marked as being issued by the server.
-// This is useful to prevent the server from accepting its own output in a
-// reflection attack.
-func NewServerSaltGenerator(secret string) ServerSaltGenerator {
+// SaltMarking configures the marks of server salts, for all access keys.
+type SaltMarking struct {
+	// Secret is combined with each access key's secret to derive the marking
+	// key, so marks can be changed without changing the access keys.  If empty,
+	// marks depend only on the access key.
+	Secret string
+	// Previous holds secrets that were replaced by Secret.  Their marks are still
+	// recognized until they expire.
+	Previous []PreviousSaltSecret
+	// MarkLen is the number of bytes of each salt used as a mark.  Zero means the
+	// default of 4.  Previous secrets are recognized with the same length.
+	MarkLen int
+}
+
+// PreviousSaltSecret is a marking secret that is recognized until Expiry.
+type PreviousSaltSecret struct {
+	Secret string
+	Expiry time.Time
+}
+
+// Validate returns an error if the marking is inconsistent.
+func (m *SaltMarking) Validate() error {
+	if m.MarkLen < 0 || m.MarkLen > MaxServerSaltMarkLen {
+		return fmt.Errorf("Salt mark length must be between 0 (the default) and %d", MaxServerSaltMarkLen)
+	}
+	for _, previous := range m.Previous {
+		if previous.Secret == m.Secret {
+			return errors.New("Previous salt marking secret is the same as the current one")
+		}
+	}
+	return nil
+}
+
+// EffectiveMarkLen returns the mark length, applying the default.  `m` may be nil.
+func (m *SaltMarking) EffectiveMarkLen() int {
+	if m == nil || m.MarkLen == 0 {
+		return serverSaltMarkLen
+	}
+	return m.MarkLen
+}
+
+// deriveSaltKey returns the HMAC key for a Shadowsocks secret and a marking secret.
+func deriveSaltKey(secret, markingSecret string) []byte {
 	// Shadowsocks already uses HKDF-SHA1 to derive the AEAD key, so we use
 	// the same derivation with a different "info" to generate our HMAC key.
-	keySource := hkdf.New(crypto.SHA1.New, []byte(secret), nil, serverSaltLabel)
+	// The marking secret is the HKDF salt, so an empty one gives the same key
+	// as before marking secrets existed.
+	var hkdfSalt []byte
+	if markingSecret != "" {
+		hkdfSalt = []byte(markingSecret)
+	}
+	keySource := hkdf.New(crypto.SHA1.New, []byte(secret), hkdfSalt, serverSaltLabel)
 	// The key can be any size, but matching the block size is most efficient.
 	key := make([]byte, crypto.SHA1.Size())
 	io.ReadFull(keySource, key)
-	return serverSaltGenerator{key}
+	return key
+}
+
+// NewServerSaltGenerator returns a SaltGenerator whose output is apparently
+// random, but is secretly marked as being issued by the server.
+// This is useful to prevent the server from accepting its own output in a
+// reflection attack.
+func NewServerSaltGenerator(secret string) ServerSaltGenerator {
+	return NewMarkedServerSaltGenerator(secret, nil)
+}
+
+// NewMarkedServerSaltGenerator is like NewServerSaltGenerator, but the marks
+// also depend on `marking`, which may be nil.
+func NewMarkedServerSaltGenerator(secret string, marking *SaltMarking) ServerSaltGenerator {
+	sg := serverSaltGenerator{markLen: marking.EffectiveMarkLen()}
+	if marking == nil {
+		sg.key = deriveSaltKey(secret, "")
+		return sg
+	}
+	sg.key = deriveSaltKey(secret, marking.Secret)
+	for _, previous := range marking.Previous {
+		sg.previous = append(sg.previous, expiringSaltKey{deriveSaltKey(secret, previous.Secret), previous.Expiry})
+	}
+	return sg
 }
 
 func (sg serverSaltGenerator) splitSalt(salt []byte) (prefix, mark []byte, err error) {
-	prefixLen := len(salt) - serverSaltMarkLen
+	prefixLen := len(salt) - sg.markLen
 	if prefixLen < 0 {
-		return nil, nil, fmt.Errorf("Salt is too short: %d < %d", len(salt), serverSaltMarkLen)
+		return nil, nil, fmt.Errorf("Salt is too short: %d < %d", len(salt), sg.markLen)
 	}
 	return salt[:prefixLen], salt[prefixLen:], nil
 }
 
 // getTag takes in a salt prefix and returns the tag.
-func (sg serverSaltGenerator) getTag(prefix []byte) []byte {
+func getTag(key, prefix []byte) []byte {
 	// Use HMAC-SHA1, even though SHA1 is broken, because HMAC-SHA1 is still
 	// secure, and we're already using HKDF-SHA1.
-	hmac := hmac.New(crypto.SHA1.New, sg.key)
+	hmac := hmac.New(crypto.SHA1.New, key)
 	hmac.Write(prefix) // Hash.Write never returns an error.
 	return hmac.Sum(nil)
 }
@@ -105,7 +187,7 @@ func (sg serverSaltGenerator) GetSalt(salt []byte) error {
 	if _, err := rand.Read(prefix); err != nil {
 		return err
 	}
-	tag := sg.getTag(prefix)
+	tag := getTag(sg.key, prefix)
 	copy(mark, tag)
 	return nil
 }
@@ -115,6 +197,17 @@ func (sg serverSaltGenerator) IsServerSalt(salt []byte) bool {
 	if err != nil {
 		return false
 	}
-	tag := sg.getTag(prefix)
-	return bytes.Equal(tag[:serverSaltMarkLen], mark)
+	if bytes.Equal(getTag(sg.key, prefix)[:sg.markLen], mark) {
+		return true
+	}
+	if len(sg.previous) == 0 {
+		return false
+	}
+	now := time.Now()
+	for _, previous := range sg.previous {
+		if now.Before(previous.expiry) && bytes.Equal(getTag(previous.key, prefix)[:sg.markLen], mark) {
+			return true
+		}
+	}
+	return false
 }
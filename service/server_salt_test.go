@@ -17,6 +17,7 @@ package service
 import (
 	"bytes"
 	"testing"
+	"time"
 )
 
 // Test that ServerSaltGenerator recognizes its own salts
@@ -151,3 +152,107 @@ func BenchmarkServerSaltGenerator(b *testing.B) {
 		}
 	})
 }
+
+func TestServerSaltMarkLen(t *testing.T) {
+	ssg := NewMarkedServerSaltGenerator("test", &SaltMarking{MarkLen: 8})
+
+	salt := make([]byte, 32)
+	if err := ssg.GetSalt(salt); err != nil {
+		t.Fatal(err)
+	}
+	if !ssg.IsServerSalt(salt) {
+		t.Error("Server salt was not recognized")
+	}
+	salt[32-8] ^= 1
+	if ssg.IsServerSalt(salt) {
+		t.Error("Modified mark was recognized")
+	}
+
+	salt7 := make([]byte, 7)
+	if err := ssg.GetSalt(salt7); err == nil {
+		t.Error("Expected error for too-short salt")
+	}
+}
+
+func TestServerSaltMarkingSecret(t *testing.T) {
+	plain := NewServerSaltGenerator("test")
+	empty := NewMarkedServerSaltGenerator("test", &SaltMarking{})
+	marked := NewMarkedServerSaltGenerator("test", &SaltMarking{Secret: "server"})
+
+	salt := make([]byte, 32)
+	if err := plain.GetSalt(salt); err != nil {
+		t.Fatal(err)
+	}
+	if !empty.IsServerSalt(salt) {
+		t.Error("An empty marking secret should not change the marks")
+	}
+	if marked.IsServerSalt(salt) {
+		t.Error("Salt without the marking secret was recognized")
+	}
+	if err := marked.GetSalt(salt); err != nil {
+		t.Fatal(err)
+	}
+	if !marked.IsServerSalt(salt) {
+		t.Error("Server salt was not recognized")
+	}
+	if plain.IsServerSalt(salt) {
+		t.Error("Salt with the marking secret was recognized without it")
+	}
+}
+
+func TestServerSaltRotation(t *testing.T) {
+	old := NewMarkedServerSaltGenerator("test", &SaltMarking{Secret: "old"})
+	oldSalt := make([]byte, 32)
+	if err := old.GetSalt(oldSalt); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := NewMarkedServerSaltGenerator("test", &SaltMarking{
+		Secret:   "new",
+		Previous: []PreviousSaltSecret{{Secret: "old", Expiry: time.Now().Add(time.Hour)}},
+	})
+	if !rotated.IsServerSalt(oldSalt) {
+		t.Error("Salt from the previous secret was not recognized during the grace period")
+	}
+	newSalt := make([]byte, 32)
+	if err := rotated.GetSalt(newSalt); err != nil {
+		t.Fatal(err)
+	}
+	if !rotated.IsServerSalt(newSalt) {
+		t.Error("Server salt was not recognized")
+	}
+	if old.IsServerSalt(newSalt) {
+		t.Error("New salts should not use the previous secret")
+	}
+
+	expired := NewMarkedServerSaltGenerator("test", &SaltMarking{
+		Secret:   "new",
+		Previous: []PreviousSaltSecret{{Secret: "old", Expiry: time.Now().Add(-time.Second)}},
+	})
+	if expired.IsServerSalt(oldSalt) {
+		t.Error("Salt from an expired secret was recognized")
+	}
+}
+
+func TestSaltMarkingValidate(t *testing.T) {
+	valid := []SaltMarking{
+		{},
+		{Secret: "new", MarkLen: MaxServerSaltMarkLen, Previous: []PreviousSaltSecret{{Secret: "old"}}},
+		{Previous: []PreviousSaltSecret{{Secret: "old"}}},
+	}
+	for _, m := range valid {
+		if err := m.Validate(); err != nil {
+			t.Errorf("%+v: %v", m, err)
+		}
+	}
+	invalid := []SaltMarking{
+		{MarkLen: -1},
+		{MarkLen: MaxServerSaltMarkLen + 1},
+		{Secret: "same", Previous: []PreviousSaltSecret{{Secret: "same"}}},
+	}
+	for _, m := range invalid {
+		if err := m.Validate(); err == nil {
+			t.Errorf("%+v: expected an error", m)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// sipHash computes SipHash-2-4 (https://www.aumasson.jp/siphash/siphash.pdf)
+// incrementally.  It is a fast keyed hash, so an attacker who doesn't know the
+// key cannot produce collisions.
+type sipHash struct {
+	v0, v1, v2, v3 uint64
+	// Pending input that doesn't fill a word.
+	tail  [8]byte
+	ntail int
+	// Total length of the input.
+	length uint64
+}
+
+func newSipHash(k0, k1 uint64) sipHash {
+	return sipHash{
+		v0: k0 ^ 0x736f6d6570736575,
+		v1: k1 ^ 0x646f72616e646f6d,
+		v2: k0 ^ 0x6c7967656e657261,
+		v3: k1 ^ 0x7465646279746573,
+	}
+}
+
+func (h *sipHash) round() {
+	h.v0 += h.v1
+	h.v1 = bits.RotateLeft64(h.v1, 13)
+	h.v1 ^= h.v0
+	h.v0 = bits.RotateLeft64(h.v0, 32)
+	h.v2 += h.v3
+	h.v3 = bits.RotateLeft64(h.v3, 16)
+	h.v3 ^= h.v2
+	h.v0 += h.v3
+	h.v3 = bits.RotateLeft64(h.v3, 21)
+	h.v3 ^= h.v0
+	h.v2 += h.v1
+	h.v1 = bits.RotateLeft64(h.v1, 17)
+	h.v1 ^= h.v2
+	h.v2 = bits.RotateLeft64(h.v2, 32)
+}
+
+func (h *sipHash) compress(m uint64) {
+	h.v3 ^= m
+	h.round()
+	h.round()
+	h.v0 ^= m
+}
+
+func (h *sipHash) writeByte(b byte) {
+	h.tail[h.ntail] = b
+	h.ntail++
+	h.length++
+	if h.ntail == 8 {
+		h.compress(binary.LittleEndian.Uint64(h.tail[:]))
+		h.ntail = 0
+	}
+}
+
+func (h *sipHash) write(p []byte) {
+	for len(p) > 0 && h.ntail > 0 {
+		h.writeByte(p[0])
+		p = p[1:]
+	}
+	for len(p) >= 8 {
+		h.compress(binary.LittleEndian.Uint64(p))
+		h.length += 8
+		p = p[8:]
+	}
+	for _, b := range p {
+		h.writeByte(b)
+	}
+}
+
+func (h *sipHash) writeString(s string) {
+	for i := 0; i < len(s); i++ {
+		h.writeByte(s[i])
+	}
+}
+
+func (h *sipHash) sum64() uint64 {
+	b := h.length << 56
+	for i := 0; i < h.ntail; i++ {
+		b |= uint64(h.tail[i]) << (8 * i)
+	}
+	h.compress(b)
+	h.v2 ^= 0xff
+	for i := 0; i < 4; i++ {
+		h.round()
+	}
+	return h.v0 ^ h.v1 ^ h.v2 ^ h.v3
+}
@@ -17,13 +17,13 @@ package service
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"sync"
-	"syscall"
 	"time"
 
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
@@ -63,12 +63,16 @@ func debugTCP(cipherID, template string, val interface{}) {
 // required = saltSize + 2 + cipher.TagSize, the number of bytes needed to authenticate the connection.
 const bytesForKeyFinding = 50
 
-func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherList) (*CipherEntry, io.Reader, []byte, time.Duration, error) {
+// findAccessKey reads the start of the connection to find its access key.  The
+// returned reader yields all the data from the client, including the bytes
+// that were read, even if no access key was found.  The affinity is only
+// meaningful if a key was found.
+func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherList) (*CipherEntry, io.Reader, []byte, time.Duration, CipherAffinity, error) {
 	// We snapshot the list because it may be modified while we use it.
-	ciphers := cipherList.SnapshotForClientIP(clientIP)
+	ciphers := orderForClientIP(cipherList, clientIP)
 	firstBytes := make([]byte, bytesForKeyFinding)
 	if n, err := io.ReadFull(clientReader, firstBytes); err != nil {
-		return nil, clientReader, nil, 0, fmt.Errorf("Reading header failed after %d bytes: %v", n, err)
+		return nil, io.MultiReader(bytes.NewReader(firstBytes[:n]), clientReader), nil, 0, NoAffinity, fmt.Errorf("Reading header failed after %d bytes: %v", n, err)
 	}
 
 	findStartTime := time.Now()
@@ -76,42 +80,62 @@ func findAccessKey(clientReader io.Reader, clientIP net.IP, cipherList CipherLis
 	timeToCipher := time.Now().Sub(findStartTime)
 	if entry == nil {
 		// TODO: Ban and log client IPs with too many failures too quick to protect against DoS.
-		return nil, clientReader, nil, timeToCipher, fmt.Errorf("Could not find valid TCP cipher")
+		return nil, io.MultiReader(bytes.NewReader(firstBytes), clientReader), nil, timeToCipher, NoAffinity, fmt.Errorf("Could not find valid TCP cipher")
 	}
 
 	// Move the active cipher to the front, so that the search is quicker next time.
-	cipherList.MarkUsedByClientIP(elt, clientIP)
+	affinity := cipherList.MarkUsedByClientIP(elt, clientIP)
 	salt := firstBytes[:entry.Cipher.SaltSize()]
-	return entry, io.MultiReader(bytes.NewReader(firstBytes), clientReader), salt, timeToCipher, nil
+	return entry, io.MultiReader(bytes.NewReader(firstBytes), clientReader), salt, timeToCipher, affinity, nil
 }
 
 // Implements a trial decryption search.  This assumes that all ciphers are AEAD.
-func findEntry(firstBytes []byte, ciphers []*list.Element) (*CipherEntry, *list.Element) {
-	// To hold the decrypted chunk length.
-	chunkLenBuf := [2]byte{}
-	for ci, elt := range ciphers {
-		entry := elt.Value.(*CipherEntry)
-		id, cipher := entry.ID, entry.Cipher
-		saltsize := cipher.SaltSize()
-		salt := firstBytes[:saltsize]
-		cipherTextLength := 2 + cipher.TagSize()
-		cipherText := firstBytes[saltsize : saltsize+cipherTextLength]
-		_, err := ss.DecryptOnce(cipher, salt, chunkLenBuf[:0], cipherText)
-		if err != nil {
-			debugTCP(id, "Failed to decrypt length: %v", err)
-			continue
+// Large searches run in parallel.
+func findEntry(firstBytes []byte, ciphers keyOrder) (*CipherEntry, *list.Element) {
+	ci := trialSearch(ciphers.len(), func() func(int) bool {
+		// To hold the decrypted chunk length.
+		chunkLenBuf := [2]byte{}
+		return func(i int) bool {
+			elt := ciphers.at(i)
+			if elt == nil {
+				return false
+			}
+			entry := elt.Value.(*CipherEntry)
+			id, cipher := entry.ID, entry.Cipher
+			saltsize := cipher.SaltSize()
+			salt := firstBytes[:saltsize]
+			cipherTextLength := 2 + cipher.TagSize()
+			cipherText := firstBytes[saltsize : saltsize+cipherTextLength]
+			_, err := ss.DecryptOnce(cipher, salt, chunkLenBuf[:0], cipherText)
+			if err != nil {
+				debugTCP(id, "Failed to decrypt length: %v", err)
+				return false
+			}
+			return true
 		}
-		debugTCP(id, "Found cipher at index %d", ci)
-		// Move the active cipher to the front, so that the search is quicker next time.
-		return entry, elt
+	})
+	if ci < 0 {
+		return nil, nil
 	}
-	return nil, nil
+	elt := ciphers.at(ci)
+	entry := elt.Value.(*CipherEntry)
+	debugTCP(entry.ID, "Found cipher at index %d", ci)
+	// Move the active cipher to the front, so that the search is quicker next time.
+	return entry, elt
 }
 
 type tcpService struct {
-	mu          sync.RWMutex // Protects .listeners and .stopped
+	mu          sync.RWMutex // Protects .listeners, .stopped, .egress, .timeouts, .fallback, .probes, .probeLog, .padding, .sockopts and .proxyProto
 	listener    *net.TCPListener
 	stopped     bool
+	egress      *EgressPolicy
+	timeouts    TCPTimeouts
+	fallback    *TCPFallback
+	probes      ProbePolicy
+	probeLog    *ProbeLog
+	padding     *ss.PaddingPolicy
+	sockopts    *TCPSocketOptions
+	proxyProto  *ProxyProtocolPolicy
 	ciphers     CipherList
 	m           metrics.ShadowsocksMetrics
 	running     sync.WaitGroup
@@ -119,6 +143,9 @@ type tcpService struct {
 	// `replayCache` is a pointer to SSServer.replayCache, to share the cache among all ports.
 	replayCache       *ReplayCache
 	targetIPValidator onet.TargetIPValidator
+	// The TCP Fast Open queue length that the service set on the listener, or
+	// zero.  Protected by mu.
+	fastOpenQueue int
 }
 
 // NewTCPService creates a TCPService
@@ -137,6 +164,29 @@ func NewTCPService(ciphers CipherList, replayCache *ReplayCache, m metrics.Shado
 type TCPService interface {
 	// SetTargetIPValidator sets the function to be used to validate the target IP addresses.
 	SetTargetIPValidator(targetIPValidator onet.TargetIPValidator)
+	// SetEgressPolicy sets the policy for connecting to targets, unless the
+	// access key has its own.  It may be called while serving.
+	SetEgressPolicy(egress *EgressPolicy)
+	// SetTimeouts sets the limits for new connections.  It may be called while serving.
+	SetTimeouts(timeouts TCPTimeouts)
+	// SetFallback sets the decoy service for connections that fail to
+	// authenticate.  If nil, they are absorbed.  It may be called while serving.
+	SetFallback(fallback *TCPFallback)
+	// SetProbePolicy sets how connections that fail to authenticate are absorbed.
+	// It may be called while serving.
+	SetProbePolicy(policy ProbePolicy)
+	// SetProbeLog sets the log of connections that fail to authenticate, which
+	// may be shared among services.  Nil disables logging.  It may be called while serving.
+	SetProbeLog(probeLog *ProbeLog)
+	// SetPadding sets the policy for randomizing the length of the first response
+	// to each client.  Nil disables it.  It may be called while serving.
+	SetPadding(padding *ss.PaddingPolicy)
+	// SetSocketOptions sets the options of new client and target sockets, and of
+	// the listener.  Nil keeps the defaults.  It may be called while serving.
+	SetSocketOptions(sockopts *TCPSocketOptions)
+	// SetProxyProtocol sets the sources that send PROXY protocol v1 or v2 headers.
+	// Nil disables them.  It may be called while serving.
+	SetProxyProtocol(policy *ProxyProtocolPolicy)
 	// Serve adopts the listener, which will be closed before Serve returns.  Serve returns an error unless Stop() was called.
 	Serve(listener *net.TCPListener) error
 	// Stop closes the listener but does not interfere with existing connections.
@@ -149,25 +199,121 @@ func (s *tcpService) SetTargetIPValidator(targetIPValidator onet.TargetIPValidat
 	s.targetIPValidator = targetIPValidator
 }
 
-func dialTarget(tgtAddr socks.Addr, proxyMetrics *metrics.ProxyMetrics, targetIPValidator onet.TargetIPValidator) (onet.DuplexConn, *onet.ConnectionError) {
-	var ipError *onet.ConnectionError
-	dialer := net.Dialer{Control: func(network, address string, c syscall.RawConn) error {
-		ip, _, _ := net.SplitHostPort(address)
-		ipError = targetIPValidator(net.ParseIP(ip))
-		if ipError != nil {
-			return errors.New(ipError.Message)
+func (s *tcpService) SetEgressPolicy(egress *EgressPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.egress = egress
+}
+
+// egressPolicy returns the policy for connections authenticated with `entry`.
+func (s *tcpService) egressPolicy(entry *CipherEntry) *EgressPolicy {
+	if entry.Egress != nil {
+		return entry.Egress
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.egress
+}
+
+func (s *tcpService) SetTimeouts(timeouts TCPTimeouts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.timeouts = timeouts
+}
+
+func (s *tcpService) SetFallback(fallback *TCPFallback) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallback = fallback
+}
+
+func (s *tcpService) currentFallback() *TCPFallback {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.fallback
+}
+
+func (s *tcpService) SetProbePolicy(policy ProbePolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probes = policy
+}
+
+func (s *tcpService) probePolicy() ProbePolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.probes
+}
+
+func (s *tcpService) SetProbeLog(probeLog *ProbeLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.probeLog = probeLog
+}
+
+func (s *tcpService) currentProbeLog() *ProbeLog {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.probeLog
+}
+
+func (s *tcpService) SetPadding(padding *ss.PaddingPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.padding = padding
+}
+
+func (s *tcpService) currentPadding() *ss.PaddingPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.padding
+}
+
+func (s *tcpService) SetSocketOptions(sockopts *TCPSocketOptions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sockopts = sockopts
+	if s.listener != nil && !s.stopped {
+		var err error
+		if s.fastOpenQueue, err = sockopts.applyToListener(s.listener, s.fastOpenQueue); err != nil {
+			logger.Warningf("Failed to set listener options: %v", err)
 		}
-		return nil
-	}}
-	tgtConn, err := dialer.Dial("tcp", tgtAddr.String())
-	if ipError != nil {
-		return nil, ipError
-	} else if err != nil {
-		return nil, onet.NewConnectionError("ERR_CONNECT", "Failed to connect to target", err)
 	}
-	tgtTCPConn := tgtConn.(*net.TCPConn)
-	tgtTCPConn.SetKeepAlive(true)
-	return metrics.MeasureConn(tgtTCPConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy), nil
+}
+
+func (s *tcpService) socketOptions() *TCPSocketOptions {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sockopts
+}
+
+func (s *tcpService) SetProxyProtocol(policy *ProxyProtocolPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proxyProto = policy
+}
+
+func (s *tcpService) proxyProtocol() *ProxyProtocolPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.proxyProto
+}
+
+func (s *tcpService) relayTimeouts() TCPTimeouts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.timeouts
+}
+
+func dialTarget(tgtAddr socks.Addr, targetIPValidator onet.TargetIPValidator, egress *EgressPolicy, timeouts TCPTimeouts, sockopts *TCPSocketOptions) (*net.TCPConn, *onet.ConnectionError) {
+	tgtTCPConn, dialErr := egress.dialTCP(context.Background(), tgtAddr.String(), targetIPValidator, timeouts, sockopts)
+	if dialErr != nil {
+		return nil, dialErr
+	}
+	if err := sockopts.applyToConn(tgtTCPConn); err != nil {
+		logger.Debugf("Failed to set target socket options: %v", err)
+	}
+	return tgtTCPConn, nil
 }
 
 func (s *tcpService) Serve(listener *net.TCPListener) error {
@@ -182,6 +328,12 @@ func (s *tcpService) Serve(listener *net.TCPListener) error {
 		return listener.Close()
 	}
 	s.listener = listener
+	if s.sockopts != nil {
+		var err error
+		if s.fastOpenQueue, err = s.sockopts.applyToListener(listener, s.fastOpenQueue); err != nil {
+			logger.Warningf("Failed to set listener options: %v", err)
+		}
+	}
 	s.running.Add(1)
 	s.mu.Unlock()
 
@@ -213,20 +365,46 @@ func (s *tcpService) Serve(listener *net.TCPListener) error {
 }
 
 func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPConn) {
-	clientIp := s.m.GetIpAddress(clientTCPConn.RemoteAddr())
-	logger.Debugf("Got location \"%v\" for IP %v", clientIp, clientTCPConn.RemoteAddr().String())
-
 	connStart := time.Now()
-	clientTCPConn.SetKeepAlive(true)
+	sockopts := s.socketOptions()
+	if err := sockopts.applyToConn(clientTCPConn); err != nil {
+		logger.Debugf("Failed to set client socket options: %v", err)
+	}
+	probes := s.probePolicy()
 	// Set a deadline to receive the address to the target.
-	clientTCPConn.SetReadDeadline(connStart.Add(s.readTimeout))
+	clientTCPConn.SetReadDeadline(connStart.Add(probes.authTimeout(s.readTimeout)))
+
+	// The client is behind a load balancer if the connection starts with a
+	// PROXY protocol header.
+	var clientBaseConn onet.DuplexConn = clientTCPConn
+	if s.proxyProtocol().trusts(clientTCPConn.RemoteAddr()) {
+		proxiedConn, err := readProxyHeader(clientTCPConn)
+		if err != nil {
+			logger.Debugf("Failed to read PROXY protocol header from %v: %v", clientTCPConn.RemoteAddr(), err)
+			clientIp := s.m.GetIpAddress(clientTCPConn.RemoteAddr())
+			s.m.AddOpenTCPConnection(clientIp, "")
+			s.m.AddClosedTCPConnection(clientIp, "", "ERR_PROXY_PROTOCOL", metrics.ProxyMetrics{}, 0, time.Now().Sub(connStart))
+			clientTCPConn.Close()
+			return
+		}
+		clientBaseConn = proxiedConn
+	}
+	clientIp := s.m.GetIpAddress(clientBaseConn.RemoteAddr())
+	logger.Debugf("Got location \"%v\" for IP %v", clientIp, clientBaseConn.RemoteAddr().String())
+
 	var proxyMetrics metrics.ProxyMetrics
-	clientConn := metrics.MeasureConn(clientTCPConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
-	cipherEntry, clientReader, clientSalt, timeToCipher, keyErr := findAccessKey(clientConn, remoteIP(clientTCPConn), s.ciphers)
+	timeouts := s.relayTimeouts()
+	clientLimitConn := &timeoutConn{DuplexConn: clientBaseConn}
+	clientConn := metrics.MeasureConn(clientLimitConn, &proxyMetrics.ProxyClient, &proxyMetrics.ClientProxy)
+	probeLog := s.currentProbeLog()
+	// Keeps the first bytes from the client, in case it is a probe.
+	clientRecorder := &prefixRecorder{Reader: clientConn, max: probeLog.HashBytes()}
+	cipherEntry, clientReader, clientSalt, timeToCipher, affinity, keyErr := findAccessKey(clientRecorder, remoteIP(clientConn), s.ciphers)
 
 	var id string
 	if cipherEntry != nil {
 		id = cipherEntry.ID
+		s.m.AddCipherLookup("tcp", string(affinity))
 	}
 
 	s.m.AddOpenTCPConnection(clientIp, id)
@@ -235,7 +413,7 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 		if keyErr != nil {
 			logger.Debugf("Failed to find a valid cipher after reading %v bytes: %v", proxyMetrics.ClientProxy, keyErr)
 			const status = "ERR_CIPHER"
-			s.absorbProbe(listenerPort, clientConn, clientIp, status, &proxyMetrics)
+			s.rejectProbe(listenerPort, clientTCPConn, clientConn, clientRecorder, clientReader, status, &probes, probeLog, &proxyMetrics)
 			return onet.NewConnectionError(status, "Failed to find a valid cipher", keyErr)
 		}
 
@@ -248,8 +426,8 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 			} else {
 				status = "ERR_REPLAY_CLIENT"
 			}
-			s.absorbProbe(listenerPort, clientConn, clientIp, status, &proxyMetrics)
-			logger.Debugf(status+": %v in %s sent %d bytes", clientTCPConn.RemoteAddr(), clientIp, proxyMetrics.ClientProxy)
+			s.rejectProbe(listenerPort, clientTCPConn, clientConn, clientRecorder, clientReader, status, &probes, probeLog, &proxyMetrics)
+			logger.Debugf(status+": %v in %s sent %d bytes", clientConn.RemoteAddr(), clientIp, proxyMetrics.ClientProxy)
 			return onet.NewConnectionError(status, "Replay detected", nil)
 		}
 
@@ -263,21 +441,42 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 			return onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", err)
 		}
 
-		tgtConn, dialErr := dialTarget(tgtAddr, &proxyMetrics, s.targetIPValidator)
+		tgtTCPConn, dialErr := dialTarget(tgtAddr, s.targetIPValidator, s.egressPolicy(cipherEntry), timeouts, sockopts)
 		if dialErr != nil {
 			// We don't drain so dial errors and invalid addresses are communicated quickly.
 			return dialErr
 		}
+		tgtLimitConn := &timeoutConn{DuplexConn: tgtTCPConn}
+		tgtConn := metrics.MeasureConn(tgtLimitConn, &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy)
 		defer tgtConn.Close()
 
-		logger.Debugf("proxy %s <-> %s", clientTCPConn.RemoteAddr().String(), tgtConn.RemoteAddr().String())
+		var clock *relayClock
+		if timeouts.limitsRelay() {
+			var end time.Time
+			if timeouts.MaxDuration > 0 {
+				end = connStart.Add(timeouts.MaxDuration)
+			}
+			clock = newRelayClock(end)
+			clock.start(clientLimitConn, tgtLimitConn, timeouts)
+		}
+		// Stops the other direction if one direction reached a relay limit.
+		stopOnTimeout := func(err error) bool {
+			if clock == nil || !isRelayTimeout(err) {
+				return false
+			}
+			clock.stop(clientLimitConn, tgtLimitConn)
+			return true
+		}
+
+		logger.Debugf("proxy %s <-> %s", clientConn.RemoteAddr().String(), tgtConn.RemoteAddr().String())
 		ssw := ss.NewShadowsocksWriter(clientConn, cipherEntry.Cipher)
 		ssw.SetSaltGenerator(cipherEntry.SaltGenerator)
+		ssw.SetPadding(s.currentPadding())
 
 		fromClientErrCh := make(chan error)
 		go func() {
 			_, fromClientErr := ssr.WriteTo(tgtConn)
-			if fromClientErr != nil {
+			if fromClientErr != nil && !stopOnTimeout(fromClientErr) {
 				// Drain to prevent a close in the case of a cipher error.
 				io.Copy(ioutil.Discard, clientConn)
 			}
@@ -289,16 +488,17 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 			fromClientErrCh <- fromClientErr
 		}()
 		_, fromTargetErr := ssw.ReadFrom(tgtConn)
+		stopOnTimeout(fromTargetErr)
 		// Send FIN to client.
 		clientConn.CloseWrite()
 		tgtConn.CloseRead()
 
 		fromClientErr := <-fromClientErrCh
 		if fromClientErr != nil {
-			return onet.NewConnectionError("ERR_RELAY_CLIENT", "Failed to relay traffic from client", fromClientErr)
+			return relayError("ERR_RELAY_CLIENT", "Failed to relay traffic from client", fromClientErr)
 		}
 		if fromTargetErr != nil {
-			return onet.NewConnectionError("ERR_RELAY_TARGET", "Failed to relay traffic from target", fromTargetErr)
+			return relayError("ERR_RELAY_TARGET", "Failed to relay traffic from target", fromTargetErr)
 		}
 		return nil
 	}()
@@ -315,13 +515,44 @@ func (s *tcpService) handleConnection(listenerPort int, clientTCPConn *net.TCPCo
 	logger.Debugf("Done with status %v, duration %v", status, connDuration)
 }
 
-// Keep the connection open until we hit the authentication deadline to protect against probing attacks
+// rejectProbe forwards a connection that failed to authenticate to the fallback
+// service, if there is one, or else absorbs it, and then records the probe.
+// `clientRecorder` reads from `clientConn`, and `clientReader` returns the bytes
+// already read, followed by the rest.
+func (s *tcpService) rejectProbe(listenerPort int, clientTCPConn *net.TCPConn, clientConn onet.DuplexConn, clientRecorder *prefixRecorder, clientReader io.Reader, status string, probes *ProbePolicy, probeLog *ProbeLog, proxyMetrics *metrics.ProxyMetrics) {
+	drainResult := s.forwardProbe(listenerPort, clientTCPConn, clientConn, clientReader, status, proxyMetrics)
+	if drainResult == "" {
+		drainResult = s.absorbProbe(listenerPort, clientTCPConn, clientRecorder, status, probes, proxyMetrics)
+	}
+	probeLog.Add(remoteIP(clientConn), listenerPort, status, proxyMetrics.ClientProxy, drainResult, clientRecorder.prefix)
+}
+
+// forwardProbe forwards the connection to the fallback service, and returns
+// "fallback", or "" if there is no fallback service or it is unavailable.
+func (s *tcpService) forwardProbe(listenerPort int, clientTCPConn *net.TCPConn, clientConn onet.DuplexConn, clientReader io.Reader, status string, proxyMetrics *metrics.ProxyMetrics) string {
+	fallback := s.currentFallback()
+	if fallback == nil {
+		return ""
+	}
+	if err := fallback.forward(clientTCPConn, clientConn, clientReader, proxyMetrics); err != nil {
+		logger.Warningf("Failed to connect to fallback %v: %v", fallback.Address, err)
+		return ""
+	}
+	logger.Debugf("Forwarded %v to fallback %v", clientConn.RemoteAddr(), fallback.Address)
+	const drainResult = "fallback"
+	s.m.AddTCPProbe(status, drainResult, "fin", listenerPort, *proxyMetrics)
+	s.m.AddTCPFallback(status, *proxyMetrics)
+	return drainResult
+}
+
+// Keep the connection open until we hit the authentication deadline, or the byte limit of the
+// probe policy, to protect against probing attacks.  Returns what ended the probe.
 // `proxyMetrics` is a pointer because its value is being mutated by `clientConn`.
-func (s *tcpService) absorbProbe(listenerPort int, clientConn io.ReadCloser, clientIp, status string, proxyMetrics *metrics.ProxyMetrics) {
-	_, drainErr := io.Copy(ioutil.Discard, clientConn) // drain socket
-	drainResult := drainErrToString(drainErr)
+func (s *tcpService) absorbProbe(listenerPort int, clientTCPConn *net.TCPConn, clientConn io.Reader, status string, probes *ProbePolicy, proxyMetrics *metrics.ProxyMetrics) string {
+	drainResult, drainErr := probes.absorb(clientTCPConn, clientConn, proxyMetrics.ClientProxy)
 	logger.Debugf("Drain error: %v, drain result: %v", drainErr, drainResult)
-	s.m.AddTCPProbe(status, drainResult, listenerPort, *proxyMetrics)
+	s.m.AddTCPProbe(status, drainResult, probes.closeStyle(), listenerPort, *proxyMetrics)
+	return drainResult
 }
 
 func drainErrToString(drainErr error) string {
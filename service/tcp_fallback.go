@@ -0,0 +1,71 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"net"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
+)
+
+// Default limit on connecting to the fallback service.
+const defaultFallbackConnectTimeout = 5 * time.Second
+
+// TCPFallback forwards connections that fail to authenticate, or are replays,
+// to a decoy service such as a web server, instead of absorbing them.  Active
+// probes then see the decoy service.  The decoy receives all the data sent by
+// the client, including the bytes read while looking for the access key.
+type TCPFallback struct {
+	// Address of the decoy service, e.g. "127.0.0.1:80".  It is not subject to
+	// the target IP validation.
+	Address string
+	// ConnectTimeout limits connecting to the decoy.  Zero selects a default.
+	// If the connection fails, the probe is absorbed.
+	ConnectTimeout time.Duration
+}
+
+// forward relays the client connection to the decoy service, until both
+// directions are closed.  `clientReader` must return the bytes already read
+// from `clientConn`, followed by the rest of its data.
+func (f *TCPFallback) forward(clientTCPConn *net.TCPConn, clientConn onet.DuplexConn, clientReader io.Reader, proxyMetrics *metrics.ProxyMetrics) error {
+	timeout := f.ConnectTimeout
+	if timeout == 0 {
+		timeout = defaultFallbackConnectTimeout
+	}
+	conn, err := net.DialTimeout("tcp", f.Address, timeout)
+	if err != nil {
+		return err
+	}
+	decoyConn := metrics.MeasureConn(conn.(*net.TCPConn), &proxyMetrics.ProxyTarget, &proxyMetrics.TargetProxy)
+	defer decoyConn.Close()
+	// The decoy is responsible for timing out the client from now on.
+	clientTCPConn.SetReadDeadline(time.Time{})
+
+	fromClientDone := make(chan struct{})
+	go func() {
+		io.Copy(decoyConn, clientReader)
+		decoyConn.CloseWrite()
+		close(fromClientDone)
+	}()
+	io.Copy(clientConn, decoyConn)
+	clientConn.CloseWrite()
+	// The decoy has closed the connection, so stop reading from the client.
+	clientTCPConn.SetReadDeadline(time.Now())
+	<-fromClientDone
+	return nil
+}
@@ -0,0 +1,144 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+const decoyResponse = "HTTP/1.1 400 Bad Request\r\n\r\n"
+
+// startDecoyServer reads each connection until EOF, and then replies with
+// decoyResponse followed by the received bytes.
+func startDecoyServer(t *testing.T) *net.TCPListener {
+	listener := makeLocalhostListener(t)
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				received, _ := ioutil.ReadAll(conn)
+				conn.Write(append([]byte(decoyResponse), received...))
+			}()
+		}
+	}()
+	return listener
+}
+
+// sendAndReceive sends `data`, half-closes the connection and returns the response.
+func sendAndReceive(t *testing.T, addr *net.TCPAddr, data []byte) []byte {
+	conn, err := net.DialTCP("tcp", nil, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	conn.CloseWrite()
+	response, err := ioutil.ReadAll(conn)
+	require.NoError(t, err)
+	return response
+}
+
+func TestTCPFallbackCipherError(t *testing.T) {
+	decoy := startDecoyServer(t)
+	defer decoy.Close()
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 10*time.Second)
+	s.SetFallback(&TCPFallback{Address: decoy.Addr().String()})
+	go s.Serve(listener)
+
+	// Probes both shorter and longer than the bytes needed to find the key.
+	for _, size := range []int{0, 10, bytesForKeyFinding, 200} {
+		probe := make([]byte, size)
+		rand.Read(probe)
+		response := sendAndReceive(t, listener.Addr().(*net.TCPAddr), probe)
+		require.Equal(t, append([]byte(decoyResponse), probe...), response, "size %d", size)
+	}
+	s.GracefulStop()
+
+	require.Equal(t, []string{"ERR_CIPHER", "ERR_CIPHER", "ERR_CIPHER", "ERR_CIPHER"}, testMetrics.fallbackStatus)
+	require.Equal(t, testMetrics.fallbackStatus, testMetrics.closeStatus)
+	data := testMetrics.fallbackData[3]
+	require.Equal(t, int64(200), data.ClientProxy)
+	require.Equal(t, int64(200), data.ProxyTarget)
+	require.Equal(t, int64(len(decoyResponse)+200), data.TargetProxy)
+	require.Equal(t, int64(len(decoyResponse)+200), data.ProxyClient)
+}
+
+func TestTCPFallbackReplay(t *testing.T) {
+	decoy := startDecoyServer(t)
+	defer decoy.Close()
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	replayCache := NewReplayCache(5)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, &replayCache, testMetrics, 200*time.Millisecond)
+	s.SetFallback(&TCPFallback{Address: decoy.Addr().String()})
+	go s.Serve(listener)
+
+	cipher := firstCipher(cipherList)
+	reader, writer := io.Pipe()
+	go ss.NewShadowsocksWriter(writer, cipher).Write([]byte{0})
+	preamble := make([]byte, cipher.SaltSize()+2+cipher.TagSize())
+	_, err = io.ReadFull(reader, preamble)
+	require.NoError(t, err)
+
+	// The first connection is authenticated, and fails to read the address.
+	require.Empty(t, sendAndReceive(t, listener.Addr().(*net.TCPAddr), preamble))
+	response := sendAndReceive(t, listener.Addr().(*net.TCPAddr), preamble)
+	require.Equal(t, append([]byte(decoyResponse), preamble...), response)
+	s.GracefulStop()
+
+	require.Equal(t, []string{"ERR_REPLAY_CLIENT"}, testMetrics.fallbackStatus)
+	require.Equal(t, []string{"ERR_REPLAY_CLIENT"}, testMetrics.probeStatus)
+}
+
+func TestTCPFallbackUnavailable(t *testing.T) {
+	// Reserve an address with nothing listening.
+	decoy := makeLocalhostListener(t)
+	decoyAddr := decoy.Addr().String()
+	decoy.Close()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 200*time.Millisecond)
+	s.SetFallback(&TCPFallback{Address: decoyAddr})
+	go s.Serve(listener)
+
+	probe := make([]byte, 100)
+	rand.Read(probe)
+	// The probe is absorbed, so the response is empty.
+	require.Empty(t, sendAndReceive(t, listener.Addr().(*net.TCPAddr), probe))
+	s.GracefulStop()
+
+	require.Empty(t, testMetrics.fallbackStatus)
+	require.Equal(t, []string{"ERR_CIPHER"}, testMetrics.probeStatus)
+}
@@ -0,0 +1,87 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"time"
+)
+
+// ProbePolicy controls how connections that fail to authenticate are absorbed.
+// A fixed deadline and an unbounded drain are recognizable, so each port can be
+// tuned to resemble the services it shares a host with.
+type ProbePolicy struct {
+	// AuthTimeout is the deadline to authenticate and send the target address,
+	// counted from the time the connection is accepted.  Zero selects the
+	// timeout the service was created with.
+	AuthTimeout time.Duration
+	// AuthJitter adds a random duration in [0, AuthJitter) to the deadline of
+	// each connection.
+	AuthJitter time.Duration
+	// MaxBytes closes a probe once the client has sent this many bytes in
+	// total.  Zero means probes are absorbed until EOF or the deadline.
+	MaxBytes int64
+	// Reset closes probes with a RST, instead of a FIN.
+	Reset bool
+}
+
+// authTimeout returns the authentication timeout for a new connection.
+func (p *ProbePolicy) authTimeout(defaultTimeout time.Duration) time.Duration {
+	timeout := p.AuthTimeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	if p.AuthJitter > 0 {
+		timeout += time.Duration(rand.Int63n(int64(p.AuthJitter)))
+	}
+	return timeout
+}
+
+// closeStyle returns "rst" or "fin", for the metrics.
+func (p *ProbePolicy) closeStyle() string {
+	if p.Reset {
+		return "rst"
+	}
+	return "fin"
+}
+
+// absorb reads from `clientConn` until EOF, the read deadline, or the byte limit,
+// and returns which one ended the probe: "eof", "timeout", "max_bytes" or "other".
+// `received` is the number of bytes already read from the client.  If the policy
+// asks for a RST, it arranges for the next Close of `clientTCPConn` to send one.
+func (p *ProbePolicy) absorb(clientTCPConn *net.TCPConn, clientConn io.Reader, received int64) (string, error) {
+	if p.Reset {
+		clientTCPConn.SetLinger(0)
+	}
+	if p.MaxBytes <= 0 {
+		_, err := io.Copy(ioutil.Discard, clientConn)
+		return drainErrToString(err), err
+	}
+	if received >= p.MaxBytes {
+		return "max_bytes", nil
+	}
+	_, err := io.CopyN(ioutil.Discard, clientConn, p.MaxBytes-received)
+	switch err {
+	case nil:
+		return "max_bytes", nil
+	case io.EOF:
+		return "eof", nil
+	default:
+		return drainErrToString(err), err
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbePolicyAuthTimeout(t *testing.T) {
+	var policy ProbePolicy
+	require.Equal(t, 59*time.Second, policy.authTimeout(59*time.Second))
+
+	policy.AuthTimeout = 10 * time.Second
+	require.Equal(t, 10*time.Second, policy.authTimeout(59*time.Second))
+
+	policy.AuthJitter = 5 * time.Second
+	for i := 0; i < 100; i++ {
+		timeout := policy.authTimeout(59 * time.Second)
+		require.GreaterOrEqual(t, timeout, 10*time.Second)
+		require.Less(t, timeout, 15*time.Second)
+	}
+}
+
+// runProbePolicy sends `payload` to a service with `policy`, without closing the
+// connection, and returns how long it took until the read ended, and the error.
+func runProbePolicy(t *testing.T, policy ProbePolicy, payload []byte) (*probeTestMetrics, time.Duration, error) {
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 10*time.Second)
+	s.SetProbePolicy(policy)
+	go s.Serve(listener)
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+	start := time.Now()
+	_, err = conn.Write(payload)
+	require.NoError(t, err)
+	conn.SetReadDeadline(start.Add(5 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	elapsed := time.Since(start)
+	conn.Close()
+	s.GracefulStop()
+	return testMetrics, elapsed, err
+}
+
+func TestProbePolicyMaxBytesFIN(t *testing.T) {
+	testMetrics, elapsed, err := runProbePolicy(t, ProbePolicy{MaxBytes: 60}, ss.MakeTestPayload(60))
+	require.Equal(t, io.EOF, err)
+	require.Less(t, elapsed, 2*time.Second)
+	require.Equal(t, []string{"ERR_CIPHER"}, testMetrics.probeStatus)
+	require.Equal(t, []string{"max_bytes"}, testMetrics.probeResult)
+	require.Equal(t, []string{"fin"}, testMetrics.probeClose)
+	require.Equal(t, int64(60), testMetrics.probeData[0].ClientProxy)
+}
+
+func TestProbePolicyMaxBytesRST(t *testing.T) {
+	// The limit is reached while looking for the access key.
+	testMetrics, elapsed, err := runProbePolicy(t, ProbePolicy{MaxBytes: 10, Reset: true}, ss.MakeTestPayload(60))
+	require.True(t, errors.Is(err, syscall.ECONNRESET), "Expected connection reset, got %v", err)
+	require.Less(t, elapsed, 2*time.Second)
+	require.Equal(t, []string{"max_bytes"}, testMetrics.probeResult)
+	require.Equal(t, []string{"rst"}, testMetrics.probeClose)
+}
+
+func TestProbePolicyAuthDeadline(t *testing.T) {
+	policy := ProbePolicy{AuthTimeout: 100 * time.Millisecond, AuthJitter: 100 * time.Millisecond, MaxBytes: 1000}
+	testMetrics, elapsed, err := runProbePolicy(t, policy, ss.MakeTestPayload(60))
+	require.Equal(t, io.EOF, err)
+	require.GreaterOrEqual(t, elapsed, 100*time.Millisecond)
+	require.Less(t, elapsed, 2*time.Second)
+	require.Equal(t, []string{"timeout"}, testMetrics.probeResult)
+	require.Equal(t, []string{"fin"}, testMetrics.probeClose)
+}
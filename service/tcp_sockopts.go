@@ -0,0 +1,173 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// TCPSocketOptions tunes the TCP sockets of a port.  Zero values keep the
+// system defaults.  Except for the keepalive idle time, the options are only
+// supported on Linux, and are ignored elsewhere.
+type TCPSocketOptions struct {
+	// KeepAliveIdle, KeepAliveInterval and KeepAliveCount control the keepalive
+	// probes of client and target connections.
+	KeepAliveIdle     time.Duration
+	KeepAliveInterval time.Duration
+	KeepAliveCount    int
+	// Nagle enables Nagle's algorithm on client and target connections.  By
+	// default, Go disables it with TCP_NODELAY.
+	Nagle bool
+	// UserTimeout closes client and target connections if sent data remains
+	// unacknowledged for this long (TCP_USER_TIMEOUT).
+	UserTimeout time.Duration
+	// FastOpenQueue enables TCP Fast Open from clients, with this many pending
+	// connections that have not completed the handshake.
+	FastOpenQueue int
+	// FastOpenConnect uses TCP Fast Open when connecting to targets.  Once the
+	// kernel has a Fast Open cookie for a target, connecting returns at once and
+	// the handshake happens with the first write.  TCPTimeouts.Connect and
+	// ConnectAttempts then don't apply, and a refused connection is reported as
+	// a relay error instead of ERR_CONNECT.
+	FastOpenConnect bool
+	// MultipathTCP accepts Multipath TCP from clients.  It only takes effect when
+	// the listener is created.
+	MultipathTCP bool
+	// DSCP marks the packets to targets with this Differentiated Services code
+	// point, in the IPv4 TOS or IPv6 traffic class.
+	DSCP int
+}
+
+// Validate returns an error if an option is out of range.
+func (o *TCPSocketOptions) Validate() error {
+	if o.KeepAliveIdle < 0 || o.KeepAliveInterval < 0 || o.KeepAliveCount < 0 || o.UserTimeout < 0 || o.FastOpenQueue < 0 {
+		return errors.New("TCP socket options must not be negative")
+	}
+	if o.DSCP < 0 || o.DSCP > 63 {
+		return errors.New("DSCP must be between 0 and 63")
+	}
+	return nil
+}
+
+// rawControl calls `f` with the file descriptor of `c`.
+func rawControl(c syscall.RawConn, f func(fd int) error) error {
+	var err error
+	if controlErr := c.Control(func(fd uintptr) { err = f(int(fd)) }); controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// applyToConn sets the options of an established client or target connection.
+// `o` may be nil.
+func (o *TCPSocketOptions) applyToConn(conn *net.TCPConn) error {
+	conn.SetKeepAlive(true)
+	if o == nil {
+		return nil
+	}
+	if o.KeepAliveIdle > 0 {
+		conn.SetKeepAlivePeriod(o.KeepAliveIdle)
+	}
+	if o.Nagle {
+		conn.SetNoDelay(false)
+	}
+	if o.KeepAliveInterval == 0 && o.KeepAliveCount == 0 && o.UserTimeout == 0 {
+		return nil
+	}
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	return rawControl(rawConn, o.setConnOptions)
+}
+
+// applyToListener sets the options of a listener that can change while it is
+// open.  `o` may be nil.  `current` is the TCP Fast Open queue length that the
+// server set on the listener, or zero, and the new one is returned.  Listeners
+// that the server didn't configure, such as inherited sockets, keep their own
+// setting unless a queue length is configured.
+func (o *TCPSocketOptions) applyToListener(listener *net.TCPListener, current int) (int, error) {
+	var queue int
+	if o != nil {
+		queue = o.FastOpenQueue
+	}
+	if queue == current {
+		return current, nil
+	}
+	rawConn, err := listener.SyscallConn()
+	if err != nil {
+		return current, err
+	}
+	if err := rawControl(rawConn, func(fd int) error { return setFastOpenQueue(fd, queue) }); err != nil {
+		return current, err
+	}
+	return queue, nil
+}
+
+// dialControl returns the function to set the options of target sockets
+// before they connect, or nil if there are none.  `o` may be nil.
+func (o *TCPSocketOptions) dialControl() func(network, address string, c syscall.RawConn) error {
+	if o == nil || (!o.FastOpenConnect && o.DSCP == 0) {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return rawControl(c, func(fd int) error { return o.setDialOptions(network, fd) })
+	}
+}
+
+// ListenTCP opens a TCP listener on `addr` with the options of a port, which
+// may be nil.  If Multipath TCP is not available, it falls back to TCP.
+func ListenTCP(addr *net.TCPAddr, opts *TCPSocketOptions) (*net.TCPListener, error) {
+	return listenTCP(addr, opts, false)
+}
+
+func listenTCP(addr *net.TCPAddr, opts *TCPSocketOptions, reusePort bool) (*net.TCPListener, error) {
+	var listener *net.TCPListener
+	if opts != nil && opts.MultipathTCP {
+		var err error
+		if listener, err = listenMPTCP(addr, reusePort); err != nil {
+			logger.Warningf("Multipath TCP is not available, using TCP: %v", err)
+		}
+	}
+	if listener == nil {
+		var err error
+		if listener, err = listenPlainTCP(addr, reusePort); err != nil {
+			return nil, err
+		}
+	}
+	if opts != nil && opts.FastOpenQueue > 0 {
+		if _, err := opts.applyToListener(listener, 0); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	return listener, nil
+}
+
+func listenPlainTCP(addr *net.TCPAddr, reusePort bool) (*net.TCPListener, error) {
+	if !reusePort {
+		return net.ListenTCP("tcp", addr)
+	}
+	lc := net.ListenConfig{Control: reusePortControl}
+	listener, err := lc.Listen(context.Background(), "tcp", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
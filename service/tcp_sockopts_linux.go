@@ -0,0 +1,123 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// seconds rounds `d` up to whole seconds, as the keepalive options require.
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+func (o *TCPSocketOptions) setConnOptions(fd int) error {
+	if o.KeepAliveInterval > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds(o.KeepAliveInterval)); err != nil {
+			return os.NewSyscallError("setsockopt TCP_KEEPINTVL", err)
+		}
+	}
+	if o.KeepAliveCount > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_KEEPCNT, o.KeepAliveCount); err != nil {
+			return os.NewSyscallError("setsockopt TCP_KEEPCNT", err)
+		}
+	}
+	if o.UserTimeout > 0 {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, int(o.UserTimeout/time.Millisecond)); err != nil {
+			return os.NewSyscallError("setsockopt TCP_USER_TIMEOUT", err)
+		}
+	}
+	return nil
+}
+
+func (o *TCPSocketOptions) setDialOptions(network string, fd int) error {
+	if o.FastOpenConnect {
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT, 1); err != nil {
+			return os.NewSyscallError("setsockopt TCP_FASTOPEN_CONNECT", err)
+		}
+	}
+	if o.DSCP > 0 {
+		// The two low bits of the TOS byte are used for ECN.
+		tos := o.DSCP << 2
+		if network == "tcp6" {
+			if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos); err != nil {
+				return os.NewSyscallError("setsockopt IPV6_TCLASS", err)
+			}
+		} else if err := unix.SetsockoptInt(fd, unix.IPPROTO_IP, unix.IP_TOS, tos); err != nil {
+			return os.NewSyscallError("setsockopt IP_TOS", err)
+		}
+	}
+	return nil
+}
+
+func setFastOpenQueue(fd int, queue int) error {
+	if err := unix.SetsockoptInt(fd, unix.IPPROTO_TCP, unix.TCP_FASTOPEN, queue); err != nil {
+		return os.NewSyscallError("setsockopt TCP_FASTOPEN", err)
+	}
+	return nil
+}
+
+// listenMPTCP creates a Multipath TCP listener, which the net package cannot do
+// in the Go versions we support.
+func listenMPTCP(addr *net.TCPAddr, reusePort bool) (*net.TCPListener, error) {
+	family := unix.AF_INET6
+	var sockaddr unix.Sockaddr
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		family = unix.AF_INET
+		sockaddr4 := &unix.SockaddrInet4{Port: addr.Port}
+		copy(sockaddr4.Addr[:], ip4)
+		sockaddr = sockaddr4
+	} else {
+		sockaddr6 := &unix.SockaddrInet6{Port: addr.Port}
+		copy(sockaddr6.Addr[:], addr.IP.To16())
+		sockaddr = sockaddr6
+	}
+	fd, err := unix.Socket(family, unix.SOCK_STREAM|unix.SOCK_CLOEXEC, unix.IPPROTO_MPTCP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	file := os.NewFile(uintptr(fd), "mptcp")
+	// net.FileListener duplicates the descriptor.
+	defer file.Close()
+	if family == unix.AF_INET6 && addr.IP == nil {
+		// Accept IPv4 too, like the net package does for wildcard addresses.
+		if err := unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, 0); err != nil {
+			return nil, os.NewSyscallError("setsockopt IPV6_V6ONLY", err)
+		}
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt SO_REUSEADDR", err)
+	}
+	if reusePort {
+		if err := setReusePort(fd); err != nil {
+			return nil, err
+		}
+	}
+	if err := unix.Bind(fd, sockaddr); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := unix.Listen(fd, unix.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	return listener.(*net.TCPListener), nil
+}
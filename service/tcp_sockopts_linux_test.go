@@ -0,0 +1,197 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+// getsockopt returns an integer socket option of `conn`.
+func getsockopt(t *testing.T, conn syscall.Conn, level, opt int) int {
+	rawConn, err := conn.SyscallConn()
+	require.NoError(t, err)
+	var value int
+	require.NoError(t, rawControl(rawConn, func(fd int) error {
+		value, err = unix.GetsockoptInt(fd, level, opt)
+		return err
+	}))
+	return value
+}
+
+func TestTCPSocketOptionsConn(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	defer listener.Close()
+	clientConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer clientConn.Close()
+	conn, err := listener.AcceptTCP()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	opts := &TCPSocketOptions{
+		KeepAliveIdle:     2 * time.Minute,
+		KeepAliveInterval: 15 * time.Second,
+		KeepAliveCount:    4,
+		Nagle:             true,
+		UserTimeout:       30 * time.Second,
+	}
+	require.NoError(t, opts.applyToConn(conn))
+	require.Equal(t, 1, getsockopt(t, conn, unix.SOL_SOCKET, unix.SO_KEEPALIVE))
+	require.Equal(t, 120, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPIDLE))
+	require.Equal(t, 15, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL))
+	require.Equal(t, 4, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_KEEPCNT))
+	require.Equal(t, 0, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_NODELAY))
+	require.Equal(t, 30000, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT))
+
+	// Without options, only keepalive is set, and Go's default of TCP_NODELAY is kept.
+	require.NoError(t, (*TCPSocketOptions)(nil).applyToConn(clientConn))
+	require.Equal(t, 1, getsockopt(t, clientConn, unix.SOL_SOCKET, unix.SO_KEEPALIVE))
+	require.Equal(t, 1, getsockopt(t, clientConn, unix.IPPROTO_TCP, unix.TCP_NODELAY))
+}
+
+func TestTCPSocketOptionsDial(t *testing.T) {
+	listener := makeLocalhostListener(t)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	opts := &TCPSocketOptions{FastOpenConnect: true, DSCP: 46}
+	conn, connErr := (*EgressPolicy)(nil).dialTCP(context.Background(), listener.Addr().String(), allowAll, TCPTimeouts{}, opts)
+	require.Nil(t, connErr)
+	defer conn.Close()
+	require.Equal(t, 46<<2, getsockopt(t, conn, unix.IPPROTO_IP, unix.IP_TOS))
+	require.Equal(t, 1, getsockopt(t, conn, unix.IPPROTO_TCP, unix.TCP_FASTOPEN_CONNECT))
+
+	// The options also apply when the addresses are resolved by the policy.
+	conn, connErr = (*EgressPolicy)(nil).dialTCP(context.Background(), listener.Addr().String(), allowAll, TCPTimeouts{ConnectAttempts: 1}, opts)
+	require.Nil(t, connErr)
+	defer conn.Close()
+	require.Equal(t, 46<<2, getsockopt(t, conn, unix.IPPROTO_IP, unix.IP_TOS))
+}
+
+func TestListenTCPFastOpen(t *testing.T) {
+	listener, err := ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, &TCPSocketOptions{FastOpenQueue: 16})
+	require.NoError(t, err)
+	defer listener.Close()
+	require.Equal(t, 16, getsockopt(t, listener, unix.IPPROTO_TCP, unix.TCP_FASTOPEN))
+
+	// Without a queue length, the setting is only reset if the server set it.
+	current, err := (*TCPSocketOptions)(nil).applyToListener(listener, 0)
+	require.NoError(t, err)
+	require.Equal(t, 0, current)
+	require.Equal(t, 16, getsockopt(t, listener, unix.IPPROTO_TCP, unix.TCP_FASTOPEN))
+
+	current, err = (&TCPSocketOptions{FastOpenQueue: 32}).applyToListener(listener, 0)
+	require.NoError(t, err)
+	require.Equal(t, 32, current)
+	require.Equal(t, 32, getsockopt(t, listener, unix.IPPROTO_TCP, unix.TCP_FASTOPEN))
+
+	current, err = (*TCPSocketOptions)(nil).applyToListener(listener, current)
+	require.NoError(t, err)
+	require.Equal(t, 0, current)
+	require.Equal(t, 0, getsockopt(t, listener, unix.IPPROTO_TCP, unix.TCP_FASTOPEN))
+}
+
+// A reload without socket options leaves the TCP Fast Open setting of an
+// inherited listener alone.
+func TestTCPServiceKeepsInheritedFastOpen(t *testing.T) {
+	listener, err := ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, &TCPSocketOptions{FastOpenQueue: 16})
+	require.NoError(t, err)
+	s := NewTCPService(nil, nil, &probeTestMetrics{}, time.Second)
+	go s.Serve(listener)
+	defer s.Stop()
+	s.SetSocketOptions(&TCPSocketOptions{KeepAliveCount: 3})
+	s.SetSocketOptions(nil)
+	require.Equal(t, 16, getsockopt(t, listener, unix.IPPROTO_TCP, unix.TCP_FASTOPEN))
+}
+
+// Once the kernel has a Fast Open cookie for a target, connecting returns at
+// once, so a refused connection is only reported by the relay.
+func TestFastOpenConnectDefersErrors(t *testing.T) {
+	data, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	require.NoError(t, err)
+	if mode, err := strconv.Atoi(strings.TrimSpace(string(data))); err != nil || mode&3 != 3 {
+		t.Skip("TCP Fast Open is not enabled for both clients and servers")
+	}
+	listener, err := ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, &TCPSocketOptions{FastOpenQueue: 16})
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	opts := &TCPSocketOptions{FastOpenConnect: true}
+	timeouts := TCPTimeouts{Connect: time.Second, ConnectAttempts: 1}
+
+	// The first connection gets a cookie.
+	conn, connErr := (*EgressPolicy)(nil).dialTCP(context.Background(), addr, allowAll, timeouts, opts)
+	require.Nil(t, connErr)
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	conn.Close()
+	listener.Close()
+
+	conn, connErr = (*EgressPolicy)(nil).dialTCP(context.Background(), addr, allowAll, timeouts, opts)
+	require.Nil(t, connErr, "Connecting with a cookie should not wait for the handshake")
+	defer conn.Close()
+	// The request goes out with the SYN, and the refusal arrives afterwards.
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, syscall.ECONNREFUSED)
+
+	// Without Fast Open, the refusal is reported when connecting.
+	_, connErr = (*EgressPolicy)(nil).dialTCP(context.Background(), addr, allowAll, timeouts, nil)
+	require.NotNil(t, connErr)
+	require.Equal(t, "ERR_CONNECT", connErr.Status)
+}
+
+func TestListenTCPMultipath(t *testing.T) {
+	listener, err := ListenTCP(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, &TCPSocketOptions{MultipathTCP: true})
+	require.NoError(t, err)
+	defer listener.Close()
+	if getsockopt(t, listener, unix.SOL_SOCKET, unix.SO_PROTOCOL) != unix.IPPROTO_MPTCP {
+		t.Skip("Multipath TCP is not available")
+	}
+	clientConn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	defer clientConn.Close()
+	conn, err := listener.AcceptTCP()
+	require.NoError(t, err)
+	conn.Close()
+}
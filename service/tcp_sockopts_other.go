@@ -0,0 +1,38 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+
+package service
+
+import (
+	"errors"
+	"net"
+)
+
+func (o *TCPSocketOptions) setConnOptions(fd int) error {
+	return nil
+}
+
+func (o *TCPSocketOptions) setDialOptions(network string, fd int) error {
+	return nil
+}
+
+func setFastOpenQueue(fd int, queue int) error {
+	return nil
+}
+
+func listenMPTCP(addr *net.TCPAddr, reusePort bool) (*net.TCPListener, error) {
+	return nil, errors.New("Multipath TCP is only supported on Linux")
+}
@@ -0,0 +1,30 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTCPSocketOptionsValidate(t *testing.T) {
+	require.NoError(t, (&TCPSocketOptions{}).Validate())
+	require.NoError(t, (&TCPSocketOptions{KeepAliveIdle: time.Minute, KeepAliveCount: 3, DSCP: 46}).Validate())
+	require.Error(t, (&TCPSocketOptions{KeepAliveInterval: -time.Second}).Validate())
+	require.Error(t, (&TCPSocketOptions{FastOpenQueue: -1}).Validate())
+	require.Error(t, (&TCPSocketOptions{DSCP: 64}).Validate())
+}
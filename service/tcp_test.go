@@ -206,7 +206,7 @@ func BenchmarkTCPFindCipherRepeat(b *testing.B) {
 		cipher := cipherEntries[cipherNumber].Cipher
 		go ss.NewShadowsocksWriter(writer, cipher).Write(ss.MakeTestPayload(50))
 		b.StartTimer()
-		_, _, _, _, err := findAccessKey(&c, clientIP, cipherList)
+		_, _, _, _, _, err := findAccessKey(&c, clientIP, cipherList)
 		b.StopTimer()
 		if err != nil {
 			b.Error(err)
@@ -218,16 +218,28 @@ func BenchmarkTCPFindCipherRepeat(b *testing.B) {
 // Stub metrics implementation for testing replay defense.
 type probeTestMetrics struct {
 	metrics.ShadowsocksMetrics
-	mu          sync.Mutex
-	probeData   []metrics.ProxyMetrics
-	probeStatus []string
-	closeStatus []string
+	mu             sync.Mutex
+	probeData      []metrics.ProxyMetrics
+	probeStatus    []string
+	probeResult    []string
+	probeClose     []string
+	closeStatus    []string
+	fallbackData   []metrics.ProxyMetrics
+	fallbackStatus []string
 }
 
-func (m *probeTestMetrics) AddTCPProbe(status, drainResult string, port int, data metrics.ProxyMetrics) {
+func (m *probeTestMetrics) AddTCPProbe(status, drainResult, closeStyle string, port int, data metrics.ProxyMetrics) {
 	m.mu.Lock()
 	m.probeData = append(m.probeData, data)
 	m.probeStatus = append(m.probeStatus, status)
+	m.probeResult = append(m.probeResult, drainResult)
+	m.probeClose = append(m.probeClose, closeStyle)
+	m.mu.Unlock()
+}
+func (m *probeTestMetrics) AddTCPFallback(status string, data metrics.ProxyMetrics) {
+	m.mu.Lock()
+	m.fallbackData = append(m.fallbackData, data)
+	m.fallbackStatus = append(m.fallbackStatus, status)
 	m.mu.Unlock()
 }
 func (m *probeTestMetrics) AddClosedTCPConnection(clientIp, accessKey, status string, data metrics.ProxyMetrics, timeToCipher, duration time.Duration) {
@@ -247,8 +259,11 @@ func (m *probeTestMetrics) AddUDPPacketFromClient(clientIp, accessKey, status st
 }
 func (m *probeTestMetrics) AddUDPPacketFromTarget(clientIp, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
 }
-func (m *probeTestMetrics) AddUDPNatEntry()    {}
-func (m *probeTestMetrics) RemoveUDPNatEntry() {}
+func (m *probeTestMetrics) AddUDPNatEntry()                        {}
+func (m *probeTestMetrics) RemoveUDPNatEntry()                     {}
+func (m *probeTestMetrics) AddUDPNatEviction(limit string)         {}
+func (m *probeTestMetrics) AddUDPPacketDropped(reason string)      {}
+func (m *probeTestMetrics) AddCipherLookup(proto, affinity string) {}
 
 func (m *probeTestMetrics) countStatuses() map[string]int {
 	counts := make(map[string]int)
@@ -718,3 +733,38 @@ func TestTCPEarlyStop(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestTCPPadding(t *testing.T) {
+	echoListener := makeLocalhostListener(t)
+	defer echoListener.Close()
+	go func() {
+		conn, err := echoListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	s := NewTCPService(cipherList, nil, &probeTestMetrics{}, 5*time.Second)
+	s.SetTargetIPValidator(allowAll)
+	s.SetPadding(&ss.PaddingPolicy{MinChunks: 2, MaxChunks: 4, MinEmptyChunks: 1, MaxEmptyChunks: 3})
+	go s.Serve(listener)
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	cipher := firstCipher(cipherList)
+	ssw := ss.NewShadowsocksWriter(conn, cipher)
+	expected := ss.MakeTestPayload(1000)
+	_, err = ssw.Write(append(socks.ParseAddr(echoListener.Addr().String()), expected...))
+	require.NoError(t, err)
+	conn.CloseWrite()
+	response, err := ioutil.ReadAll(ss.NewShadowsocksReader(conn, cipher))
+	require.NoError(t, err)
+	require.Equal(t, expected, response)
+	conn.Close()
+	s.GracefulStop()
+}
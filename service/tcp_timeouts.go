@@ -0,0 +1,192 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
+
+	onet "github.com/Jigsaw-Code/outline-ss-server/net"
+)
+
+// TCPTimeouts limits the connection to the target and the lifetime of relayed
+// TCP connections.  Zero values disable each limit.
+type TCPTimeouts struct {
+	// Connect bounds each attempt to connect to a target address.
+	Connect time.Duration
+	// ConnectAttempts is the maximum number of resolved addresses of each
+	// family to try before giving up.  Zero means all of them.
+	ConnectAttempts int
+	// ClientIdle closes the connection if the proxy is waiting for data from
+	// the client, and no data has been relayed in either direction for this long.
+	ClientIdle time.Duration
+	// TargetIdle is like ClientIdle, for data from the target.
+	TargetIdle time.Duration
+	// MaxDuration closes the connection this long after it was accepted, even if
+	// it is active.
+	MaxDuration time.Duration
+}
+
+func (t *TCPTimeouts) limitsRelay() bool {
+	return t.ClientIdle > 0 || t.TargetIdle > 0 || t.MaxDuration > 0
+}
+
+// relayTimeoutError is returned by timeoutConn when a relay limit is reached.
+type relayTimeoutError struct {
+	msg string
+}
+
+func (e *relayTimeoutError) Error() string   { return e.msg }
+func (e *relayTimeoutError) Timeout() bool   { return true }
+func (e *relayTimeoutError) Temporary() bool { return false }
+
+var (
+	errIdleTimeout = &relayTimeoutError{"relay idle timeout"}
+	errMaxDuration = &relayTimeoutError{"relay maximum duration exceeded"}
+)
+
+// relayClock tracks the activity shared by both directions of a relay.
+type relayClock struct {
+	// Time of the last successful read in either direction, in UnixNano.
+	lastActivity int64
+	// Zero if there is no maximum duration.
+	end time.Time
+	// Set when one direction has timed out, to stop the other.
+	stopped int32
+}
+
+func newRelayClock(end time.Time) *relayClock {
+	c := &relayClock{end: end}
+	c.touch()
+	return c
+}
+
+func (c *relayClock) touch() {
+	atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
+}
+
+func (c *relayClock) last() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActivity))
+}
+
+// deadline returns the read deadline for a direction with the given idle timeout.
+func (c *relayClock) deadline(idle time.Duration) time.Time {
+	var deadline time.Time
+	if idle > 0 {
+		deadline = c.last().Add(idle)
+	}
+	if !c.end.IsZero() && (deadline.IsZero() || c.end.Before(deadline)) {
+		deadline = c.end
+	}
+	return deadline
+}
+
+// timeoutConn enforces an idle timeout and a maximum duration on reads.
+// Before its clock is set, it behaves exactly like the inner connection.
+type timeoutConn struct {
+	onet.DuplexConn
+	idle  time.Duration
+	clock *relayClock
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.clock == nil {
+		return c.DuplexConn.Read(b)
+	}
+	for {
+		c.DuplexConn.SetReadDeadline(c.clock.deadline(c.idle))
+		n, err := c.DuplexConn.Read(b)
+		if n > 0 {
+			c.clock.touch()
+		}
+		if done, err := c.checkLimits(n, err); done {
+			return n, err
+		}
+		// The other direction was active, so the deadline has moved.
+	}
+}
+
+// WaitRead implements shadowsocks.ReadWaiter, with the same limits as Read.
+func (c *timeoutConn) WaitRead() error {
+	if c.clock == nil {
+		return waitReadable(c.DuplexConn)
+	}
+	for {
+		c.DuplexConn.SetReadDeadline(c.clock.deadline(c.idle))
+		if done, err := c.checkLimits(0, waitReadable(c.DuplexConn)); done {
+			return err
+		}
+	}
+}
+
+// checkLimits returns the result of a read that returned `n` and `err`, or
+// false if the read should be retried with a new deadline.
+func (c *timeoutConn) checkLimits(n int, err error) (bool, error) {
+	if err == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+		return true, err
+	}
+	now := time.Now()
+	switch {
+	case !c.clock.end.IsZero() && !now.Before(c.clock.end):
+		return true, errMaxDuration
+	case atomic.LoadInt32(&c.clock.stopped) != 0:
+		return true, errIdleTimeout
+	case c.idle > 0 && now.Sub(c.clock.last()) >= c.idle:
+		return true, errIdleTimeout
+	case n > 0:
+		return true, nil
+	}
+	return false, nil
+}
+
+// stop makes pending and future reads on both connections fail.
+func (c *relayClock) stop(conns ...*timeoutConn) {
+	atomic.StoreInt32(&c.stopped, 1)
+	now := time.Now()
+	for _, conn := range conns {
+		conn.DuplexConn.SetReadDeadline(now)
+	}
+}
+
+// start applies the limits in `timeouts` to the client and target connections.
+func (c *relayClock) start(clientConn, targetConn *timeoutConn, timeouts TCPTimeouts) {
+	clientConn.idle, targetConn.idle = timeouts.ClientIdle, timeouts.TargetIdle
+	clientConn.clock, targetConn.clock = c, c
+	if !c.end.IsZero() {
+		// Writes may block forever if the peer stops reading.
+		clientConn.DuplexConn.SetWriteDeadline(c.end)
+		targetConn.DuplexConn.SetWriteDeadline(c.end)
+	}
+}
+
+func isRelayTimeout(err error) bool {
+	var timeoutErr *relayTimeoutError
+	return errors.As(err, &timeoutErr) || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// relayError converts an error from one direction of the relay into a
+// ConnectionError, with a distinct status if a relay limit was reached.
+func relayError(status, message string, err error) *onet.ConnectionError {
+	switch {
+	case errors.Is(err, errIdleTimeout):
+		return onet.NewConnectionError("ERR_IDLE_TIMEOUT", "Connection was idle for too long", err)
+	case errors.Is(err, errMaxDuration), errors.Is(err, os.ErrDeadlineExceeded):
+		// Write deadlines are only set for the maximum duration.
+		return onet.NewConnectionError("ERR_MAX_DURATION", "Connection exceeded its maximum duration", err)
+	}
+	return onet.NewConnectionError(status, message, err)
+}
@@ -0,0 +1,56 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// makeFullListener returns a localhost listener whose accept queue is full, so
+// that it drops new connection attempts.
+func makeFullListener(t *testing.T) *net.TCPListener {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	file := os.NewFile(uintptr(fd), "listener")
+	defer file.Close()
+	require.NoError(t, syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}))
+	require.NoError(t, syscall.Listen(fd, 0))
+	listener, err := net.FileListener(file)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	// With a backlog of 0, the queue holds one connection.
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return listener.(*net.TCPListener)
+}
+
+func TestTCPConnectTimeout(t *testing.T) {
+	listener := makeFullListener(t)
+	const timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, connErr := (*EgressPolicy)(nil).dialTCP(context.Background(), listener.Addr().String(), allowAll, TCPTimeouts{Connect: timeout, ConnectAttempts: 1}, nil)
+	require.NotNil(t, connErr)
+	require.Equal(t, "ERR_CONNECT_TIMEOUT", connErr.Status)
+	require.GreaterOrEqual(t, time.Since(start), timeout)
+	require.Less(t, time.Since(start), 10*timeout)
+}
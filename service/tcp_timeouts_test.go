@@ -0,0 +1,136 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+// Runs one proxied connection to an echo server with the given timeouts.
+// `send` is called with the encrypted client connection, and the close status
+// is returned.
+func relayWithTimeouts(t *testing.T, timeouts TCPTimeouts, send func(w io.Writer)) string {
+	echoListener := makeLocalhostListener(t)
+	defer echoListener.Close()
+	go func() {
+		conn, err := echoListener.AcceptTCP()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+
+	listener := makeLocalhostListener(t)
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	testMetrics := &probeTestMetrics{}
+	s := NewTCPService(cipherList, nil, testMetrics, 5*time.Second)
+	s.SetTargetIPValidator(allowAll)
+	s.SetTimeouts(timeouts)
+	go s.Serve(listener)
+
+	conn, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	require.NoError(t, err)
+	ssw := ss.NewShadowsocksWriter(conn, firstCipher(cipherList))
+	_, err = ssw.Write(socks.ParseAddr(echoListener.Addr().String()))
+	require.NoError(t, err)
+	send(ssw)
+	// Wait for the proxy to close the connection.
+	io.Copy(ioutil.Discard, conn)
+	conn.Close()
+	s.GracefulStop()
+
+	require.Len(t, testMetrics.closeStatus, 1)
+	return testMetrics.closeStatus[0]
+}
+
+func TestTCPIdleTimeout(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	start := time.Now()
+	status := relayWithTimeouts(t, TCPTimeouts{ClientIdle: idle, TargetIdle: idle}, func(w io.Writer) {})
+	require.Equal(t, "ERR_IDLE_TIMEOUT", status)
+	require.Less(t, time.Since(start), 10*idle)
+}
+
+func TestTCPIdleTimeoutActive(t *testing.T) {
+	// Echoed data keeps both directions active, so only the maximum duration applies.
+	const maxDuration = 300 * time.Millisecond
+	timeouts := TCPTimeouts{ClientIdle: 100 * time.Millisecond, MaxDuration: maxDuration}
+	start := time.Now()
+	status := relayWithTimeouts(t, timeouts, func(w io.Writer) {
+		for i := 0; i < 10; i++ {
+			if _, err := w.Write([]byte("ping")); err != nil {
+				return
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
+	require.Equal(t, "ERR_MAX_DURATION", status)
+	require.GreaterOrEqual(t, time.Since(start), maxDuration)
+}
+
+func TestTCPConnectAttempts(t *testing.T) {
+	// Nothing listens on this port.
+	listener := makeLocalhostListener(t)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	_, connErr := (*EgressPolicy)(nil).dialTCP(context.Background(), addr, allowAll, TCPTimeouts{Connect: time.Second, ConnectAttempts: 1}, nil)
+	require.NotNil(t, connErr)
+	require.Equal(t, "ERR_CONNECT", connErr.Status)
+}
+
+func TestTCPConnectAttemptsNextAddress(t *testing.T) {
+	// Only the second address of the target accepts connections.
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.2")})
+	if err != nil {
+		t.Skipf("Can't listen on a second loopback address: %v", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	defer func(original func(context.Context, string, string) ([]net.IP, error)) { lookupIP = original }(lookupIP)
+	lookupIP = func(ctx context.Context, network, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("127.0.0.2")}, nil
+	}
+	addr := net.JoinHostPort("target.example", strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+
+	conn, connErr := (*EgressPolicy)(nil).dialTCP(context.Background(), addr, allowAll, TCPTimeouts{Connect: time.Second, ConnectAttempts: 2}, nil)
+	require.Nil(t, connErr)
+	require.Equal(t, listener.Addr().String(), conn.RemoteAddr().String())
+	conn.Close()
+
+	_, connErr = (*EgressPolicy)(nil).dialTCP(context.Background(), addr, allowAll, TCPTimeouts{Connect: time.Second, ConnectAttempts: 1}, nil)
+	require.NotNil(t, connErr)
+	require.Equal(t, "ERR_CONNECT", connErr.Status)
+}
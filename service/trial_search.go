@@ -0,0 +1,105 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Searches of fewer entries than this are not worth splitting.
+const minParallelTrials = 128
+
+// Number of entries that a goroutine claims at a time.
+const trialChunkSize = 32
+
+// trialHelpers bounds the goroutines that help with searches, across all
+// ports.  The goroutine that starts a search always takes part, so searches
+// never wait for a helper.
+var trialHelpers = make(chan struct{}, runtime.GOMAXPROCS(0)-1)
+
+// trialSearch returns the index of the first of `n` entries accepted by a
+// trier, or -1 if there is none.  Large searches are split into chunks, which
+// are tried in order by the calling goroutine and any idle helpers.  Once an
+// entry is accepted, the later entries are skipped, but the earlier ones are
+// still tried, so the result is the same as a sequential search.
+// `newTrier` is called once for each goroutine, so that each trier can have
+// its own buffers.
+func trialSearch(n int, newTrier func() func(i int) bool) int {
+	if n < minParallelTrials || cap(trialHelpers) == 0 {
+		try := newTrier()
+		for i := 0; i < n; i++ {
+			if try(i) {
+				return i
+			}
+		}
+		return -1
+	}
+
+	var nextChunk atomic.Int64
+	var found atomic.Int64
+	found.Store(int64(n))
+	search := func(try func(i int) bool) {
+		for {
+			start := int(nextChunk.Add(trialChunkSize)) - trialChunkSize
+			if start >= n || int64(start) >= found.Load() {
+				return
+			}
+			end := start + trialChunkSize
+			if end > n {
+				end = n
+			}
+			for i := start; i < end && int64(i) < found.Load(); i++ {
+				if try(i) {
+					// Keep the lowest index, in case a later chunk matched first.
+					for {
+						current := found.Load()
+						if int64(i) >= current || found.CompareAndSwap(current, int64(i)) {
+							break
+						}
+					}
+					return
+				}
+			}
+		}
+	}
+
+	var helpers sync.WaitGroup
+	numChunks := (n + trialChunkSize - 1) / trialChunkSize
+addHelpers:
+	for h := 1; h < numChunks; h++ {
+		select {
+		case trialHelpers <- struct{}{}:
+			helpers.Add(1)
+			go func() {
+				defer func() {
+					<-trialHelpers
+					helpers.Done()
+				}()
+				search(newTrier())
+			}()
+		default:
+			break addHelpers
+		}
+	}
+	search(newTrier())
+	helpers.Wait()
+
+	if i := int(found.Load()); i < n {
+		return i
+	}
+	return -1
+}
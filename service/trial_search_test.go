@@ -0,0 +1,106 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func matchAt(indices ...int) func() func(int) bool {
+	return func() func(int) bool {
+		return func(i int) bool {
+			for _, index := range indices {
+				if i == index {
+					return true
+				}
+			}
+			return false
+		}
+	}
+}
+
+// withTrialHelpers allows `n` helpers during a test, regardless of the CPUs.
+func withTrialHelpers(t *testing.T, n int) {
+	saved := trialHelpers
+	trialHelpers = make(chan struct{}, n)
+	t.Cleanup(func() { trialHelpers = saved })
+}
+
+func TestTrialSearch(t *testing.T) {
+	withTrialHelpers(t, 3)
+	require.Equal(t, -1, trialSearch(0, matchAt()))
+	require.Equal(t, 3, trialSearch(10, matchAt(3, 5)))
+	require.Equal(t, -1, trialSearch(10, matchAt(10)))
+	const n = 10 * minParallelTrials
+	for i := 0; i < 20; i++ {
+		require.Equal(t, 300, trialSearch(n, matchAt(900, 300, n-1)))
+	}
+	require.Equal(t, n-1, trialSearch(n, matchAt(n-1)))
+	require.Equal(t, -1, trialSearch(n, matchAt()))
+	require.Equal(t, 0, len(trialHelpers))
+}
+
+func TestTrialSearchSkipsLaterEntries(t *testing.T) {
+	withTrialHelpers(t, 3)
+	const n = 100 * minParallelTrials
+	var tries atomic.Int64
+	found := trialSearch(n, func() func(int) bool {
+		return func(i int) bool {
+			tries.Add(1)
+			return i == 5
+		}
+	})
+	require.Equal(t, 5, found)
+	// Each goroutine may finish the chunk it claimed.
+	require.Less(t, tries.Load(), int64((cap(trialHelpers)+2)*trialChunkSize))
+}
+
+func TestFindAccessKeyUDPManyKeys(t *testing.T) {
+	withTrialHelpers(t, 3)
+	const numCiphers = 4 * minParallelTrials
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(numCiphers))
+	require.NoError(t, err)
+	snapshot := cipherList.SnapshotForClientIP(nil)
+	clientIP := net.ParseIP("192.0.2.1")
+	plaintext := ss.MakeTestPayload(50)
+	for _, i := range []int{0, numCiphers / 2, numCiphers - 1} {
+		expected := snapshot[i].Value.(*CipherEntry)
+		pkt, err := ss.Pack(make([]byte, serverUDPBufferSize), plaintext, expected.Cipher)
+		require.NoError(t, err)
+		buf := make([]byte, serverUDPBufferSize)
+		decrypted, entry, _, err := findAccessKeyUDP(clientIP, buf, pkt, cipherList)
+		require.NoError(t, err)
+		require.Equal(t, expected.ID, entry.ID)
+		require.Equal(t, plaintext, decrypted)
+	}
+}
+
+// Simulates receiving invalid UDP packets on a server with 5000 ciphers.
+func BenchmarkUDPUnpackFailManyKeys(b *testing.B) {
+	cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(5000))
+	require.NoError(b, err)
+	testPayload := ss.MakeTestPayload(50)
+	textBuf := make([]byte, serverUDPBufferSize)
+	testIP := net.ParseIP("192.0.2.1")
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		findAccessKeyUDP(testIP, textBuf, testPayload, cipherList)
+	}
+}
@@ -15,13 +15,18 @@
 package service
 
 import (
+	"container/list"
+	"encoding/binary"
 	"errors"
-	"fmt"
+	"hash/maphash"
 	"net"
+	"runtime"
 	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/Jigsaw-Code/outline-ss-server/internal/slicepool"
 	onet "github.com/Jigsaw-Code/outline-ss-server/net"
 	"github.com/Jigsaw-Code/outline-ss-server/service/metrics"
 	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
@@ -48,36 +53,81 @@ func debugUDPAddr(addr net.Addr, template string, val interface{}) {
 	}
 }
 
+// udpTrier decrypts a packet with each access key it is given, until one
+// authenticates.
+type udpTrier struct {
+	buf       []byte
+	plaintext []byte
+	found     int
+}
+
 // Decrypts src into dst. It tries each cipher until it finds one that authenticates
-// correctly. dst and src must not overlap.
-func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) ([]byte, string, *ss.Cipher, error) {
+// correctly. dst and src must not overlap.  Large searches run in parallel.
+func findAccessKeyUDP(clientIP net.IP, dst, src []byte, cipherList CipherList) ([]byte, *CipherEntry, CipherAffinity, error) {
 	// Try each cipher until we find one that authenticates successfully. This assumes that all ciphers are AEAD.
 	// We snapshot the list because it may be modified while we use it.
-	snapshot := cipherList.SnapshotForClientIP(clientIP)
-	for ci, entry := range snapshot {
-		id, cipher := entry.Value.(*CipherEntry).ID, entry.Value.(*CipherEntry).Cipher
-		buf, err := ss.Unpack(dst, src, cipher)
-		if err != nil {
-			debugUDP(id, "Failed to unpack: %v", err)
-			continue
+	ciphers := orderForClientIP(cipherList, clientIP)
+	var mu sync.Mutex
+	var triers []*udpTrier
+	ci := trialSearch(ciphers.len(), func() func(int) bool {
+		// Each goroutine of the search needs its own buffer.
+		t := &udpTrier{found: -1}
+		mu.Lock()
+		if len(triers) == 0 {
+			t.buf = dst
+		} else {
+			t.buf = make([]byte, len(dst))
+		}
+		triers = append(triers, t)
+		mu.Unlock()
+		return func(i int) bool {
+			elt := ciphers.at(i)
+			if elt == nil {
+				return false
+			}
+			entry := elt.Value.(*CipherEntry)
+			plaintext, err := ss.Unpack(t.buf, src, entry.Cipher)
+			if err != nil {
+				debugUDP(entry.ID, "Failed to unpack: %v", err)
+				return false
+			}
+			t.plaintext, t.found = plaintext, i
+			return true
+		}
+	})
+	if ci < 0 {
+		return nil, nil, NoAffinity, errors.New("could not find valid cipher")
+	}
+	var buf []byte
+	for _, t := range triers {
+		if t.found == ci {
+			buf = dst[:copy(dst, t.plaintext)]
 		}
-		debugUDP(id, "Found cipher at index %d", ci)
-		// Move the active cipher to the front, so that the search is quicker next time.
-		cipherList.MarkUsedByClientIP(entry, clientIP)
-		return buf, id, cipher, nil
 	}
-	return nil, "", nil, errors.New("could not find valid cipher")
+	elt := ciphers.at(ci)
+	entry := elt.Value.(*CipherEntry)
+	debugUDP(entry.ID, "Found cipher at index %d", ci)
+	// Move the active cipher to the front, so that the search is quicker next time.
+	affinity := cipherList.MarkUsedByClientIP(elt, clientIP)
+	return buf, entry, affinity, nil
 }
 
 type udpService struct {
-	mu                sync.RWMutex // Protects .clientConn and .stopped
+	mu                sync.RWMutex // Protects .clientConn, .stopped, .egress, .nat and .pipeline
 	clientConn        net.PacketConn
 	stopped           bool
+	egress            *EgressPolicy
+	nat               natPolicy
+	pipeline          UDPPipeline
 	natTimeout        time.Duration
 	ciphers           CipherList
 	m                 metrics.ShadowsocksMetrics
 	running           sync.WaitGroup
 	targetIPValidator onet.TargetIPValidator
+	// `replayCache` may be shared among all ports, but not with TCP.
+	replayCache *ReplayCache
+	// Read for every packet, so it is not guarded by mu.
+	proxyProto atomic.Pointer[ProxyProtocolPolicy]
 }
 
 // NewUDPService creates a UDPService
@@ -89,6 +139,27 @@ func NewUDPService(natTimeout time.Duration, cipherList CipherList, m metrics.Sh
 type UDPService interface {
 	// SetTargetIPValidator sets the function to be used to validate the target IP addresses.
 	SetTargetIPValidator(targetIPValidator onet.TargetIPValidator)
+	// SetReplayCache sets the cache used to detect replayed packets.  It must be
+	// called before Serve.  Packets are not checked if it is nil.
+	SetReplayCache(replayCache *ReplayCache)
+	// SetEgressPolicy sets the policy for resolving targets, unless the
+	// access key has its own.  It may be called while serving.
+	SetEgressPolicy(egress *EgressPolicy)
+	// SetNATLimits sets the limits on the NAT table.  New limits apply when
+	// entries are added, so it may be called while serving.
+	SetNATLimits(limits NATLimits)
+	// SetNATFiltering sets which packets from targets are relayed to the client.
+	// The filtering of existing NAT entries does not change.
+	SetNATFiltering(filtering NATFiltering)
+	// SetNATTimeouts sets the NAT timeout rules, unless the access key has its
+	// own.  The rules of existing NAT entries do not change.
+	SetNATTimeouts(timeouts *NATTimeoutPolicy)
+	// SetPipeline sets the number of workers and the queue lengths.  It must be
+	// called before Serve.
+	SetPipeline(pipeline UDPPipeline)
+	// SetProxyProtocol sets the sources that put a PROXY protocol v2 header at
+	// the start of each packet.  Nil disables them.  It may be called while serving.
+	SetProxyProtocol(policy *ProxyProtocolPolicy)
 	// Serve adopts the clientConn, and will not return until it is closed by Stop().
 	Serve(clientConn net.PacketConn) error
 	// Stop closes the clientConn and prevents further forwarding of packets.
@@ -101,6 +172,164 @@ func (s *udpService) SetTargetIPValidator(targetIPValidator onet.TargetIPValidat
 	s.targetIPValidator = targetIPValidator
 }
 
+func (s *udpService) SetReplayCache(replayCache *ReplayCache) {
+	s.replayCache = replayCache
+}
+
+func (s *udpService) SetEgressPolicy(egress *EgressPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.egress = egress
+}
+
+func (s *udpService) SetNATLimits(limits NATLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nat.limits = limits
+}
+
+func (s *udpService) SetNATFiltering(filtering NATFiltering) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nat.filtering = filtering
+}
+
+func (s *udpService) SetNATTimeouts(timeouts *NATTimeoutPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nat.timeouts = timeouts
+}
+
+// egressPolicy returns the policy for packets authenticated with `entry`.
+func (s *udpService) egressPolicy(entry *CipherEntry) *EgressPolicy {
+	if entry.Egress != nil {
+		return entry.Egress
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.egress
+}
+
+// UDPPipeline sizes the stages that process packets from clients.  A reader
+// passes each packet to a worker, which decrypts it, and then to the worker's
+// writer, which sends it to the target.  The packets from each client IP are
+// handled by the same worker, in order.
+type UDPPipeline struct {
+	// Workers is the number of workers and writers.  Zero means one per CPU.
+	Workers int
+	// QueueLen is the number of packets that may wait for each worker and for
+	// each writer.  Packets that arrive when the queue is full are dropped.
+	// Zero means 128.
+	QueueLen int
+	// BatchSize enables batched I/O on Linux, with up to this many packets per
+	// system call, and UDP GSO and GRO where the kernel supports them.  The
+	// client socket receives and sends in batches, and NAT sockets send in
+	// batches.  Zero or one disables batching.
+	BatchSize int
+}
+
+const defaultUDPQueueLen = 128
+
+func (p UDPPipeline) workers() int {
+	if p.Workers > 0 {
+		return p.Workers
+	}
+	return runtime.NumCPU()
+}
+
+func (p UDPPipeline) queueLen() int {
+	if p.QueueLen > 0 {
+		return p.QueueLen
+	}
+	return defaultUDPQueueLen
+}
+
+func (p UDPPipeline) batchSize() int {
+	if p.BatchSize > 1 {
+		return p.BatchSize
+	}
+	return 1
+}
+
+// Validate returns an error if the sizes are negative.
+func (p UDPPipeline) Validate() error {
+	if p.Workers < 0 || p.QueueLen < 0 || p.BatchSize < 0 {
+		return errors.New("UDP pipeline sizes must not be negative")
+	}
+	return nil
+}
+
+func (s *udpService) SetPipeline(pipeline UDPPipeline) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pipeline = pipeline
+}
+
+func (s *udpService) SetProxyProtocol(policy *ProxyProtocolPolicy) {
+	s.proxyProto.Store(policy)
+}
+
+// Size of the pooled buffers for packets queued between stages.  Larger
+// packets are rare, and get their own buffers.
+const pooledUDPBufferSize = 2048
+
+var udpBufferPool = sync.Pool{New: func() interface{} {
+	buf := make([]byte, pooledUDPBufferSize)
+	return &buf
+}}
+
+// getUDPBuffer returns a buffer of at least `size` bytes, which should be
+// returned with putUDPBuffer.
+func getUDPBuffer(size int) *[]byte {
+	if size > pooledUDPBufferSize {
+		buf := make([]byte, size)
+		return &buf
+	}
+	return udpBufferPool.Get().(*[]byte)
+}
+
+func putUDPBuffer(buf *[]byte) {
+	if buf != nil && cap(*buf) == pooledUDPBufferSize {
+		udpBufferPool.Put(buf)
+	}
+}
+
+// Buffer pool used for encrypting packets from targets, which may be up to
+// serverUDPBufferSize.
+var natBufPool = slicepool.MakePool(serverUDPBufferSize)
+
+// UDPBufferBytesInUse returns the memory held by the buffers that NAT entries
+// have acquired to relay packets from targets.
+func UDPBufferBytesInUse() int64 {
+	return natBufPool.BytesInUse()
+}
+
+// udpReadJob is a packet from a client, waiting for a worker.
+type udpReadJob struct {
+	clientAddr net.Addr
+	// The client address from a PROXY protocol header, or nil.
+	srcAddr *net.UDPAddr
+	buf     *[]byte
+	n       int
+}
+
+// udpWriteJob is the result of decrypting a packet, waiting for a writer.  The
+// writer sends the payload to the target, if there is no error, and reports
+// the metrics.  The zero value does nothing.
+type udpWriteJob struct {
+	connError        *onet.ConnectionError
+	clientAddr       net.Addr
+	clientIp         string
+	keyID            string
+	clientProxyBytes int
+	timeToCipher     time.Duration
+	targetConn       *natconn
+	payload          []byte
+	tgtUDPAddr       *net.UDPAddr
+	// Holds the payload, and is released after writing.
+	buf *[]byte
+}
+
 // Listen on addr for encrypted packets and basically do UDP NAT.
 // We take the ciphers as a pointer because it gets replaced on config updates.
 func (s *udpService) Serve(clientConn net.PacketConn) error {
@@ -115,114 +344,294 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 		return clientConn.Close()
 	}
 	s.clientConn = clientConn
+	pipeline := s.pipeline
 	s.running.Add(1)
 	s.mu.Unlock()
 	defer s.running.Done()
 
 	nm := newNATmap(s.natTimeout, s.m, &s.running)
 	defer nm.Close()
-	cipherBuf := make([]byte, serverUDPBufferSize)
-	textBuf := make([]byte, serverUDPBufferSize)
-
-	stopped := false
-	for !stopped {
-		func() (connError *onet.ConnectionError) {
-			defer func() {
-				if r := recover(); r != nil {
-					logger.Errorf("Panic in UDP loop: %v", r)
-					debug.PrintStack()
-				}
-			}()
+	// Responses are written to the client through `sender`.
+	var sender net.PacketConn = clientConn
+	if batchSender := newBatchSender(clientConn, pipeline.batchSize()); batchSender != nil {
+		defer batchSender.stop()
+		sender = batchSender
+	}
 
-			// Attempt to read an upstream packet.
-			clientProxyBytes, clientAddr, err := clientConn.ReadFrom(cipherBuf)
-			if err != nil {
-				s.mu.RLock()
-				stopped = s.stopped
-				s.mu.RUnlock()
-				if stopped {
-					return nil
+	var stages sync.WaitGroup
+	workers := make([]chan udpReadJob, pipeline.workers())
+	for i := range workers {
+		jobs := make(chan udpReadJob, pipeline.queueLen())
+		writes := make(chan udpWriteJob, pipeline.queueLen())
+		workers[i] = jobs
+		stages.Add(2)
+		go func() {
+			defer stages.Done()
+			defer close(writes)
+			for job := range jobs {
+				write := s.decrypt(job, sender, nm, pipeline.batchSize())
+				select {
+				case writes <- write:
+				default:
+					putUDPBuffer(write.buf)
+					s.m.AddUDPPacketDropped("writer_queue")
 				}
 			}
-
-			// An upstream packet should have been read.  Set up the metrics reporting
-			// for this forwarding event.
-			clientIp := ""
-			keyID := ""
-			var proxyTargetBytes int
-			var timeToCipher time.Duration
-			defer func() {
-				status := "OK"
-				if connError != nil {
-					logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
-					status = connError.Status
+		}()
+		go func() {
+			defer stages.Done()
+			batch := make([]udpWriteJob, 0, pipeline.batchSize())
+			for write := range writes {
+				batch = append(batch[:0], write)
+			gather:
+				for len(batch) < cap(batch) {
+					select {
+					case write, ok := <-writes:
+						if !ok {
+							break gather
+						}
+						batch = append(batch, write)
+					default:
+						break gather
+					}
 				}
-				s.m.AddUDPPacketFromClient(clientIp, keyID, status, clientProxyBytes, proxyTargetBytes, timeToCipher)
-			}()
+				s.writeBatch(batch)
+			}
+		}()
+	}
+	s.read(clientConn, newPacketReader(clientConn, pipeline.batchSize()), workers)
+	for _, jobs := range workers {
+		close(jobs)
+	}
+	stages.Wait()
+	return nil
+}
 
+// read passes the packets from clients to the workers until the service stops.
+func (s *udpService) read(clientConn net.PacketConn, reader packetReader, workers []chan udpReadJob) {
+	// The zero Hash picks a random seed, so clients can't choose their worker.
+	var hash maphash.Hash
+	for {
+		pkt, clientAddr, err := reader.readPacket()
+		clientProxyBytes := len(pkt)
+		if err != nil {
+			s.mu.RLock()
+			stopped := s.stopped
+			s.mu.RUnlock()
+			if stopped {
+				return
+			}
+			logger.Debugf("UDP Error: Failed to read from client: %v", err)
+			s.m.AddUDPPacketFromClient("", "", "ERR_READ", clientProxyBytes, 0, 0)
+			continue
+		}
+		var srcAddr *net.UDPAddr
+		if s.proxyProto.Load().trusts(clientAddr) {
+			src, headerLen, err := parseProxyHeader(pkt, false)
 			if err != nil {
-				return onet.NewConnectionError("ERR_READ", "Failed to read from client", err)
+				debugUDPAddr(clientAddr, "Failed to parse PROXY protocol header: %v", err)
+				s.m.AddUDPPacketFromClient("", "", "ERR_PROXY_PROTOCOL", clientProxyBytes, 0, 0)
+				continue
+			}
+			pkt = pkt[headerLen:]
+			clientProxyBytes = len(pkt)
+			if src != nil {
+				srcAddr = &net.UDPAddr{IP: src.IP, Port: src.Port}
 			}
-			if logger.IsEnabledFor(logging.DEBUG) {
-				defer logger.Debugf("UDP(%v): done", clientAddr)
-				logger.Debugf("UDP(%v): Outbound packet has %d bytes", clientAddr, clientProxyBytes)
+		}
+		hash.Reset()
+		if udpAddr, ok := clientAddr.(*net.UDPAddr); ok {
+			hash.Write(udpAddr.IP)
+			if srcAddr != nil {
+				// Spread the clients of a load balancer among the workers.  Packets from
+				// the same address still go to the same worker, to keep their order.
+				var port [2]byte
+				binary.BigEndian.PutUint16(port[:], uint16(udpAddr.Port))
+				hash.Write(port[:])
 			}
+		} else {
+			hash.WriteString(clientAddr.String())
+		}
+		buf := getUDPBuffer(clientProxyBytes)
+		copy(*buf, pkt)
+		select {
+		case workers[hash.Sum64()%uint64(len(workers))] <- udpReadJob{clientAddr, srcAddr, buf, clientProxyBytes}:
+		default:
+			putUDPBuffer(buf)
+			s.m.AddUDPPacketDropped("worker_queue")
+		}
+	}
+}
 
-			cipherData := cipherBuf[:clientProxyBytes]
-			var payload []byte
-			var tgtUDPAddr *net.UDPAddr
-			targetConn := nm.Get(clientAddr.String())
-			if targetConn == nil {
-				clientIp = s.m.GetIpAddress(clientAddr)
-				debugUDPAddr(clientAddr, "Got location \"%s\"", clientIp)
-
-				ip := clientAddr.(*net.UDPAddr).IP
-				var textData []byte
-				var cipher *ss.Cipher
-				unpackStart := time.Now()
-				textData, keyID, cipher, err = findAccessKeyUDP(ip, textBuf, cipherData, s.ciphers)
-				timeToCipher = time.Now().Sub(unpackStart)
-
-				if err != nil {
-					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack initial packet", err)
-				}
+// decrypt authenticates a packet from a client, finds or creates its NAT entry
+// and validates its target.
+func (s *udpService) decrypt(job udpReadJob, clientConn net.PacketConn, nm *natmap, batchSize int) (write udpWriteJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errorf("Panic in UDP loop: %v", r)
+			debug.PrintStack()
+			putUDPBuffer(write.buf)
+			write = udpWriteJob{}
+		}
+	}()
+	clientAddr := job.clientAddr
+	write.clientAddr = clientAddr
+	write.clientProxyBytes = job.n
+	if logger.IsEnabledFor(logging.DEBUG) {
+		logger.Debugf("UDP(%v): Outbound packet has %d bytes", clientAddr, job.n)
+	}
 
-				var onetErr *onet.ConnectionError
-				if payload, tgtUDPAddr, onetErr = s.validatePacket(textData); onetErr != nil {
-					return onetErr
-				}
+	cipherData := (*job.buf)[:job.n]
+	// Behind a load balancer, it may send the packets of several clients from
+	// the same address, so they are told apart by the PROXY protocol header.
+	natKey := clientAddr.String()
+	if job.srcAddr != nil {
+		natKey += "|" + job.srcAddr.String()
+	}
+	targetConn := nm.Get(natKey)
+	if targetConn == nil {
+		// Trial decryption can't be done in place, so the payload is in a new buffer.
+		defer putUDPBuffer(job.buf)
+		// Behind a load balancer, responses go to the load balancer, but the
+		// client is identified by the address in the PROXY protocol header.
+		srcAddr := clientAddr.(*net.UDPAddr)
+		if job.srcAddr != nil {
+			srcAddr = job.srcAddr
+		}
+		write.clientIp = s.m.GetIpAddress(srcAddr)
+		debugUDPAddr(clientAddr, "Got location \"%s\"", write.clientIp)
 
-				udpConn, err := net.ListenPacket("udp", "")
-				if err != nil {
-					return onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
-				}
-				targetConn = nm.Add(clientAddr, clientConn, cipher, udpConn, clientIp, keyID)
-			} else {
-				clientIp = targetConn.clientIp
-
-				unpackStart := time.Now()
-				textData, err := ss.Unpack(nil, cipherData, targetConn.cipher)
-				timeToCipher = time.Now().Sub(unpackStart)
-				if err != nil {
-					return onet.NewConnectionError("ERR_CIPHER", "Failed to unpack data from client", err)
-				}
+		ip := srcAddr.IP
+		write.buf = getUDPBuffer(job.n)
+		unpackStart := time.Now()
+		textData, entry, affinity, err := findAccessKeyUDP(ip, *write.buf, cipherData, s.ciphers)
+		write.timeToCipher = time.Now().Sub(unpackStart)
 
-				// The key ID is known with confidence once decryption succeeds.
-				keyID = targetConn.keyID
+		if err != nil {
+			write.connError = onet.NewConnectionError("ERR_CIPHER", "Failed to unpack initial packet", err)
+			return write
+		}
+		s.m.AddCipherLookup("udp", string(affinity))
+		write.keyID = entry.ID
+		if write.connError = s.checkReplay(entry.ID, entry.SaltGenerator, cipherData[:entry.Cipher.SaltSize()]); write.connError != nil {
+			return write
+		}
+		egress := s.egressPolicy(entry)
 
-				var onetErr *onet.ConnectionError
-				if payload, tgtUDPAddr, onetErr = s.validatePacket(textData); onetErr != nil {
-					return onetErr
-				}
-			}
+		if write.payload, write.tgtUDPAddr, write.connError = s.validatePacket(textData, egress); write.connError != nil {
+			return write
+		}
 
-			debugUDPAddr(clientAddr, "Proxy exit %v", targetConn.LocalAddr())
-			proxyTargetBytes, err = targetConn.WriteTo(payload, tgtUDPAddr) // accept only UDPAddr despite the signature
-			if err != nil {
-				return onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
+		udpConn, err := net.ListenPacket("udp", "")
+		if err != nil {
+			write.connError = onet.NewConnectionError("ERR_CREATE_SOCKET", "Failed to create UDP socket", err)
+			return write
+		}
+		s.mu.RLock()
+		policy := s.nat
+		s.mu.RUnlock()
+		if entry.NATTimeouts != nil {
+			policy.timeouts = entry.NATTimeouts
+		}
+		targetConn = nm.Add(natKey, clientAddr, ip, clientConn, entry, udpConn, write.clientIp, policy)
+		targetConn.egress = egress
+		targetConn.batch = newBatchConn(udpConn, batchSize, false)
+	} else {
+		// The packet is decrypted in place.
+		write.buf = job.buf
+		write.clientIp = targetConn.clientIp
+
+		unpackStart := time.Now()
+		textData, err := ss.Unpack(nil, cipherData, targetConn.cipher)
+		write.timeToCipher = time.Now().Sub(unpackStart)
+		if err != nil {
+			write.connError = onet.NewConnectionError("ERR_CIPHER", "Failed to unpack data from client", err)
+			return write
+		}
+
+		// The key ID is known with confidence once decryption succeeds.
+		write.keyID = targetConn.keyID
+		if write.connError = s.checkReplay(targetConn.keyID, targetConn.saltGenerator, cipherData[:targetConn.cipher.SaltSize()]); write.connError != nil {
+			return write
+		}
+
+		if write.payload, write.tgtUDPAddr, write.connError = s.validatePacket(textData, targetConn.egress); write.connError != nil {
+			return write
+		}
+	}
+	write.targetConn = targetConn
+	return write
+}
+
+// writeBatch sends decrypted packets to their targets.  Consecutive packets
+// through the same batching NAT entry are sent together.
+func (s *udpService) writeBatch(writes []udpWriteJob) {
+	for start := 0; start < len(writes); {
+		end := start + 1
+		if targetConn := writes[start].targetConn; writes[start].connError == nil && targetConn != nil && targetConn.batch != nil {
+			for end < len(writes) && writes[end].connError == nil && writes[end].targetConn == targetConn {
+				end++
 			}
-			return nil
-		}()
+		}
+		s.write(writes[start:end])
+		start = end
+	}
+}
+
+// write sends decrypted packets for the same NAT entry to their targets, and
+// reports the metrics.  All the packets have the same error, if any.
+func (s *udpService) write(writes []udpWriteJob) {
+	first := writes[0]
+	if first.connError == nil && first.targetConn == nil {
+		return
+	}
+	if first.connError == nil && first.targetConn.evicted.Load() {
+		// The entry was evicted while the packets were queued.
+		for _, write := range writes {
+			s.m.AddUDPPacketDropped("evicted")
+			putUDPBuffer(write.buf)
+		}
+		return
+	}
+	connError := first.connError
+	if connError == nil {
+		debugUDPAddr(first.clientAddr, "Proxy exit %v", first.targetConn.LocalAddr())
+		var err error
+		if len(writes) == 1 {
+			_, err = first.targetConn.WriteTo(first.payload, first.tgtUDPAddr) // accept only UDPAddr despite the signature
+		} else {
+			err = first.targetConn.writeBatch(writes)
+		}
+		if err != nil {
+			connError = onet.NewConnectionError("ERR_WRITE", "Failed to write to target", err)
+		}
+	}
+	status := "OK"
+	if connError != nil {
+		logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
+		status = connError.Status
+	}
+	for _, write := range writes {
+		var proxyTargetBytes int
+		if connError == nil {
+			proxyTargetBytes = len(write.payload)
+		}
+		s.m.AddUDPPacketFromClient(write.clientIp, write.keyID, status, write.clientProxyBytes, proxyTargetBytes, write.timeToCipher)
+		putUDPBuffer(write.buf)
+	}
+	debugUDPAddr(first.clientAddr, "done%v", "")
+}
+
+// checkReplay returns an error if the salt of an authenticated packet was
+// generated by this server, or has been seen recently.
+func (s *udpService) checkReplay(keyID string, saltGenerator ServerSaltGenerator, salt []byte) *onet.ConnectionError {
+	if saltGenerator.IsServerSalt(salt) {
+		s.m.AddUDPPacketDropped("replay_server")
+		return onet.NewConnectionError("ERR_REPLAY_SERVER", "Reflected packet detected", nil)
+	}
+	if !s.replayCache.Add(keyID, salt) {
+		s.m.AddUDPPacketDropped("replay_client")
+		return onet.NewConnectionError("ERR_REPLAY_CLIENT", "Replayed packet detected", nil)
 	}
 	return nil
 }
@@ -230,17 +639,14 @@ func (s *udpService) Serve(clientConn net.PacketConn) error {
 // Given the decrypted contents of a UDP packet, return
 // the payload and the destination address, or an error if
 // this packet cannot or should not be forwarded.
-func (s *udpService) validatePacket(textData []byte) ([]byte, *net.UDPAddr, *onet.ConnectionError) {
+func (s *udpService) validatePacket(textData []byte, egress *EgressPolicy) ([]byte, *net.UDPAddr, *onet.ConnectionError) {
 	tgtAddr := socks.SplitAddr(textData)
 	if tgtAddr == nil {
 		return nil, nil, onet.NewConnectionError("ERR_READ_ADDRESS", "Failed to get target address", nil)
 	}
 
-	tgtUDPAddr, err := net.ResolveUDPAddr("udp", tgtAddr.String())
+	tgtUDPAddr, err := egress.resolveUDP(tgtAddr.String(), s.targetIPValidator)
 	if err != nil {
-		return nil, nil, onet.NewConnectionError("ERR_RESOLVE_ADDRESS", fmt.Sprintf("Failed to resolve target address %v", tgtAddr), err)
-	}
-	if err := s.targetIPValidator(tgtUDPAddr.IP); err != nil {
 		return nil, nil, err
 	}
 
@@ -264,42 +670,55 @@ func (s *udpService) GracefulStop() error {
 	return err
 }
 
-func isDNS(addr net.Addr) bool {
-	_, port, _ := net.SplitHostPort(addr.String())
-	return port == "53"
-}
-
 type natconn struct {
 	net.PacketConn
 	cipher *ss.Cipher
 	keyID  string
+	// Marks the salts of downstream packets, to detect reflected packets.
+	saltGenerator ServerSaltGenerator
+	// Policy for resolving targets, determined when the entry is created.
+	egress *EgressPolicy
 	// We store the client location in the NAT map to avoid recomputing it
 	// for every downstream packet in a UDP-based connection.
 	clientIp string
-	// NAT timeout to apply for non-DNS packets.
+	// NAT timeout to apply for destinations that match no rule.
 	defaultTimeout time.Duration
+	// Rules for the NAT timeout, by destination.
+	timeouts *NATTimeoutPolicy
 	// Current read deadline of PacketConn.  Used to avoid decreasing the
 	// deadline.  Initially zero.
 	readDeadline time.Time
-	// If the connection has only sent one DNS query, it will close
-	// if it receives a DNS response.
+	// If the connection has only sent one packet, to a destination with fast
+	// close, it will close if it receives a response from such a destination.
 	fastClose sync.Once
+	// Destinations the client has sent to, or nil if all sources are allowed.
+	filter *natFilter
+	// Sends packets to targets in batches, or nil.
+	batch batchConn
+	// Position in the NAT table.  Guarded by natmap.lruMu.
+	elements natElements
+	// Set when a NAT limit evicts the entry.  Packets for it that are still
+	// queued are dropped, so that they don't keep its socket open.
+	evicted atomic.Bool
 }
 
 func (c *natconn) onWrite(addr net.Addr) {
+	if c.evicted.Load() {
+		// The copy loop must stop at the deadline set on eviction.
+		return
+	}
+	rule := c.timeouts.match(addr)
 	// Fast close is only allowed if there has been exactly one write,
-	// and it was a DNS query.
-	isDNS := isDNS(addr)
+	// and its destination allows fast close.
 	isFirstWrite := c.readDeadline.IsZero()
-	if !isDNS || !isFirstWrite {
+	if rule == nil || !rule.FastClose || !isFirstWrite {
 		// Disable fast close.  (Idempotent.)
 		c.fastClose.Do(func() {})
 	}
 
 	timeout := c.defaultTimeout
-	if isDNS {
-		// Shorten timeout as required by RFC 5452 Section 10.
-		timeout = 17 * time.Second
+	if rule != nil && rule.Timeout > 0 {
+		timeout = rule.Timeout
 	}
 
 	newDeadline := time.Now().Add(timeout)
@@ -311,7 +730,7 @@ func (c *natconn) onWrite(addr net.Addr) {
 
 func (c *natconn) onRead(addr net.Addr) {
 	c.fastClose.Do(func() {
-		if isDNS(addr) {
+		if rule := c.timeouts.match(addr); rule != nil && rule.FastClose {
 			// The next ReadFrom() should time out immediately.
 			c.SetReadDeadline(time.Now())
 		}
@@ -320,91 +739,257 @@ func (c *natconn) onRead(addr net.Addr) {
 
 func (c *natconn) WriteTo(buf []byte, dst net.Addr) (int, error) {
 	c.onWrite(dst)
+	c.filter.onWrite(dst)
 	return c.PacketConn.WriteTo(buf, dst)
 }
 
+// writeBatch sends the payloads of `writes` to their targets.
+func (c *natconn) writeBatch(writes []udpWriteJob) error {
+	pkts := make([]udpPacket, len(writes))
+	for i, write := range writes {
+		c.onWrite(write.tgtUDPAddr)
+		c.filter.onWrite(write.tgtUDPAddr)
+		pkts[i] = udpPacket{write.payload, write.tgtUDPAddr}
+	}
+	return c.batch.writeBatch(pkts)
+}
+
 func (c *natconn) ReadFrom(buf []byte) (int, net.Addr, error) {
 	n, addr, err := c.PacketConn.ReadFrom(buf)
 	if err == nil {
+		if !c.filter.allows(addr) {
+			return n, addr, errNATFiltered
+		}
 		c.onRead(addr)
 	}
 	return n, addr, err
 }
 
-// Packet NAT table
-type natmap struct {
+// errNATFiltered is returned by natconn.ReadFrom for a packet from a source
+// that the client has not sent to.
+var errNATFiltered = errors.New("packet source is not an allowed destination")
+
+// NATLimits bounds the number of entries in the UDP NAT table.  Each entry
+// holds an OS socket, so these limits prevent a client that sends from many
+// source ports from exhausting file descriptors.  When a limit is reached, the
+// least recently used entry within the limit is evicted.  Zero means no limit.
+type NATLimits struct {
+	// MaxEntries limits the total number of entries.
+	MaxEntries int
+	// MaxEntriesPerClientIP limits the entries for each client IP address.
+	MaxEntriesPerClientIP int
+	// MaxEntriesPerKey limits the entries for each access key.
+	MaxEntriesPerKey int
+}
+
+// natPolicy holds the settings for new NAT entries.
+type natPolicy struct {
+	limits    NATLimits
+	filtering NATFiltering
+	timeouts  *NATTimeoutPolicy
+}
+
+// Number of shards of the NAT table, so that lookups for different clients
+// rarely wait for each other.
+const natShards = 16
+
+type natShard struct {
 	sync.RWMutex
 	keyConn map[string]*natconn
+}
+
+// Packet NAT table
+type natmap struct {
+	seed   maphash.Seed
+	shards [natShards]natShard
+	// Protects the LRU lists and the elements of each entry.  It is acquired
+	// before the shard locks.
+	lruMu sync.Mutex
+	// Entries ordered by last upstream packet, most recent first.  An entry is
+	// in all three orders.
+	lru      *list.List
+	clientIP map[string]*list.List
+	key      map[string]*list.List
+	// The entry most recently moved to the front of the lists, so that a
+	// client sending many packets in a row does not need lruMu.
+	front   atomic.Pointer[natconn]
 	timeout time.Duration
 	metrics metrics.ShadowsocksMetrics
 	running *sync.WaitGroup
 }
 
+// natElements locates a natconn in the LRU lists of the natmap.
+type natElements struct {
+	mapKey, clientIP, keyID  string
+	lru, byClientIP, byKeyID *list.Element
+}
+
 func newNATmap(timeout time.Duration, sm metrics.ShadowsocksMetrics, running *sync.WaitGroup) *natmap {
-	m := &natmap{metrics: sm, running: running}
-	m.keyConn = make(map[string]*natconn)
+	m := &natmap{seed: maphash.MakeSeed(), metrics: sm, running: running}
+	for i := range m.shards {
+		m.shards[i].keyConn = make(map[string]*natconn)
+	}
+	m.lru = list.New()
+	m.clientIP = make(map[string]*list.List)
+	m.key = make(map[string]*list.List)
 	m.timeout = timeout
 	return m
 }
 
+func (m *natmap) shard(key string) *natShard {
+	return &m.shards[maphash.String(m.seed, key)%natShards]
+}
+
+// Get returns the entry for `key` and marks it as recently used.
 func (m *natmap) Get(key string) *natconn {
-	m.RLock()
-	defer m.RUnlock()
-	return m.keyConn[key]
+	shard := m.shard(key)
+	shard.RLock()
+	entry := shard.keyConn[key]
+	shard.RUnlock()
+	if entry == nil || m.front.Load() == entry {
+		return entry
+	}
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
+	// The entry may have been removed since the lookup.
+	if entry.elements.lru != nil {
+		m.lru.MoveToFront(entry.elements.lru)
+		m.clientIP[entry.elements.clientIP].MoveToFront(entry.elements.byClientIP)
+		m.key[entry.elements.keyID].MoveToFront(entry.elements.byKeyID)
+		m.front.Store(entry)
+	}
+	return entry
 }
 
-func (m *natmap) set(key string, pc net.PacketConn, cipher *ss.Cipher, keyID, clientIp string) *natconn {
+func pushFront(lists map[string]*list.List, name string, entry *natconn) *list.Element {
+	l := lists[name]
+	if l == nil {
+		l = list.New()
+		lists[name] = l
+	}
+	return l.PushFront(entry)
+}
+
+func removeElement(lists map[string]*list.List, name string, elt *list.Element) {
+	l := lists[name]
+	l.Remove(elt)
+	if l.Len() == 0 {
+		delete(lists, name)
+	}
+}
+
+// evictFrom evicts the least recently used entries in `l` until it has fewer
+// than `max` entries.  The caller must hold lruMu.
+func (m *natmap) evictFrom(l *list.List, max int, limit string) {
+	for max > 0 && l != nil && l.Len() >= max {
+		entry := l.Back().Value.(*natconn)
+		m.remove(entry)
+		entry.evicted.Store(true)
+		// The copy loop will stop and close the socket.
+		entry.SetReadDeadline(time.Now())
+		m.metrics.AddUDPNatEviction(limit)
+	}
+}
+
+func (m *natmap) set(key, clientIP string, pc net.PacketConn, cipherEntry *CipherEntry, clientLocation string, policy natPolicy) *natconn {
+	keyID := cipherEntry.ID
 	entry := &natconn{
 		PacketConn:     pc,
-		cipher:         cipher,
+		cipher:         cipherEntry.Cipher,
 		keyID:          keyID,
-		clientIp:       clientIp,
+		saltGenerator:  cipherEntry.SaltGenerator,
+		clientIp:       clientLocation,
 		defaultTimeout: m.timeout,
+		timeouts:       policy.timeouts,
+		filter:         newNATFilter(policy.filtering),
 	}
+	limits := policy.limits
+
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
 
-	m.Lock()
-	defer m.Unlock()
+	shard := m.shard(key)
+	shard.RLock()
+	old := shard.keyConn[key]
+	shard.RUnlock()
+	if old != nil {
+		m.remove(old)
+	}
+	m.evictFrom(m.clientIP[clientIP], limits.MaxEntriesPerClientIP, "client_ip")
+	m.evictFrom(m.key[keyID], limits.MaxEntriesPerKey, "access_key")
+	m.evictFrom(m.lru, limits.MaxEntries, "total")
 
-	m.keyConn[key] = entry
+	entry.elements = natElements{
+		mapKey:     key,
+		clientIP:   clientIP,
+		keyID:      keyID,
+		lru:        m.lru.PushFront(entry),
+		byClientIP: pushFront(m.clientIP, clientIP, entry),
+		byKeyID:    pushFront(m.key, keyID, entry),
+	}
+	m.front.Store(entry)
+	shard.Lock()
+	shard.keyConn[key] = entry
+	shard.Unlock()
 	return entry
 }
 
-func (m *natmap) del(key string) net.PacketConn {
-	m.Lock()
-	defer m.Unlock()
+// remove deletes `entry` from the table.  The caller must hold lruMu.
+func (m *natmap) remove(entry *natconn) {
+	shard := m.shard(entry.elements.mapKey)
+	shard.Lock()
+	delete(shard.keyConn, entry.elements.mapKey)
+	shard.Unlock()
+	m.lru.Remove(entry.elements.lru)
+	removeElement(m.clientIP, entry.elements.clientIP, entry.elements.byClientIP)
+	removeElement(m.key, entry.elements.keyID, entry.elements.byKeyID)
+	entry.elements.lru = nil
+	m.front.CompareAndSwap(entry, nil)
+}
+
+// del removes `entry` from the table, unless it was already replaced or evicted.
+func (m *natmap) del(entry *natconn) {
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
 
-	entry, ok := m.keyConn[key]
-	if ok {
-		delete(m.keyConn, key)
-		return entry
+	if entry.elements.lru != nil {
+		m.remove(entry)
 	}
-	return nil
 }
 
-func (m *natmap) Add(clientAddr net.Addr, clientConn net.PacketConn, cipher *ss.Cipher, targetConn net.PacketConn, clientIp, keyID string) *natconn {
-	entry := m.set(clientAddr.String(), targetConn, cipher, keyID, clientIp)
+// Len returns the number of entries in the table.
+func (m *natmap) Len() int {
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
+	return m.lru.Len()
+}
+
+// Add creates the NAT entry `key` for packets from `clientAddr`, where responses
+// are sent.  Limits per client IP apply to `clientIP`, which differs from the
+// address if the client is behind a load balancer.
+func (m *natmap) Add(key string, clientAddr net.Addr, clientIP net.IP, clientConn net.PacketConn, cipherEntry *CipherEntry, targetConn net.PacketConn, clientIp string, policy natPolicy) *natconn {
+	entry := m.set(key, clientIP.String(), targetConn, cipherEntry, clientIp, policy)
 
 	m.metrics.AddUDPNatEntry()
 	m.running.Add(1)
 	go func() {
-		timedCopy(clientAddr, clientConn, entry, keyID, m.metrics)
+		timedCopy(clientAddr, clientConn, entry, m.metrics)
 		m.metrics.RemoveUDPNatEntry()
-		if pc := m.del(clientAddr.String()); pc != nil {
-			pc.Close()
-		}
+		m.del(entry)
+		entry.Close()
 		m.running.Done()
 	}()
 	return entry
 }
 
 func (m *natmap) Close() error {
-	m.Lock()
-	defer m.Unlock()
+	m.lruMu.Lock()
+	defer m.lruMu.Unlock()
 
 	var err error
 	now := time.Now()
-	for _, pc := range m.keyConn {
-		if e := pc.SetReadDeadline(now); e != nil {
+	for e := m.lru.Front(); e != nil; e = e.Next() {
+		if e := e.Value.(*natconn).SetReadDeadline(now); e != nil {
 			err = e
 		}
 	}
@@ -417,11 +1002,12 @@ var maxAddrLen int = len(socks.ParseAddr("[2001:db8::1]:12345"))
 
 // copy from target to client until read timeout
 func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natconn,
-	keyID string, sm metrics.ShadowsocksMetrics) {
+	sm metrics.ShadowsocksMetrics) {
 	// pkt is used for in-place encryption of downstream UDP packets, with the layout
 	// [padding?][salt][address][body][tag][extra]
 	// Padding is only used if the address is IPv4.
-	pkt := make([]byte, serverUDPBufferSize)
+	// It is only held while a packet is relayed, so idle entries don't use it.
+	lazyPkt := natBufPool.LazySlice()
 
 	saltSize := targetConn.cipher.SaltSize()
 	// Leave enough room at the beginning of the packet for a max-length header (i.e. IPv6).
@@ -429,17 +1015,23 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 
 	expired := false
 	for {
+		filtered := false
 		var bodyLen, proxyClientBytes int
 		connError := func() (connError *onet.ConnectionError) {
 			var (
 				raddr net.Addr
 				err   error
 			)
-			// `readBuf` receives the plaintext body in `pkt`:
-			// [padding?][salt][address][body][tag][unused]
-			// |--     bodyStart     --|[      readBuf    ]
-			readBuf := pkt[bodyStart:]
-			bodyLen, raddr, err = targetConn.ReadFrom(readBuf)
+			var pkt []byte
+			// Wait for a packet before acquiring the buffer.
+			if err = waitReadable(targetConn.PacketConn); err == nil {
+				pkt = lazyPkt.Acquire()
+				// `readBuf` receives the plaintext body in `pkt`:
+				// [padding?][salt][address][body][tag][unused]
+				// |--     bodyStart     --|[      readBuf    ]
+				readBuf := pkt[bodyStart:]
+				bodyLen, raddr, err = targetConn.ReadFrom(readBuf)
+			}
 			if err != nil {
 				if netErr, ok := err.(net.Error); ok {
 					if netErr.Timeout() {
@@ -447,6 +1039,11 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 						return nil
 					}
 				}
+				if errors.Is(err, errNATFiltered) {
+					debugUDPAddr(clientAddr, "Filtered packet from %v", raddr)
+					filtered = true
+					return nil
+				}
 				return onet.NewConnectionError("ERR_READ", "Failed to read from target", err)
 			}
 
@@ -467,7 +1064,7 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			//           [            packBuf             ]
 			//           [          buf           ]
 			packBuf := pkt[saltStart:]
-			buf, err := ss.Pack(packBuf, plaintextBuf, targetConn.cipher) // Encrypt in-place
+			buf, err := ss.PackWithSaltGenerator(packBuf, plaintextBuf, targetConn.cipher, targetConn.saltGenerator) // Encrypt in-place
 			if err != nil {
 				return onet.NewConnectionError("ERR_PACK", "Failed to pack data to client", err)
 			}
@@ -477,6 +1074,7 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 			}
 			return nil
 		}()
+		lazyPkt.Release()
 		status := "OK"
 		if connError != nil {
 			logger.Debugf("UDP Error: %v: %v", connError.Message, connError.Cause)
@@ -485,6 +1083,10 @@ func timedCopy(clientAddr net.Addr, clientConn net.PacketConn, targetConn *natco
 		if expired {
 			break
 		}
-		sm.AddUDPPacketFromTarget(targetConn.clientIp, keyID, status, bodyLen, proxyClientBytes)
+		if filtered {
+			sm.AddUDPPacketDropped("nat_filtering")
+			continue
+		}
+		sm.AddUDPPacketFromTarget(targetConn.clientIp, targetConn.keyID, status, bodyLen, proxyClientBytes)
 	}
 }
@@ -0,0 +1,138 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"sync"
+)
+
+// udpPacket is a packet to send in a batch.
+type udpPacket struct {
+	payload []byte
+	addr    net.Addr
+}
+
+// batchConn moves several packets per system call on a UDP socket.  It is
+// only available on Linux.  A batchConn may be used by one reader and one
+// writer at a time.
+type batchConn interface {
+	// readPacket returns the next packet, which is valid until the next call.
+	// The packets are received in batches, and packets coalesced by GRO are
+	// split again.
+	readPacket() ([]byte, net.Addr, error)
+	// writeBatch sends the packets in order, coalescing runs of packets to the
+	// same destination with GSO.  It returns the first error, after trying to
+	// send the other packets.
+	writeBatch(pkts []udpPacket) error
+}
+
+// packetReader returns the packets from a socket one at a time.
+type packetReader interface {
+	// readPacket returns the next packet, which is valid until the next call.
+	readPacket() ([]byte, net.Addr, error)
+}
+
+// singleReader reads one packet per system call.
+type singleReader struct {
+	conn net.PacketConn
+	buf  []byte
+}
+
+func (r *singleReader) readPacket() ([]byte, net.Addr, error) {
+	n, addr, err := r.conn.ReadFrom(r.buf)
+	return r.buf[:n], addr, err
+}
+
+// newPacketReader returns a reader that receives batches of up to `batchSize`
+// packets from `conn`, if possible, or one at a time otherwise.
+func newPacketReader(conn net.PacketConn, batchSize int) packetReader {
+	if bc := newBatchConn(conn, batchSize, true); bc != nil {
+		return bc
+	}
+	return &singleReader{conn: conn, buf: make([]byte, serverUDPBufferSize)}
+}
+
+// batchSender sends the packets written to it in batches, from its own
+// goroutine.  WriteTo blocks while the queue is full, as it would while the
+// socket buffer is full.  The errors of batched writes are only logged.
+type batchSender struct {
+	net.PacketConn
+	conn    batchConn
+	queue   chan udpPacket
+	done    chan struct{}
+	stopped sync.Once
+}
+
+// newBatchSender returns a sender for `conn` that sends batches of up to
+// `batchSize` packets, or nil if that's not possible.
+func newBatchSender(conn net.PacketConn, batchSize int) *batchSender {
+	bc := newBatchConn(conn, batchSize, false)
+	if bc == nil {
+		return nil
+	}
+	s := &batchSender{
+		PacketConn: conn,
+		conn:       bc,
+		queue:      make(chan udpPacket, batchSize),
+		done:       make(chan struct{}),
+	}
+	go s.run(batchSize)
+	return s
+}
+
+func (s *batchSender) WriteTo(buf []byte, addr net.Addr) (int, error) {
+	copyBuf := getUDPBuffer(len(buf))
+	select {
+	case s.queue <- udpPacket{append((*copyBuf)[:0], buf...), addr}:
+		return len(buf), nil
+	case <-s.done:
+		putUDPBuffer(copyBuf)
+		return 0, net.ErrClosed
+	}
+}
+
+func (s *batchSender) run(batchSize int) {
+	pkts := make([]udpPacket, 0, batchSize)
+	for {
+		select {
+		case pkt := <-s.queue:
+			pkts = append(pkts[:0], pkt)
+		case <-s.done:
+			return
+		}
+	gather:
+		for len(pkts) < batchSize {
+			select {
+			case pkt := <-s.queue:
+				pkts = append(pkts, pkt)
+			default:
+				break gather
+			}
+		}
+		if err := s.conn.writeBatch(pkts); err != nil {
+			logger.Debugf("UDP Error: Failed to write batch to clients: %v", err)
+		}
+		for _, pkt := range pkts {
+			buf := pkt.payload[:cap(pkt.payload)]
+			putUDPBuffer(&buf)
+		}
+	}
+}
+
+// stop discards the queued packets, and makes further writes fail.
+func (s *batchSender) stop() {
+	s.stopped.Do(func() { close(s.done) })
+}
@@ -0,0 +1,258 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+	"golang.org/x/sys/unix"
+)
+
+// Socket options and control messages from linux/udp.h.
+const (
+	udpSegment = 103
+	udpGRO     = 104
+)
+
+// The kernel coalesces at most this many segments with GSO.
+const maxGSOSegments = 64
+
+// ipv4.Message and ipv6.Message are the same type, so either PacketConn can
+// be used.
+type xBatchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+type linuxBatchConn struct {
+	conn  *net.UDPConn
+	xconn xBatchConn
+	size  int
+	// Cleared if the kernel or the network device doesn't support GSO.
+	gso atomic.Bool
+	gro bool
+
+	// Received packets, the number received, and the position of the next
+	// packet to return.
+	in     []ipv4.Message
+	n      int
+	next   int
+	offset int
+
+	// Messages and GSO control messages for writeBatch.
+	out     []ipv4.Message
+	runs    [][2]int
+	gsoOOBs [][]byte
+}
+
+// newBatchConn returns a batchConn for `conn` if it is a UDP socket and
+// `batchSize` is more than one, or nil.  If `gro` is set, the socket is
+// configured to receive packets coalesced by GRO, where available.
+func newBatchConn(conn net.PacketConn, batchSize int, gro bool) batchConn {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok || batchSize <= 1 {
+		return nil
+	}
+	c := &linuxBatchConn{conn: udpConn, size: batchSize}
+	if addr, ok := udpConn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		c.xconn = ipv4.NewPacketConn(udpConn)
+	} else {
+		c.xconn = ipv6.NewPacketConn(udpConn)
+	}
+	rawConn, err := udpConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	rawControl(rawConn, func(fd int) error {
+		// Kernels that support GSO can report the segment size.
+		if _, err := unix.GetsockoptInt(fd, unix.IPPROTO_UDP, udpSegment); err == nil {
+			c.gso.Store(true)
+		}
+		if gro {
+			c.gro = unix.SetsockoptInt(fd, unix.IPPROTO_UDP, udpGRO, 1) == nil
+		}
+		return nil
+	})
+	return c
+}
+
+func (c *linuxBatchConn) readPacket() ([]byte, net.Addr, error) {
+	for c.next >= c.n {
+		if err := c.fill(); err != nil {
+			return nil, nil, err
+		}
+	}
+	msg := &c.in[c.next]
+	data := msg.Buffers[0][c.offset:msg.N]
+	if segSize := groSegmentSize(msg.OOB[:msg.NN]); segSize > 0 && segSize < len(data) {
+		c.offset += segSize
+		return data[:segSize], msg.Addr, nil
+	}
+	c.next++
+	c.offset = 0
+	return data, msg.Addr, nil
+}
+
+// fill receives the next batch of packets.
+func (c *linuxBatchConn) fill() error {
+	if c.in == nil {
+		c.in = make([]ipv4.Message, c.size)
+		for i := range c.in {
+			c.in[i].Buffers = [][]byte{make([]byte, serverUDPBufferSize)}
+			if c.gro {
+				c.in[i].OOB = make([]byte, unix.CmsgSpace(4))
+			}
+		}
+	}
+	c.n, c.next, c.offset = 0, 0, 0
+	n, err := c.xconn.ReadBatch(c.in, 0)
+	if errors.Is(err, unix.ENOSYS) {
+		// recvmmsg is older than GRO, so packets are not coalesced.
+		msg := &c.in[0]
+		msg.N, msg.Addr, err = c.conn.ReadFrom(msg.Buffers[0])
+		msg.NN = 0
+		n = 1
+	}
+	if err != nil {
+		return err
+	}
+	c.n = n
+	return nil
+}
+
+// groSegmentSize returns the size of the packets coalesced in a message, or
+// zero if it holds a single packet.
+func groSegmentSize(oob []byte) int {
+	if len(oob) == 0 {
+		return 0
+	}
+	cmsgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0
+	}
+	for _, cmsg := range cmsgs {
+		if cmsg.Header.Level == unix.IPPROTO_UDP && cmsg.Header.Type == udpGRO && len(cmsg.Data) >= 4 {
+			return int(*(*int32)(unsafe.Pointer(&cmsg.Data[0])))
+		}
+	}
+	return 0
+}
+
+// gsoRunEnd returns the end of the run of packets starting at `start` that can
+// be sent as one message with GSO: the same destination, and the same size,
+// except for a shorter last packet.
+func gsoRunEnd(pkts []udpPacket, start int) int {
+	first := pkts[start]
+	addr, ok := first.addr.(*net.UDPAddr)
+	segSize := len(first.payload)
+	if !ok || segSize == 0 {
+		return start + 1
+	}
+	total := segSize
+	end := start + 1
+	for end < len(pkts) && end-start < maxGSOSegments {
+		pkt := pkts[end]
+		pktAddr, ok := pkt.addr.(*net.UDPAddr)
+		if !ok || pktAddr.Port != addr.Port || !pktAddr.IP.Equal(addr.IP) ||
+			len(pkt.payload) > segSize || total+len(pkt.payload) > serverUDPBufferSize-maxAddrLen {
+			break
+		}
+		total += len(pkt.payload)
+		end++
+		if len(pkt.payload) < segSize {
+			break
+		}
+	}
+	return end
+}
+
+func (c *linuxBatchConn) writeBatch(pkts []udpPacket) error {
+	c.out = c.out[:0]
+	c.runs = c.runs[:0]
+	gso := c.gso.Load()
+	for start := 0; start < len(pkts); {
+		end := start + 1
+		if gso {
+			end = gsoRunEnd(pkts, start)
+		}
+		msg := ipv4.Message{Addr: pkts[start].addr}
+		for _, pkt := range pkts[start:end] {
+			msg.Buffers = append(msg.Buffers, pkt.payload)
+		}
+		if end-start > 1 {
+			msg.OOB = c.gsoOOB(len(c.runs), len(pkts[start].payload))
+		}
+		c.out = append(c.out, msg)
+		c.runs = append(c.runs, [2]int{start, end})
+		start = end
+	}
+
+	var firstErr error
+	for next := 0; next < len(c.out); {
+		n, err := c.xconn.WriteBatch(c.out[next:], 0)
+		if n > 0 {
+			next += n
+		}
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, unix.ENOSYS) {
+			// Without sendmmsg, there is no GSO either.
+			for _, pkt := range pkts[c.runs[next][0]:] {
+				if _, err := c.conn.WriteTo(pkt.payload, pkt.addr); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+			return firstErr
+		}
+		run := c.runs[next]
+		if run[1]-run[0] > 1 {
+			// EIO means the device can't checksum GSO segments.  Other errors, such
+			// as a segment larger than the MTU, only affect this message.
+			if errors.Is(err, unix.EIO) {
+				c.gso.Store(false)
+			}
+			for _, pkt := range pkts[run[0]:run[1]] {
+				if _, err := c.conn.WriteTo(pkt.payload, pkt.addr); err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		} else if firstErr == nil {
+			firstErr = err
+		}
+		next++
+	}
+	return firstErr
+}
+
+// gsoOOB returns the control message for the `i`th message of a batch, which
+// sets the GSO segment size.
+func (c *linuxBatchConn) gsoOOB(i int, segSize int) []byte {
+	for len(c.gsoOOBs) <= i {
+		c.gsoOOBs = append(c.gsoOOBs, make([]byte, unix.CmsgSpace(2)))
+	}
+	oob := c.gsoOOBs[i]
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.IPPROTO_UDP
+	h.Type = udpSegment
+	h.SetLen(unix.CmsgLen(2))
+	*(*uint16)(unsafe.Pointer(&oob[unix.CmsgLen(0)])) = uint16(segSize)
+	return oob
+}
@@ -0,0 +1,134 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/shadowsocks/go-shadowsocks2/socks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchConnRead(t *testing.T) {
+	server := makeLocalhostPacketConn(t)
+	client := makeLocalhostPacketConn(t)
+	bc := newBatchConn(server, 4, true)
+	require.NotNil(t, bc)
+
+	for i := 1; i <= 6; i++ {
+		_, err := client.WriteTo(bytes.Repeat([]byte{byte(i)}, i), server.LocalAddr())
+		require.NoError(t, err)
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 1; i <= 6; i++ {
+		pkt, addr, err := bc.readPacket()
+		require.NoError(t, err)
+		require.Equal(t, bytes.Repeat([]byte{byte(i)}, i), pkt)
+		require.Equal(t, client.LocalAddr().String(), addr.String())
+	}
+}
+
+// Packets sent with GSO may arrive coalesced with GRO, and are split again.
+func TestBatchConnSegments(t *testing.T) {
+	sender := makeLocalhostPacketConn(t)
+	receiver := makeLocalhostPacketConn(t)
+	out := newBatchConn(sender, 8, false)
+	in := newBatchConn(receiver, 8, true)
+	require.NotNil(t, out)
+	require.NotNil(t, in)
+
+	var pkts []udpPacket
+	for i := 0; i < 5; i++ {
+		pkts = append(pkts, udpPacket{bytes.Repeat([]byte{byte(i)}, 100), receiver.LocalAddr()})
+	}
+	pkts = append(pkts, udpPacket{[]byte{5}, receiver.LocalAddr()})
+	pkts = append(pkts, udpPacket{bytes.Repeat([]byte{6}, 200), receiver.LocalAddr()})
+	require.NoError(t, out.writeBatch(pkts))
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	for _, expected := range pkts {
+		pkt, _, err := in.readPacket()
+		require.NoError(t, err)
+		require.Equal(t, expected.payload, pkt)
+	}
+}
+
+func TestGSORunEnd(t *testing.T) {
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1}
+	b := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 1}
+	pkts := []udpPacket{
+		{make([]byte, 10), a},
+		{make([]byte, 10), a},
+		{make([]byte, 5), a},
+		{make([]byte, 10), a},
+		{make([]byte, 10), b},
+		{make([]byte, 20), b},
+	}
+	require.Equal(t, 3, gsoRunEnd(pkts, 0))
+	require.Equal(t, 4, gsoRunEnd(pkts, 3))
+	require.Equal(t, 5, gsoRunEnd(pkts, 4))
+	require.Equal(t, 6, gsoRunEnd(pkts, 5))
+}
+
+func TestUDPServiceBatching(t *testing.T) {
+	ciphers, err := MakeTestCiphers(ss.MakeTestSecrets(1))
+	require.NoError(t, err)
+	cipher := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry).Cipher
+	clientConn := makeLocalhostPacketConn(t)
+	proxyConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	echoConn := makeLocalhostPacketConn(t)
+	go func() {
+		buf := make([]byte, serverUDPBufferSize)
+		for {
+			n, addr, err := echoConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echoConn.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	s := NewUDPService(timeout, ciphers, &natTestMetrics{})
+	s.SetTargetIPValidator(allowAll)
+	s.SetPipeline(UDPPipeline{Workers: 2, BatchSize: 8})
+	go s.Serve(proxyConn)
+	defer s.GracefulStop()
+
+	const numPackets = 20
+	targetAddr := socks.ParseAddr(echoConn.LocalAddr().String())
+	for i := 0; i < numPackets; i++ {
+		plaintext := append(append([]byte{}, targetAddr...), byte(i))
+		pkt, err := ss.Pack(make([]byte, serverUDPBufferSize), plaintext, cipher)
+		require.NoError(t, err)
+		_, err = clientConn.WriteTo(pkt, proxyConn.LocalAddr())
+		require.NoError(t, err)
+	}
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received := make(map[byte]bool)
+	buf := make([]byte, serverUDPBufferSize)
+	for len(received) < numPackets {
+		n, _, err := clientConn.ReadFrom(buf)
+		require.NoError(t, err)
+		plaintext, err := ss.Unpack(nil, buf[:n], cipher)
+		require.NoError(t, err)
+		require.Equal(t, []byte(targetAddr), plaintext[:len(targetAddr)])
+		received[plaintext[len(plaintext)-1]] = true
+	}
+}
@@ -17,7 +17,9 @@ package service
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"net"
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -37,10 +39,13 @@ var clientAddr = net.UDPAddr{IP: []byte{192, 0, 2, 1}, Port: 12345}
 var targetAddr = net.UDPAddr{IP: []byte{192, 0, 2, 2}, Port: 54321}
 var dnsAddr = net.UDPAddr{IP: []byte{192, 0, 2, 3}, Port: 53}
 var natCipher *ss.Cipher
+var natEntry *CipherEntry
 
 func init() {
 	logging.SetLevel(logging.INFO, "")
 	natCipher, _ = ss.NewCipher(ss.TestCipher, "test password")
+	entry := MakeCipherEntry("key id", natCipher, "test password")
+	natEntry = &entry
 }
 
 type packet struct {
@@ -56,6 +61,13 @@ type fakePacketConn struct {
 	deadline time.Time
 }
 
+func makeLocalhostPacketConn(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
 func makePacketConn() *fakePacketConn {
 	return &fakePacketConn{
 		send: make(chan packet, 1),
@@ -99,11 +111,14 @@ type udpReport struct {
 // Stub metrics implementation for testing NAT behaviors.
 type natTestMetrics struct {
 	metrics.ShadowsocksMetrics
+	mu              sync.Mutex
 	natEntriesAdded int
+	natEvictions    []string
+	droppedPackets  []string
 	upstreamPackets []udpReport
 }
 
-func (m *natTestMetrics) AddTCPProbe(status, drainResult string, port int, data metrics.ProxyMetrics) {
+func (m *natTestMetrics) AddTCPProbe(status, drainResult, closeStyle string, port int, data metrics.ProxyMetrics) {
 }
 func (m *natTestMetrics) AddClosedTCPConnection(clientIp, accessKey, status string, data metrics.ProxyMetrics, timeToCipher, duration time.Duration) {
 }
@@ -115,14 +130,29 @@ func (m *natTestMetrics) SetNumAccessKeys(numKeys int, numPorts int) {
 func (m *natTestMetrics) AddOpenTCPConnection(clientIp, accessKey string) {
 }
 func (m *natTestMetrics) AddUDPPacketFromClient(clientIp, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.upstreamPackets = append(m.upstreamPackets, udpReport{clientIp, accessKey, status, clientProxyBytes, proxyTargetBytes})
 }
 func (m *natTestMetrics) AddUDPPacketFromTarget(clientIp, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
 }
 func (m *natTestMetrics) AddUDPNatEntry() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.natEntriesAdded++
 }
 func (m *natTestMetrics) RemoveUDPNatEntry() {}
+func (m *natTestMetrics) AddUDPNatEviction(limit string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.natEvictions = append(m.natEvictions, limit)
+}
+func (m *natTestMetrics) AddCipherLookup(proto, affinity string) {}
+func (m *natTestMetrics) AddUDPPacketDropped(reason string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.droppedPackets = append(m.droppedPackets, reason)
+}
 
 // Takes a validation policy, and returns the metrics it
 // generates when localhost access is attempted
@@ -194,6 +224,98 @@ func TestUpstreamMetrics(t *testing.T) {
 	}
 }
 
+func TestUDPReplay(t *testing.T) {
+	ciphers, _ := MakeTestCiphers([]string{"asdf"})
+	entry := ciphers.SnapshotForClientIP(nil)[0].Value.(*CipherEntry)
+	clientConn := makePacketConn()
+	testMetrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, testMetrics)
+	service.SetTargetIPValidator(allowAll)
+	replayCache := NewReplayCache(10)
+	service.SetReplayCache(&replayCache)
+	go service.Serve(clientConn)
+
+	plaintext := append(socks.ParseAddr("127.0.0.1:9"), []byte("payload")...)
+	pack := func(saltGenerator ss.SaltGenerator) []byte {
+		buf := make([]byte, serverUDPBufferSize)
+		pkt, err := ss.PackWithSaltGenerator(buf, plaintext, entry.Cipher, saltGenerator)
+		require.NoError(t, err)
+		return pkt
+	}
+	send := func(port int, pkt []byte) {
+		clientConn.recv <- packet{
+			addr:    &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: port},
+			payload: pkt,
+		}
+	}
+	clientPacket := pack(ss.RandomSaltGenerator)
+	send(54321, clientPacket)
+	// Replay on the same NAT entry.
+	send(54321, clientPacket)
+	// Reflection of a downstream packet.
+	send(54321, pack(entry.SaltGenerator))
+	// Replay from a new client address.
+	send(54322, clientPacket)
+	service.GracefulStop()
+
+	var statuses []string
+	for _, report := range testMetrics.upstreamPackets {
+		statuses = append(statuses, report.status)
+	}
+	require.Equal(t, []string{"OK", "ERR_REPLAY_CLIENT", "ERR_REPLAY_SERVER", "ERR_REPLAY_CLIENT"}, statuses)
+	require.Equal(t, []string{"replay_client", "replay_server", "replay_client"}, testMetrics.droppedPackets)
+	require.Equal(t, 1, testMetrics.natEntriesAdded)
+}
+
+func TestUDPPipelineOrder(t *testing.T) {
+	const numClients = 8
+	const numPackets = 10
+	ciphers, err := MakeTestCiphers(ss.MakeTestSecrets(numClients))
+	require.NoError(t, err)
+	clientConn := makePacketConn()
+	testMetrics := &natTestMetrics{}
+	service := NewUDPService(timeout, ciphers, testMetrics)
+	service.SetTargetIPValidator(allowAll)
+	service.SetPipeline(UDPPipeline{Workers: 4, QueueLen: numClients * numPackets})
+	go service.Serve(clientConn)
+
+	targetAddr := socks.ParseAddr("127.0.0.1:9")
+	snapshot := ciphers.SnapshotForClientIP(nil)
+	for i := 1; i <= numPackets; i++ {
+		for c, element := range snapshot {
+			plaintext := append(append([]byte{}, targetAddr...), make([]byte, i)...)
+			pkt, err := ss.Pack(make([]byte, serverUDPBufferSize), plaintext, element.Value.(*CipherEntry).Cipher)
+			require.NoError(t, err)
+			clientConn.recv <- packet{
+				addr:    &net.UDPAddr{IP: net.IPv4(192, 0, 2, byte(c)), Port: 54321},
+				payload: pkt,
+			}
+		}
+	}
+	service.GracefulStop()
+
+	require.Empty(t, testMetrics.droppedPackets)
+	require.Len(t, testMetrics.upstreamPackets, numClients*numPackets)
+	sizes := make(map[string][]int)
+	for _, report := range testMetrics.upstreamPackets {
+		require.Equal(t, "OK", report.status)
+		sizes[report.accessKey] = append(sizes[report.accessKey], report.proxyTargetBytes)
+	}
+	require.Len(t, sizes, numClients)
+	for _, keySizes := range sizes {
+		require.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, keySizes)
+	}
+}
+
+func TestUDPServerSaltMarking(t *testing.T) {
+	clientConn, targetConn, entry := setupNAT()
+	entry.WriteTo([]byte{1}, &targetAddr)
+	<-targetConn.send
+	targetConn.recv <- packet{addr: &targetAddr, payload: []byte{2}}
+	sent := <-clientConn.send
+	require.True(t, natEntry.SaltGenerator.IsServerSalt(sent.payload[:natCipher.SaltSize()]))
+}
+
 func assertAlmostEqual(t *testing.T, a, b time.Time) {
 	delta := a.Sub(b)
 	limit := 100 * time.Millisecond
@@ -210,10 +332,14 @@ func TestNATEmpty(t *testing.T) {
 }
 
 func setupNAT() (*fakePacketConn, *fakePacketConn, *natconn) {
+	return setupNATWithPolicy(natPolicy{})
+}
+
+func setupNATWithPolicy(policy natPolicy) (*fakePacketConn, *fakePacketConn, *natconn) {
 	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
 	clientConn := makePacketConn()
 	targetConn := makePacketConn()
-	nat.Add(&clientAddr, clientConn, natCipher, targetConn, "ZZ", "key id")
+	nat.Add(clientAddr.String(), &clientAddr, clientAddr.IP, clientConn, natEntry, targetConn, "ZZ", policy)
 	entry := nat.Get(clientAddr.String())
 	return clientConn, targetConn, entry
 }
@@ -228,6 +354,109 @@ func TestNATGet(t *testing.T) {
 	}
 }
 
+// Adds an entry for a client at `ip`:`port`, and returns its target connection.
+func addNATEntry(nat *natmap, ip byte, port int, keyID string, limits NATLimits) *fakePacketConn {
+	addr := &net.UDPAddr{IP: []byte{192, 0, 2, ip}, Port: port}
+	targetConn := makePacketConn()
+	entry := &CipherEntry{ID: keyID, Cipher: natCipher, SaltGenerator: RandomServerSaltGenerator}
+	nat.Add(addr.String(), addr, addr.IP, makePacketConn(), entry, targetConn, "ZZ", natPolicy{limits: limits})
+	return targetConn
+}
+
+func natHas(nat *natmap, ip byte, port int) bool {
+	addr := &net.UDPAddr{IP: []byte{192, 0, 2, ip}, Port: port}
+	return nat.Get(addr.String()) != nil
+}
+
+func TestNATLimitTotal(t *testing.T) {
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &sync.WaitGroup{})
+	limits := NATLimits{MaxEntries: 2}
+	first := addNATEntry(nat, 1, 1000, "k1", limits)
+	addNATEntry(nat, 2, 1000, "k2", limits)
+	require.Equal(t, 2, nat.Len())
+	require.Empty(t, testMetrics.natEvictions)
+
+	addNATEntry(nat, 3, 1000, "k3", limits)
+	require.Equal(t, 2, nat.Len())
+	require.False(t, natHas(nat, 1, 1000))
+	require.True(t, natHas(nat, 2, 1000))
+	require.True(t, natHas(nat, 3, 1000))
+	require.Equal(t, []string{"total"}, testMetrics.natEvictions)
+	// The evicted entry's copy loop is stopped.
+	assertAlmostEqual(t, first.deadline, time.Now())
+}
+
+func TestNATLimitLRU(t *testing.T) {
+	nat := newNATmap(timeout, &natTestMetrics{}, &sync.WaitGroup{})
+	limits := NATLimits{MaxEntries: 2}
+	addNATEntry(nat, 1, 1000, "k1", limits)
+	addNATEntry(nat, 2, 1000, "k2", limits)
+	// Using the oldest entry makes the other one least recently used.
+	require.True(t, natHas(nat, 1, 1000))
+	addNATEntry(nat, 3, 1000, "k3", limits)
+	require.True(t, natHas(nat, 1, 1000))
+	require.False(t, natHas(nat, 2, 1000))
+	require.True(t, natHas(nat, 3, 1000))
+}
+
+func TestNATLimitPerClientIP(t *testing.T) {
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &sync.WaitGroup{})
+	limits := NATLimits{MaxEntries: 10, MaxEntriesPerClientIP: 2}
+	addNATEntry(nat, 1, 1000, "k1", limits)
+	addNATEntry(nat, 2, 1000, "k1", limits)
+	addNATEntry(nat, 1, 1001, "k1", limits)
+	// A third port from the same IP evicts the oldest entry for that IP only.
+	addNATEntry(nat, 1, 1002, "k1", limits)
+	require.Equal(t, 3, nat.Len())
+	require.False(t, natHas(nat, 1, 1000))
+	require.True(t, natHas(nat, 1, 1001))
+	require.True(t, natHas(nat, 1, 1002))
+	require.True(t, natHas(nat, 2, 1000))
+	require.Equal(t, []string{"client_ip"}, testMetrics.natEvictions)
+}
+
+func TestNATLimitPerKey(t *testing.T) {
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &sync.WaitGroup{})
+	limits := NATLimits{MaxEntriesPerKey: 1}
+	addNATEntry(nat, 1, 1000, "k1", limits)
+	addNATEntry(nat, 2, 1000, "k2", limits)
+	addNATEntry(nat, 3, 1000, "k1", limits)
+	require.Equal(t, 2, nat.Len())
+	require.False(t, natHas(nat, 1, 1000))
+	require.True(t, natHas(nat, 2, 1000))
+	require.True(t, natHas(nat, 3, 1000))
+	require.Equal(t, []string{"access_key"}, testMetrics.natEvictions)
+}
+
+// A packet that was queued for an entry before it was evicted is dropped, and
+// doesn't extend the entry's deadline.
+func TestNATEvictedQueuedWrite(t *testing.T) {
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &sync.WaitGroup{})
+	limits := NATLimits{MaxEntries: 1}
+	first := addNATEntry(nat, 1, 1000, "k1", limits)
+	entry := nat.Get((&net.UDPAddr{IP: []byte{192, 0, 2, 1}, Port: 1000}).String())
+	require.NotNil(t, entry)
+	buf := getUDPBuffer(1)
+	write := udpWriteJob{targetConn: entry, payload: (*buf)[:1], tgtUDPAddr: &targetAddr, buf: buf}
+
+	addNATEntry(nat, 2, 1000, "k2", limits)
+	require.True(t, entry.evicted.Load())
+	s := &udpService{m: testMetrics}
+	s.writeBatch([]udpWriteJob{write})
+	require.Equal(t, []string{"evicted"}, testMetrics.droppedPackets)
+	require.Empty(t, testMetrics.upstreamPackets)
+	require.Empty(t, first.send)
+	assertAlmostEqual(t, first.deadline, time.Now())
+
+	// Writing to the entry directly doesn't extend the deadline either.
+	entry.onWrite(&targetAddr)
+	assertAlmostEqual(t, first.deadline, time.Now())
+}
+
 func TestNATWrite(t *testing.T) {
 	_, targetConn, entry := setupNAT()
 
@@ -316,6 +545,74 @@ func TestNATFastClose(t *testing.T) {
 	assertAlmostEqual(t, targetConn.deadline, time.Now())
 }
 
+func testNATFiltering(t *testing.T, filtering NATFiltering, src *net.UDPAddr, allowed bool) {
+	testMetrics := &natTestMetrics{}
+	nat := newNATmap(timeout, testMetrics, &sync.WaitGroup{})
+	clientConn := makePacketConn()
+	targetConn := makePacketConn()
+	nat.Add(clientAddr.String(), &clientAddr, clientAddr.IP, clientConn, natEntry, targetConn, "ZZ", natPolicy{filtering: filtering})
+	entry := nat.Get(clientAddr.String())
+
+	entry.WriteTo([]byte{1}, &targetAddr)
+	<-targetConn.send
+
+	targetConn.recv <- packet{addr: src, payload: []byte{2}}
+	// A packet from the destination is always relayed.
+	targetConn.recv <- packet{addr: &targetAddr, payload: []byte{3}}
+	<-clientConn.send
+	if allowed {
+		<-clientConn.send
+		require.Empty(t, testMetrics.droppedPackets)
+	} else {
+		require.Equal(t, []string{"nat_filtering"}, testMetrics.droppedPackets)
+	}
+}
+
+func TestNATFiltering(t *testing.T) {
+	otherPort := &net.UDPAddr{IP: targetAddr.IP, Port: targetAddr.Port + 1}
+	otherIP := &net.UDPAddr{IP: []byte{192, 0, 2, 4}, Port: targetAddr.Port}
+	t.Run("EndpointIndependent", func(t *testing.T) {
+		testNATFiltering(t, EndpointIndependentFiltering, otherIP, true)
+	})
+	t.Run("AddressDependent/OtherPort", func(t *testing.T) {
+		testNATFiltering(t, AddressDependentFiltering, otherPort, true)
+	})
+	t.Run("AddressDependent/OtherIP", func(t *testing.T) {
+		testNATFiltering(t, AddressDependentFiltering, otherIP, false)
+	})
+	t.Run("AddressAndPortDependent/OtherPort", func(t *testing.T) {
+		testNATFiltering(t, AddressAndPortDependentFiltering, otherPort, false)
+	})
+}
+
+func TestNATTimeoutRules(t *testing.T) {
+	ntpAddr := net.UDPAddr{IP: targetAddr.IP, Port: 123}
+	quicAddr := net.UDPAddr{IP: targetAddr.IP, Port: 443}
+	timeouts := &NATTimeoutPolicy{Rules: []NATTimeoutRule{
+		{Ports: []int{123}, Timeout: 10 * time.Second, FastClose: true},
+		{Ports: []int{443}, Timeout: 30 * time.Minute},
+	}}
+	clientConn, targetConn, entry := setupNATWithPolicy(natPolicy{timeouts: timeouts})
+
+	entry.WriteTo([]byte{1}, &ntpAddr)
+	<-targetConn.send
+	assertAlmostEqual(t, targetConn.deadline, time.Now().Add(10*time.Second))
+
+	targetConn.recv <- packet{addr: &ntpAddr, payload: []byte{2}}
+	<-clientConn.send
+	// The single NTP exchange is complete.
+	assertAlmostEqual(t, targetConn.deadline, time.Now())
+
+	_, targetConn, entry = setupNATWithPolicy(natPolicy{timeouts: timeouts})
+	entry.WriteTo([]byte{1}, &quicAddr)
+	<-targetConn.send
+	assertAlmostEqual(t, targetConn.deadline, time.Now().Add(30*time.Minute))
+	// A shorter timeout doesn't shorten the deadline.
+	entry.WriteTo([]byte{1}, &ntpAddr)
+	<-targetConn.send
+	assertAlmostEqual(t, targetConn.deadline, time.Now().Add(30*time.Minute))
+}
+
 func TestNATNoFastClose_NotDNS(t *testing.T) {
 	clientConn, targetConn, entry := setupNAT()
 
@@ -525,3 +822,118 @@ func TestUDPEarlyStop(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// benchPacketConn supplies packets to a UDPService, with at most `window`
+// packets in the service at once, so that none are dropped.
+type benchPacketConn struct {
+	net.PacketConn
+	packets []packet
+	next    int
+	limit   int
+	window  chan struct{}
+	closed  chan struct{}
+}
+
+func (conn *benchPacketConn) ReadFrom(buffer []byte) (int, net.Addr, error) {
+	select {
+	case conn.window <- struct{}{}:
+	case <-conn.closed:
+		return 0, nil, net.ErrClosed
+	}
+	if conn.next == conn.limit {
+		<-conn.closed
+		return 0, nil, net.ErrClosed
+	}
+	pkt := conn.packets[conn.next%len(conn.packets)]
+	conn.next++
+	return copy(buffer, pkt.payload), pkt.addr, nil
+}
+
+func (conn *benchPacketConn) WriteTo(payload []byte, addr net.Addr) (int, error) {
+	return len(payload), nil
+}
+
+func (conn *benchPacketConn) Close() error {
+	close(conn.closed)
+	return nil
+}
+
+// benchMetrics releases the window of a benchPacketConn for each packet
+// processed, and signals when `remaining` reaches zero.
+type benchMetrics struct {
+	metrics.ShadowsocksMetrics
+	conn      *benchPacketConn
+	remaining sync.WaitGroup
+}
+
+func (m *benchMetrics) done() {
+	<-m.conn.window
+	m.remaining.Done()
+}
+func (m *benchMetrics) GetIpAddress(net.Addr) string {
+	return ""
+}
+func (m *benchMetrics) AddUDPPacketFromClient(clientIp, accessKey, status string, clientProxyBytes, proxyTargetBytes int, timeToCipher time.Duration) {
+	m.done()
+}
+func (m *benchMetrics) AddUDPPacketDropped(reason string) {
+	m.done()
+}
+func (m *benchMetrics) AddUDPPacketFromTarget(clientIp, accessKey, status string, targetProxyBytes, proxyClientBytes int) {
+}
+func (m *benchMetrics) AddCipherLookup(proto, affinity string) {}
+func (m *benchMetrics) AddUDPNatEntry()                        {}
+func (m *benchMetrics) RemoveUDPNatEntry()                     {}
+func (m *benchMetrics) AddUDPNatEviction(limit string)         {}
+
+// Simulates a server with 1000 keys, receiving packets from 200 clients with
+// their own keys, and undecryptable packets from 50 more, which are tried with
+// every key.
+func BenchmarkUDPManyKeys(b *testing.B) {
+	const numKeys = 1000
+	const numClients = 200
+	const numProbers = 50
+	plaintext := append(socks.ParseAddr("127.0.0.1:9"), ss.MakeTestPayload(50)...)
+	// Each sub-benchmark has its own ciphers, so that the key order and the
+	// affinity learned in one don't carry into the next.
+	setup := func(b *testing.B) (CipherList, []packet) {
+		cipherList, err := MakeTestCiphers(ss.MakeTestSecrets(numKeys))
+		require.NoError(b, err)
+		var packets []packet
+		snapshot := cipherList.SnapshotForClientIP(nil)
+		for i := 0; i < numClients+numProbers; i++ {
+			addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2+byte(i/256), byte(i)), Port: 54321}
+			if i >= numClients {
+				packets = append(packets, packet{addr: addr, payload: ss.MakeTestPayload(100)})
+				continue
+			}
+			cipher := snapshot[i*numKeys/numClients].Value.(*CipherEntry).Cipher
+			pkt, err := ss.Pack(make([]byte, serverUDPBufferSize), plaintext, cipher)
+			require.NoError(b, err)
+			packets = append(packets, packet{addr: addr, payload: pkt})
+		}
+		return cipherList, packets
+	}
+
+	for _, workers := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cipherList, packets := setup(b)
+			conn := &benchPacketConn{
+				packets: packets,
+				limit:   b.N,
+				window:  make(chan struct{}, 4*workers),
+				closed:  make(chan struct{}),
+			}
+			testMetrics := &benchMetrics{conn: conn}
+			testMetrics.remaining.Add(b.N)
+			s := NewUDPService(timeout, cipherList, testMetrics)
+			s.SetTargetIPValidator(allowAll)
+			s.SetPipeline(UDPPipeline{Workers: workers})
+			b.ResetTimer()
+			go s.Serve(conn)
+			testMetrics.remaining.Wait()
+			b.StopTimer()
+			s.GracefulStop()
+		})
+	}
+}
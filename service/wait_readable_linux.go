@@ -0,0 +1,42 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitReadable blocks until a read from `conn` would not block, without
+// reading, so that the caller doesn't need to hold a buffer meanwhile.  Like a
+// read, it fails when the read deadline passes or the socket is closed.  It
+// returns immediately if `conn` is not a socket.
+func waitReadable(conn interface{}) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	rawConn, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	return rawConn.Read(func(fd uintptr) bool {
+		// Returning false waits for the socket to become readable.
+		fds := [1]unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		n, err := unix.Poll(fds[:], 0)
+		return err != nil || n > 0
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package service
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	ss "github.com/Jigsaw-Code/outline-ss-server/shadowsocks"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitReadable(t *testing.T) {
+	conn := makeLocalhostPacketConn(t)
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	require.ErrorIs(t, waitReadable(conn), os.ErrDeadlineExceeded)
+
+	sender := makeLocalhostPacketConn(t)
+	_, err := sender.WriteTo([]byte("ping"), conn.LocalAddr())
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	require.NoError(t, waitReadable(conn))
+	// Waiting doesn't consume the packet.
+	require.NoError(t, waitReadable(conn))
+	buf := make([]byte, 10)
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buf[:n]))
+}
+
+func TestWaitReadableClosed(t *testing.T) {
+	conn := makeLocalhostPacketConn(t)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		conn.Close()
+	}()
+	require.ErrorIs(t, waitReadable(conn), net.ErrClosed)
+}
+
+func TestTimedCopyReleasesBuffer(t *testing.T) {
+	targetConn := makeLocalhostPacketConn(t)
+	clientConn := makeLocalhostPacketConn(t)
+	cipher, err := ss.NewCipher(ss.TestCipher, "secret")
+	require.NoError(t, err)
+	nat := &natconn{
+		PacketConn:     targetConn,
+		cipher:         cipher,
+		saltGenerator:  RandomServerSaltGenerator,
+		defaultTimeout: time.Second,
+	}
+	inUse := natBufPool.BytesInUse()
+	done := make(chan struct{})
+	go func() {
+		timedCopy(clientConn.LocalAddr(), clientConn, nat, &natTestMetrics{})
+		close(done)
+	}()
+
+	peer := makeLocalhostPacketConn(t)
+	_, err = peer.WriteTo([]byte("response"), targetConn.LocalAddr())
+	require.NoError(t, err)
+	clientConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, serverUDPBufferSize)
+	_, _, err = clientConn.ReadFrom(buf)
+	require.NoError(t, err)
+	// The entry is idle again.
+	require.Eventually(t, func() bool { return natBufPool.BytesInUse() == inUse }, time.Second, 10*time.Millisecond)
+
+	targetConn.SetReadDeadline(time.Now())
+	<-done
+}
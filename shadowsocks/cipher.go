@@ -88,6 +88,16 @@ func maxTagSize() int {
 	return max
 }
 
+func maxSaltSize() int {
+	max := 0
+	for _, spec := range supportedAEADs {
+		if spec.saltSize > max {
+			max = spec.saltSize
+		}
+	}
+	return max
+}
+
 // Cipher encapsulates a Shadowsocks AEAD spec and a secret
 type Cipher struct {
 	aead   aeadSpec
@@ -27,12 +27,17 @@ var ErrShortPacket = errors.New("short packet")
 // If plaintext and dst overlap but are not aligned for in-place encryption, this
 // function will panic.
 func Pack(dst, plaintext []byte, cipher *Cipher) ([]byte, error) {
+	return PackWithSaltGenerator(dst, plaintext, cipher, RandomSaltGenerator)
+}
+
+// PackWithSaltGenerator is like Pack, but uses saltGenerator to create the salt.
+func PackWithSaltGenerator(dst, plaintext []byte, cipher *Cipher, saltGenerator SaltGenerator) ([]byte, error) {
 	saltSize := cipher.SaltSize()
 	if len(dst) < saltSize {
 		return nil, io.ErrShortBuffer
 	}
 	salt := dst[:saltSize]
-	if err := RandomSaltGenerator.GetSalt(salt); err != nil {
+	if err := saltGenerator.GetSalt(salt); err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,100 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+)
+
+// MaxPaddingChunks is the largest number of chunks a PaddingPolicy may add, to
+// bound the overhead.
+const MaxPaddingChunks = 16
+
+// PaddingPolicy randomizes the length of the first data sent by a Writer, which
+// would otherwise be determined by the salt size and the first payload.
+//
+// The first payload is split into a random number of chunks at random
+// boundaries.  The salt and the first chunk are written together, and the rest
+// of the chunks in a second write, so the first packet has a random length.
+// Every chunk carries at least one byte, so all clients can read the stream.
+//
+// Optionally, empty chunks are inserted after the salt, which adds a random
+// multiple of the chunk overhead.  Not all clients accept empty chunks, so they
+// should only be used if all the clients are known to handle them, as Outline
+// clients do.
+type PaddingPolicy struct {
+	// The first payload is split into a number of chunks chosen uniformly from
+	// [MinChunks, MaxChunks], or fewer if it is too short.  Zero values mean 1.
+	MinChunks, MaxChunks int
+	// The number of empty chunks inserted before the first payload is chosen
+	// uniformly from [MinEmptyChunks, MaxEmptyChunks].
+	MinEmptyChunks, MaxEmptyChunks int
+}
+
+// Validate returns an error if the policy is inconsistent.
+func (p *PaddingPolicy) Validate() error {
+	if p.MinChunks < 0 || p.MinEmptyChunks < 0 {
+		return errors.New("padding chunk counts must not be negative")
+	}
+	if p.MaxChunks < p.MinChunks || p.MaxEmptyChunks < p.MinEmptyChunks {
+		return errors.New("padding chunk maximums must not be less than the minimums")
+	}
+	if p.MaxChunks > MaxPaddingChunks || p.MaxEmptyChunks > MaxPaddingChunks {
+		return errors.New("too many padding chunks")
+	}
+	return nil
+}
+
+// uniform returns a random number in [min, max].
+func uniform(min, max int) int {
+	if max <= min {
+		return min
+	}
+	return min + rand.Intn(max-min+1)
+}
+
+// emptyChunks returns the number of empty chunks to insert.
+func (p *PaddingPolicy) emptyChunks() int {
+	return uniform(p.MinEmptyChunks, p.MaxEmptyChunks)
+}
+
+// split returns the sizes of the chunks for a payload of `size` bytes.
+func (p *PaddingPolicy) split(size int) []int {
+	chunks := uniform(p.MinChunks, p.MaxChunks)
+	if chunks > size {
+		chunks = size
+	}
+	if chunks <= 1 {
+		return []int{size}
+	}
+	// Pick distinct boundaries in [1, size).
+	cuts := make(map[int]bool, chunks-1)
+	for len(cuts) < chunks-1 {
+		cuts[1+rand.Intn(size-1)] = true
+	}
+	boundaries := make([]int, 0, chunks+1)
+	boundaries = append(boundaries, 0, size)
+	for cut := range cuts {
+		boundaries = append(boundaries, cut)
+	}
+	sort.Ints(boundaries)
+	sizes := make([]int, chunks)
+	for i := range sizes {
+		sizes[i] = boundaries[i+1] - boundaries[i]
+	}
+	return sizes
+}
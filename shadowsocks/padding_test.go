@@ -0,0 +1,146 @@
+// Copyright 2026 Jigsaw Operations LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shadowsocks
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPaddingValidate(t *testing.T) {
+	require.NoError(t, (&PaddingPolicy{}).Validate())
+	require.NoError(t, (&PaddingPolicy{MinChunks: 1, MaxChunks: 4, MaxEmptyChunks: 2}).Validate())
+	require.Error(t, (&PaddingPolicy{MinChunks: -1}).Validate())
+	require.Error(t, (&PaddingPolicy{MinChunks: 3, MaxChunks: 2}).Validate())
+	require.Error(t, (&PaddingPolicy{MinEmptyChunks: 1}).Validate())
+	require.Error(t, (&PaddingPolicy{MaxChunks: MaxPaddingChunks + 1}).Validate())
+}
+
+func TestPaddingSplit(t *testing.T) {
+	policy := PaddingPolicy{MinChunks: 2, MaxChunks: 5}
+	counts := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		sizes := policy.split(100)
+		counts[len(sizes)]++
+		total := 0
+		for _, size := range sizes {
+			require.Greater(t, size, 0)
+			total += size
+		}
+		require.Equal(t, 100, total)
+	}
+	for chunks := 2; chunks <= 5; chunks++ {
+		require.Greater(t, counts[chunks], 0, "%d chunks", chunks)
+	}
+	require.Len(t, counts, 4)
+
+	// Short payloads can't be split into more chunks than bytes.
+	require.Equal(t, []int{1, 1}, (&PaddingPolicy{MinChunks: 5, MaxChunks: 5}).split(2))
+	require.Equal(t, []int{1}, policy.split(1))
+	require.Equal(t, []int{100}, (&PaddingPolicy{}).split(100))
+}
+
+// writeRecorder keeps each write separately.
+type writeRecorder struct {
+	writes [][]byte
+}
+
+func (w *writeRecorder) Write(b []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// readChunkSizes decrypts `ciphertext` and returns the payload sizes of its chunks.
+func readChunkSizes(t *testing.T, cipher *Cipher, ciphertext []byte) []int {
+	cr := &chunkReader{reader: bytes.NewReader(ciphertext), ssCipher: cipher, payload: readBufPool.LazySlice()}
+	var sizes []int
+	for {
+		payload, err := cr.ReadChunk()
+		if err != nil {
+			return sizes
+		}
+		sizes = append(sizes, len(payload))
+	}
+}
+
+func TestWriterPadding(t *testing.T) {
+	cipher := newTestCipher(t)
+	const chunkOverhead = 2 + 2*testCipherOverhead
+	policy := &PaddingPolicy{MinChunks: 3, MaxChunks: 3, MinEmptyChunks: 2, MaxEmptyChunks: 2}
+	out := &writeRecorder{}
+	writer := NewShadowsocksWriter(out, cipher)
+	writer.SetPadding(policy)
+	payload := MakeTestPayload(100)
+	_, err := writer.Write(payload)
+	require.NoError(t, err)
+	_, err = writer.Write([]byte("more"))
+	require.NoError(t, err)
+
+	require.Len(t, out.writes, 3)
+	ciphertext := bytes.Join(out.writes, nil)
+	require.Equal(t, cipher.SaltSize()+len(payload)+len("more")+6*chunkOverhead, len(ciphertext))
+	sizes := readChunkSizes(t, cipher, ciphertext)
+	require.Len(t, sizes, 6)
+	require.Equal(t, []int{0, 0}, sizes[:2])
+	require.Equal(t, 100, sizes[2]+sizes[3]+sizes[4])
+	require.Equal(t, 4, sizes[5])
+	// The first write holds the salt, the empty chunks and the first payload chunk.
+	require.Equal(t, cipher.SaltSize()+3*chunkOverhead+sizes[2], len(out.writes[0]))
+	// The policy is not mutated, so it can be shared.
+	require.Equal(t, 3, policy.MaxChunks)
+
+	plaintext, err := ioutil.ReadAll(NewShadowsocksReader(bytes.NewReader(ciphertext), cipher))
+	require.NoError(t, err)
+	require.Equal(t, append(payload, "more"...), plaintext)
+}
+
+func TestWriterPaddingRandomizesFirstWrite(t *testing.T) {
+	cipher := newTestCipher(t)
+	policy := &PaddingPolicy{MinChunks: 1, MaxChunks: 4}
+	lengths := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		out := &writeRecorder{}
+		writer := NewShadowsocksWriter(out, cipher)
+		writer.SetPadding(policy)
+		_, err := writer.Write(MakeTestPayload(500))
+		require.NoError(t, err)
+		lengths[len(out.writes[0])] = true
+		// Without empty chunks, every chunk has a payload.
+		for _, size := range readChunkSizes(t, cipher, bytes.Join(out.writes, nil)) {
+			require.Greater(t, size, 0)
+		}
+	}
+	require.Greater(t, len(lengths), 10)
+}
+
+func TestWriterPaddingLazyWrite(t *testing.T) {
+	cipher := newTestCipher(t)
+	out := &writeRecorder{}
+	writer := NewShadowsocksWriter(out, cipher)
+	writer.SetPadding(&PaddingPolicy{MinChunks: 2, MaxChunks: 2})
+	_, err := writer.LazyWrite([]byte("header"))
+	require.NoError(t, err)
+	require.Empty(t, out.writes)
+	require.NoError(t, writer.Flush())
+	require.Len(t, out.writes, 2)
+	sizes := readChunkSizes(t, cipher, bytes.Join(out.writes, nil))
+	require.Len(t, sizes, 2)
+	require.Equal(t, 6, sizes[0]+sizes[1])
+	// The size of the first chunk is visible in the length of the first write.
+	require.Equal(t, cipher.SaltSize()+2+2*testCipherOverhead+sizes[0], len(out.writes[0]))
+}
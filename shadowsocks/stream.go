@@ -32,6 +32,25 @@ const payloadSizeMask = 0x3FFF // 16*1024 - 1
 // The largest buffer we could need is for decrypting a max-length payload.
 var readBufPool = slicepool.MakePool(payloadSizeMask + maxTagSize())
 
+// Buffer pool used for encrypting Shadowsocks streams.
+// The largest message is the salt (first message only), length, length tag,
+// payload, and payload tag.
+var writeBufPool = slicepool.MakePool(maxSaltSize() + 2 + payloadSizeMask + 2*maxTagSize())
+
+// BufferBytesInUse returns the memory held by the buffers that Readers and
+// Writers have acquired from their pools.
+func BufferBytesInUse() int64 {
+	return readBufPool.BytesInUse() + writeBufPool.BytesInUse()
+}
+
+// ReadWaiter is implemented by readers that can wait for data without reading
+// it.  A Writer that reads from a ReadWaiter doesn't hold a buffer while the
+// reader is idle.
+type ReadWaiter interface {
+	// WaitRead blocks until a Read would not block.
+	WaitRead() error
+}
+
 // Writer is an io.Writer that also implements io.ReaderFrom to
 // allow for piping the data without extra allocations and copies.
 // The LazyWrite and Flush methods allow a header to be
@@ -47,12 +66,18 @@ type Writer struct {
 	writer        io.Writer
 	ssCipher      *Cipher
 	saltGenerator SaltGenerator
+	// Randomizes the first write.  Nil if disabled.
+	padding *PaddingPolicy
 	// Wrapper for input that arrives as a slice.
 	byteWrapper bytes.Reader
 	// Number of plaintext bytes that are currently buffered.
 	pending int
+	// Holds a buffer for the salt and the next message, when needed.
+	lazyBuf slicepool.LazySlice
+	// The buffer acquired from lazyBuf, or nil.
+	buf []byte
 	// These are populated by init():
-	buf  []byte
+	salt []byte
 	aead cipher.AEAD
 	// Index of the next encrypted chunk to write.
 	counter []byte
@@ -61,7 +86,12 @@ type Writer struct {
 // NewShadowsocksWriter creates a Writer that encrypts the given Writer using
 // the shadowsocks protocol with the given shadowsocks cipher.
 func NewShadowsocksWriter(writer io.Writer, ssCipher *Cipher) *Writer {
-	return &Writer{writer: writer, ssCipher: ssCipher, saltGenerator: RandomSaltGenerator}
+	return &Writer{
+		writer:        writer,
+		ssCipher:      ssCipher,
+		saltGenerator: RandomSaltGenerator,
+		lazyBuf:       writeBufPool.LazySlice(),
+	}
 }
 
 // SetSaltGenerator sets the salt generator to be used. Must be called before the first write.
@@ -69,8 +99,13 @@ func (sw *Writer) SetSaltGenerator(saltGenerator SaltGenerator) {
 	sw.saltGenerator = saltGenerator
 }
 
-// init generates a random salt, sets up the AEAD object and writes
-// the salt to the inner Writer.
+// SetPadding sets the policy for randomizing the length of the first write.
+// Nil disables it.  Must be called before the first write.
+func (sw *Writer) SetPadding(padding *PaddingPolicy) {
+	sw.padding = padding
+}
+
+// init generates a random salt and sets up the AEAD object.
 func (sw *Writer) init() (err error) {
 	if sw.aead == nil {
 		salt := make([]byte, sw.ssCipher.SaltSize())
@@ -83,17 +118,24 @@ func (sw *Writer) init() (err error) {
 		}
 		sw.saltGenerator = nil // No longer needed, so release reference.
 		sw.counter = make([]byte, sw.aead.NonceSize())
-		// The maximum length message is the salt (first message only), length, length tag,
-		// payload, and payload tag.
-		sizeBufSize := 2 + sw.aead.Overhead()
-		maxPayloadBufSize := payloadSizeMask + sw.aead.Overhead()
-		sw.buf = make([]byte, len(salt)+sizeBufSize+maxPayloadBufSize)
-		// Store the salt at the start of sw.buf.
-		copy(sw.buf, salt)
+		sw.salt = salt
 	}
 	return nil
 }
 
+// acquire takes a buffer from the pool, unless the Writer already holds one.
+func (sw *Writer) acquire() {
+	if sw.buf == nil {
+		sw.buf = sw.lazyBuf.Acquire()
+	}
+}
+
+// release returns the buffer to the pool.  There must be no pending data.
+func (sw *Writer) release() {
+	sw.buf = nil
+	sw.lazyBuf.Release()
+}
+
 // encryptBlock encrypts `plaintext` in-place.  The slice must have enough capacity
 // for the tag. Returns the total ciphertext length.
 func (sw *Writer) encryptBlock(plaintext []byte) int {
@@ -119,6 +161,7 @@ func (sw *Writer) LazyWrite(p []byte) (int, error) {
 	// for a previous call to LazyWrite().
 	sw.mu.Lock()
 	defer sw.mu.Unlock()
+	sw.acquire()
 
 	queued := 0
 	for {
@@ -158,7 +201,7 @@ func isZero(b []byte) bool {
 
 // Returns the slices of sw.buf in which to place plaintext for encryption.
 func (sw *Writer) buffers() (sizeBuf, payloadBuf []byte) {
-	// sw.buf starts with the salt.
+	// sw.buf starts with room for the salt.
 	saltSize := sw.ssCipher.SaltSize()
 
 	// Each Shadowsocks-TCP message consists of a fixed-length size block,
@@ -176,7 +219,6 @@ func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
 	}
 	var written int64
 	var err error
-	_, payloadBuf := sw.buffers()
 
 	// Special case: one thread-safe read, if necessary
 	sw.mu.Lock()
@@ -189,7 +231,8 @@ func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
 		// The first pending+overhead bytes of payloadBuf are potentially
 		// in use, and may be modified on the flush thread.  Data after
 		// that is safe to use on this thread.
-		readBuf := sw.buf[saltsize+2+overhead+pending+overhead:]
+		payloadStart := saltsize + 2 + overhead
+		readBuf := sw.buf[payloadStart+pending+overhead : payloadStart+payloadSizeMask+overhead]
 		var plaintextSize int
 		plaintextSize, err = r.Read(readBuf)
 		written = int64(plaintextSize)
@@ -204,13 +247,27 @@ func (sw *Writer) ReadFrom(r io.Reader) (int64, error) {
 	sw.mu.Unlock()
 
 	// Main transfer loop
+	waiter, _ := r.(ReadWaiter)
+	full := false
 	for err == nil {
+		// Unless the last read filled the buffer, the reader is likely to be idle
+		// for a while, so don't hold a buffer while waiting for it.
+		if waiter != nil && !full {
+			sw.release()
+			if err = waiter.WaitRead(); err != nil {
+				break
+			}
+		}
+		sw.acquire()
+		_, payloadBuf := sw.buffers()
 		sw.pending, err = r.Read(payloadBuf)
 		written += int64(sw.pending)
+		full = sw.pending == len(payloadBuf)
 		if flushErr := sw.flush(); flushErr != nil {
 			err = flushErr
 		}
 	}
+	sw.release()
 
 	if err == io.EOF { // ignore EOF as per io.ReaderFrom contract
 		return written, nil
@@ -232,14 +289,18 @@ func (sw *Writer) flush() error {
 	if sw.pending == 0 {
 		return nil
 	}
-	// sw.buf starts with the salt.
+	// sw.buf starts with room for the salt.
 	saltSize := sw.ssCipher.SaltSize()
-	// Normally we ignore the salt at the beginning of sw.buf.
+	// Normally we ignore the start of sw.buf.
 	start := saltSize
 	if isZero(sw.counter) {
+		if sw.padding != nil {
+			return sw.flushPadded()
+		}
 		// For the first message, include the salt.  Compared to writing the salt
 		// separately, this saves one packet during TCP slow-start and potentially
 		// avoids having a distinctive size for the first packet.
+		copy(sw.buf, sw.salt)
 		start = 0
 	}
 
@@ -252,6 +313,51 @@ func (sw *Writer) flush() error {
 	return err
 }
 
+// Encrypts the first pending data as chunks chosen by sw.padding.  The salt and the
+// first chunk are written together, and the rest of the chunks separately.
+func (sw *Writer) flushPadded() error {
+	saltSize := sw.ssCipher.SaltSize()
+	_, payloadBuf := sw.buffers()
+	payload := payloadBuf[:sw.pending]
+	sw.pending = 0
+	sizes := sw.padding.split(len(payload))
+	empty := sw.padding.emptyChunks()
+	sw.padding = nil // No longer needed, so release reference.
+
+	chunkOverhead := 2 + 2*sw.aead.Overhead()
+	out := make([]byte, 0, saltSize+len(payload)+(empty+len(sizes))*chunkOverhead)
+	out = append(out, sw.salt...)
+	for i := 0; i < empty; i++ {
+		out = sw.sealChunk(out, nil)
+	}
+	out = sw.sealChunk(out, payload[:sizes[0]])
+	if _, err := sw.writer.Write(out); err != nil {
+		return err
+	}
+	payload = payload[sizes[0]:]
+	if len(payload) == 0 {
+		return nil
+	}
+	rest := out[len(out):]
+	for _, size := range sizes[1:] {
+		rest = sw.sealChunk(rest, payload[:size])
+		payload = payload[size:]
+	}
+	_, err := sw.writer.Write(rest)
+	return err
+}
+
+// sealChunk appends the encrypted size and payload of a chunk to `dst`.
+func (sw *Writer) sealChunk(dst, plaintext []byte) []byte {
+	var sizeBuf [2]byte
+	binary.BigEndian.PutUint16(sizeBuf[:], uint16(len(plaintext)))
+	dst = sw.aead.Seal(dst, sw.counter, sizeBuf[:], nil)
+	increment(sw.counter)
+	dst = sw.aead.Seal(dst, sw.counter, plaintext, nil)
+	increment(sw.counter)
+	return dst
+}
+
 // ChunkReader is similar to io.Reader, except that it controls its own
 // buffer granularity.
 type ChunkReader interface {
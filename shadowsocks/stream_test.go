@@ -412,6 +412,73 @@ func TestLazyWriteConcurrentFlush(t *testing.T) {
 	}
 }
 
+// waitingReader reads its chunks one at a time, and records whether the
+// Writer holds a buffer while it waits.
+type waitingReader struct {
+	writer     *Writer
+	chunks     [][]byte
+	waits      int
+	heldBuffer bool
+}
+
+func (r *waitingReader) WaitRead() error {
+	r.waits++
+	if r.writer.buf != nil {
+		r.heldBuffer = true
+	}
+	return nil
+}
+
+func (r *waitingReader) Read(b []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, r.chunks[0])
+	r.chunks[0] = r.chunks[0][n:]
+	if len(r.chunks[0]) == 0 {
+		r.chunks = r.chunks[1:]
+	}
+	return n, nil
+}
+
+func TestWriterReleasesBuffer(t *testing.T) {
+	cipher := newTestCipher(t)
+	buf := new(bytes.Buffer)
+	writer := NewShadowsocksWriter(buf, cipher)
+
+	if _, err := writer.Write([]byte("Request")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if writer.buf != nil {
+		t.Error("Buffer was held after Write")
+	}
+
+	large := bytes.Repeat([]byte{1}, payloadSizeMask+10)
+	source := &waitingReader{writer: writer, chunks: [][]byte{[]byte("Response"), large, []byte("End")}}
+	if _, err := writer.ReadFrom(source); err != nil {
+		t.Fatalf("ReadFrom failed: %v", err)
+	}
+	if source.heldBuffer {
+		t.Error("Buffer was held while waiting")
+	}
+	// No wait is expected after the full read of the large chunk.
+	if source.waits != 4 {
+		t.Errorf("Wrong number of waits: %d", source.waits)
+	}
+	if writer.buf != nil {
+		t.Error("Buffer was held after ReadFrom")
+	}
+
+	decrypted, err := ioutil.ReadAll(NewShadowsocksReader(buf, cipher))
+	if err != nil {
+		t.Fatalf("Read failed: %v", err)
+	}
+	expected := append(append([]byte("RequestResponse"), large...), "End"...)
+	if !bytes.Equal(decrypted, expected) {
+		t.Errorf("Wrong decrypted content")
+	}
+}
+
 type nullIO struct{}
 
 func (n *nullIO) Write(b []byte) (int, error) {